@@ -0,0 +1,173 @@
+// Package admin serves an HTTP API to manage a running Mta:
+//
+//	GET /sessions         the active sessions, as a JSON array
+//	DELETE /sessions/{id} ends a session with a 421
+//	POST /reload          reloads the config with Server.LoadConfig
+//
+// Every request needs the AdminToken of the Config as bearer token.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/mta"
+)
+
+// Server is the admin API of an Mta.
+type Server struct {
+	// Addr is where ListenAndServe listens, Config.AdminAddr by default.
+	Addr string
+	// Token is the bearer token requests need, Config.AdminToken by default.
+	// All requests are refused if it is empty.
+	Token string
+	// LoadConfig returns the config for POST /reload, e.g. from a file.
+	// Nil if the config can't be reloaded.
+	LoadConfig func() (mta.Config, error)
+
+	mta    *mta.Mta
+	server *http.Server
+}
+
+// session is the JSON of a session summary.
+type session struct {
+	Id       string    `json:"id"`
+	Ip       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// NewServer creates the admin API for m, with the AdminAddr and AdminToken of c.
+func NewServer(m *mta.Mta, c mta.Config) *Server {
+	s := &Server{
+		Addr:  c.AdminAddr,
+		Token: c.AdminToken,
+		mta:   m,
+	}
+	s.server = &http.Server{Handler: s}
+	return s
+}
+
+// ListenAndServe listens on Addr and serves the API until Close is called.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the API on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	log.Printf("Admin API listening on %s", l.Addr())
+	err := s.server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/sessions":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		s.listSessions(w)
+	case strings.HasPrefix(r.URL.Path, "/sessions/"):
+		if !allowMethod(w, r, http.MethodDelete) {
+			return
+		}
+		s.killSession(w, strings.TrimPrefix(r.URL.Path, "/sessions/"))
+	case r.URL.Path == "/reload":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		s.reload(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowMethod answers 405 and returns false if r doesn't use method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// authorized checks the bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *Server) listSessions(w http.ResponseWriter) {
+	sessions := []session{}
+	for _, summary := range s.mta.Sessions() {
+		sessions = append(sessions, session{
+			Id:       summary.Id,
+			Ip:       summary.Ip,
+			Hostname: summary.Hostname,
+			Started:  summary.Started,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (s *Server) killSession(w http.ResponseWriter, id string) {
+	if !s.mta.KillSession(id) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	log.WithFields(log.Fields{
+		"SessionId": id,
+	}).Info("Session killed over the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) reload(w http.ResponseWriter) {
+	if s.LoadConfig == nil {
+		http.Error(w, "Reloading is not supported", http.StatusNotImplemented)
+		return
+	}
+	c, err := s.LoadConfig()
+	if err != nil {
+		log.Warnf("Could not load config: %v", err)
+		http.Error(w, "Could not load config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.mta.ReloadConfig(c); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("Config reloaded over the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServer(t *testing.T) {
+	c.Convey("Testing the admin API", t, func() {
+		cfg := mta.Config{Hostname: "home.sweet.home", AdminToken: "secret"}
+		m := mta.New(cfg, mta.HandlerFunc(func(*smtp.State) error { return nil }))
+		s := NewServer(m, cfg)
+
+		request := func(method, path, token string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, path, nil)
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w
+		}
+		sessions := func() []session {
+			w := request(http.MethodGet, "/sessions", "secret")
+			c.So(w.Code, c.ShouldEqual, http.StatusOK)
+			c.So(w.Header().Get("Content-Type"), c.ShouldEqual, "application/json")
+			result := []session{}
+			c.So(json.NewDecoder(w.Body).Decode(&result), c.ShouldBeNil)
+			return result
+		}
+
+		c.Convey("Requests need the token", func() {
+			c.So(request(http.MethodGet, "/sessions", "").Code, c.ShouldEqual, http.StatusUnauthorized)
+			c.So(request(http.MethodGet, "/sessions", "wrong").Code, c.ShouldEqual, http.StatusUnauthorized)
+			c.So(request(http.MethodPost, "/reload", "wrong").Code, c.ShouldEqual, http.StatusUnauthorized)
+
+			s.Token = ""
+			c.So(request(http.MethodGet, "/sessions", "").Code, c.ShouldEqual, http.StatusUnauthorized)
+		})
+
+		c.Convey("Unknown paths and methods are refused", func() {
+			c.So(request(http.MethodGet, "/other", "secret").Code, c.ShouldEqual, http.StatusNotFound)
+			c.So(request(http.MethodPost, "/sessions", "secret").Code, c.ShouldEqual, http.StatusMethodNotAllowed)
+			c.So(request(http.MethodGet, "/sessions/1", "secret").Code, c.ShouldEqual, http.StatusMethodNotAllowed)
+			c.So(request(http.MethodGet, "/reload", "secret").Code, c.ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		c.Convey("Sessions are listed and killed", func() {
+			c.So(sessions(), c.ShouldBeEmpty)
+
+			server, conn := net.Pipe()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			done := make(chan bool)
+			go func() {
+				m.HandleClient(smtp.NewMtaProtocol(server))
+				close(done)
+			}()
+
+			tc := textproto.NewConn(conn)
+			_, _, err := tc.ReadResponse(220)
+			c.So(err, c.ShouldBeNil)
+			c.So(tc.PrintfLine("HELO some.sender"), c.ShouldBeNil)
+			_, _, err = tc.ReadResponse(250)
+			c.So(err, c.ShouldBeNil)
+
+			list := sessions()
+			c.So(list, c.ShouldHaveLength, 1)
+			c.So(list[0].Hostname, c.ShouldEqual, "some.sender")
+			c.So(list[0].Ip, c.ShouldNotBeEmpty)
+
+			c.So(request(http.MethodDelete, "/sessions/unknown", "secret").Code, c.ShouldEqual, http.StatusNotFound)
+			c.So(request(http.MethodDelete, "/sessions/"+list[0].Id, "secret").Code, c.ShouldEqual, http.StatusNoContent)
+
+			_, _, err = tc.ReadResponse(421)
+			c.So(err, c.ShouldBeNil)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Session was not closed")
+			}
+			c.So(sessions(), c.ShouldBeEmpty)
+		})
+
+		c.Convey("The config is reloaded", func() {
+			c.So(request(http.MethodPost, "/reload", "secret").Code, c.ShouldEqual, http.StatusNotImplemented)
+
+			var loadErr error
+			reloaded := cfg
+			s.LoadConfig = func() (mta.Config, error) {
+				return reloaded, loadErr
+			}
+			c.So(request(http.MethodPost, "/reload", "secret").Code, c.ShouldEqual, http.StatusNoContent)
+
+			reloaded.Hostname = "other.host"
+			c.So(request(http.MethodPost, "/reload", "secret").Code, c.ShouldEqual, http.StatusUnprocessableEntity)
+
+			loadErr = errors.New("file not found")
+			c.So(request(http.MethodPost, "/reload", "secret").Code, c.ShouldEqual, http.StatusInternalServerError)
+		})
+
+		c.Convey("The server listens on its own address", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.So(err, c.ShouldBeNil)
+			go s.Serve(l)
+			defer s.Close()
+
+			r, err := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/sessions", nil)
+			c.So(err, c.ShouldBeNil)
+			r.Header.Set("Authorization", "Bearer secret")
+			resp, err := http.DefaultClient.Do(r)
+			c.So(err, c.ShouldBeNil)
+			resp.Body.Close()
+			c.So(resp.StatusCode, c.ShouldEqual, http.StatusOK)
+		})
+	})
+}
@@ -0,0 +1,294 @@
+// Package auth contains backends for AUTH PLAIN of the mta package.
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrInvalidCredentials is returned when the username or password is wrong.
+// The error doesn't tell which one, so usernames can't be guessed.
+var ErrInvalidCredentials = errors.New("auth: invalid username or password")
+
+// Params are the argon2id parameters for new password hashes.
+// Existing hashes are verified with the parameters they were made with.
+type Params struct {
+	// Time is the number of passes over the memory.
+	Time uint32
+	// Memory in KiB.
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultParams are the parameters recommended by the argon2 package.
+var DefaultParams = Params{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// HashPassword hashes a password with DefaultParams.
+func HashPassword(password string) (string, error) {
+	return DefaultParams.Hash(password)
+}
+
+// Hash hashes a password with a random salt. The result is in the PHC
+// string format: $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+func (p Params) Hash(password string) (string, error) {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// hash is a decoded password hash.
+type hash struct {
+	params Params
+	salt   []byte
+	key    []byte
+}
+
+func parseHash(encoded string) (*hash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, errors.New("auth: not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("auth: unsupported argon2 version")
+	}
+
+	h := &hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.params.Memory, &h.params.Time, &h.params.Threads); err != nil {
+		return nil, errors.New("auth: invalid argon2 parameters")
+	}
+	if h.params.Memory == 0 || h.params.Time == 0 || h.params.Threads == 0 {
+		return nil, errors.New("auth: invalid argon2 parameters")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("auth: invalid salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("auth: invalid hash")
+	}
+	h.params.SaltLen = uint32(len(h.salt))
+	h.params.KeyLen = uint32(len(h.key))
+	return h, nil
+}
+
+// matches compares the password in constant time.
+func (h *hash) matches(password string) bool {
+	key := argon2.IDKey([]byte(password), h.salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// VerifyPassword checks a password against a hash made by HashPassword.
+func VerifyPassword(encoded, password string) (bool, error) {
+	h, err := parseHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	return h.matches(password), nil
+}
+
+// SecureAuthBackend is an mta.AuthBackend with argon2id password hashes,
+// read from a file of "username:$argon2id$..." lines. Empty lines and lines
+// starting with # are ignored.
+type SecureAuthBackend struct {
+	path  string
+	lock  sync.RWMutex
+	users map[string]*hash
+	// Hashed for unknown users, so they take as long as wrong passwords.
+	dummy *hash
+}
+
+// NewSecureAuthBackend reads the users from the file at path.
+func NewSecureAuthBackend(path string) (*SecureAuthBackend, error) {
+	b := &SecureAuthBackend{path: path}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads the file again, e.g. after users were changed.
+// The old users are kept if the file is invalid.
+func (b *SecureAuthBackend) Reload() error {
+	entries, err := readUsers(b.path)
+	if err != nil {
+		return err
+	}
+
+	users := map[string]*hash{}
+	params := DefaultParams
+	for _, entry := range entries {
+		if entry.username == "" {
+			continue
+		}
+		h, err := parseHash(entry.hash)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", b.path, entry.line, err)
+		}
+		if len(users) == 0 {
+			params = h.params
+		}
+		users[entry.username] = h
+	}
+
+	// The dummy uses the parameters of the first user, so it costs the same.
+	encoded, err := params.Hash("")
+	if err != nil {
+		return err
+	}
+	dummy, _ := parseHash(encoded)
+
+	b.lock.Lock()
+	b.users = users
+	b.dummy = dummy
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *SecureAuthBackend) Authenticate(username, password string) error {
+	b.lock.RLock()
+	h, ok := b.users[username]
+	if !ok {
+		h = b.dummy
+	}
+	b.lock.RUnlock()
+
+	// Always hash the password, so unknown users can't be told apart by timing.
+	if !h.matches(password) || !ok {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// entry is a line of the users file. Comments and empty lines have no username.
+type entry struct {
+	line     int
+	raw      string
+	username string
+	hash     string
+}
+
+func readUsers(path string) ([]entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []entry{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		e := entry{line: n, raw: scanner.Text()}
+		line := strings.TrimSpace(e.raw)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("%s:%d: expected username:hash", path, n)
+			}
+			e.username, e.hash = parts[0], parts[1]
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// ErrUserExists and ErrUserNotFound are returned when changing the users file.
+var (
+	ErrUserExists   = errors.New("auth: user already exists")
+	ErrUserNotFound = errors.New("auth: user not found")
+)
+
+// AddUser adds a user to the file at path, which is created if it doesn't exist.
+func AddUser(path, username, password string) error {
+	if username == "" || strings.ContainsAny(username, ":\r\n") || strings.HasPrefix(username, "#") {
+		return fmt.Errorf("auth: invalid username %q", username)
+	}
+	entries, err := readUsers(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if e.username == username {
+			return ErrUserExists
+		}
+	}
+
+	encoded, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, entry{raw: username + ":" + encoded})
+	return writeUsers(path, entries)
+}
+
+// ChangePassword changes the password of a user in the file at path.
+func ChangePassword(path, username, password string) error {
+	entries, err := readUsers(path)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.username == username {
+			encoded, err := HashPassword(password)
+			if err != nil {
+				return err
+			}
+			entries[i].raw = username + ":" + encoded
+			return writeUsers(path, entries)
+		}
+	}
+	return ErrUserNotFound
+}
+
+// DeleteUser removes a user from the file at path.
+func DeleteUser(path, username string) error {
+	entries, err := readUsers(path)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.username == username {
+			return writeUsers(path, append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return ErrUserNotFound
+}
+
+// writeUsers replaces the file at path, comments are kept.
+func writeUsers(path string, entries []entry) error {
+	var sb strings.Builder
+	for _, e := range entries {
+		sb.WriteString(e.raw)
+		sb.WriteString("\n")
+	}
+	// Write a temporary file first, so the file is never half written.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(sb.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
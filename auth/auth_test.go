@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+func init() {
+	// Cheaper hashes, so the tests are fast.
+	DefaultParams = Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+}
+
+func tempUsersFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "users")
+	if content != "" {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestHashPassword(t *testing.T) {
+	c.Convey("Testing HashPassword", t, func() {
+		encoded, err := HashPassword("secret")
+		c.So(err, c.ShouldBeNil)
+		c.So(encoded, c.ShouldStartWith, "$argon2id$v=19$m=8192,t=1,p=1$")
+
+		other, err := HashPassword("secret")
+		c.So(err, c.ShouldBeNil)
+		c.So(other, c.ShouldNotEqual, encoded)
+
+		ok, err := VerifyPassword(encoded, "secret")
+		c.So(err, c.ShouldBeNil)
+		c.So(ok, c.ShouldBeTrue)
+
+		ok, err = VerifyPassword(encoded, "Secret")
+		c.So(err, c.ShouldBeNil)
+		c.So(ok, c.ShouldBeFalse)
+
+		for _, invalid := range []string{"", "secret", "$2a$10$abc", "$argon2i$v=19$m=8192,t=1,p=1$c2FsdA$aGFzaA", "$argon2id$v=16$m=8192,t=1,p=1$c2FsdA$aGFzaA", "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$aGFzaA", "$argon2id$v=19$m=8192,t=1,p=1$!!$aGFzaA"} {
+			_, err := VerifyPassword(invalid, "secret")
+			c.So(err, c.ShouldNotBeNil)
+		}
+	})
+}
+
+func TestSecureAuthBackend(t *testing.T) {
+	alice, _ := HashPassword("alice's secret")
+	bob, _ := HashPassword("bob's secret")
+	path, cleanup := tempUsersFile(t, "# Users\n\nalice:"+alice+"\n  # bob left\nbob:"+bob+"\n")
+	defer cleanup()
+
+	c.Convey("Testing SecureAuthBackend", t, func() {
+		b, err := NewSecureAuthBackend(path)
+		c.So(err, c.ShouldBeNil)
+
+		c.So(b.Authenticate("alice", "alice's secret"), c.ShouldBeNil)
+		c.So(b.Authenticate("bob", "bob's secret"), c.ShouldBeNil)
+		c.So(b.Authenticate("alice", "bob's secret"), c.ShouldEqual, ErrInvalidCredentials)
+		c.So(b.Authenticate("alice", ""), c.ShouldEqual, ErrInvalidCredentials)
+		c.So(b.Authenticate("carol", "alice's secret"), c.ShouldEqual, ErrInvalidCredentials)
+		c.So(b.Authenticate("", ""), c.ShouldEqual, ErrInvalidCredentials)
+	})
+
+	c.Convey("Testing the timing of SecureAuthBackend", t, func() {
+		b, err := NewSecureAuthBackend(path)
+		c.So(err, c.ShouldBeNil)
+
+		median := func(username string) time.Duration {
+			durations := []time.Duration{}
+			for i := 0; i < 15; i++ {
+				start := time.Now()
+				b.Authenticate(username, "wrong")
+				durations = append(durations, time.Since(start))
+			}
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			return durations[len(durations)/2]
+		}
+
+		// Unknown users are hashed as well, so they take as long as known users.
+		known, unknown := median("alice"), median("carol")
+		ratio := float64(unknown) / float64(known)
+		c.So(ratio, c.ShouldBeBetween, 0.5, 2)
+	})
+
+	c.Convey("Testing invalid files", t, func() {
+		_, err := NewSecureAuthBackend(path + ".missing")
+		c.So(err, c.ShouldNotBeNil)
+
+		for _, content := range []string{"alice\n", ":" + alice + "\n", "alice:secret\n"} {
+			invalid, cleanup := tempUsersFile(t, content)
+			_, err := NewSecureAuthBackend(invalid)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err.Error(), c.ShouldContainSubstring, ":1:")
+			cleanup()
+		}
+	})
+}
+
+func TestManageUsers(t *testing.T) {
+	path, cleanup := tempUsersFile(t, "# Our users\n")
+	defer cleanup()
+
+	c.Convey("Testing AddUser, ChangePassword and DeleteUser", t, func() {
+		c.So(AddUser(path, "alice", "first"), c.ShouldBeNil)
+		c.So(AddUser(path, "bob", "second"), c.ShouldBeNil)
+		c.So(AddUser(path, "alice", "again"), c.ShouldEqual, ErrUserExists)
+		c.So(AddUser(path, "eve:admin", "third"), c.ShouldNotBeNil)
+		c.So(AddUser(path, "#eve", "third"), c.ShouldNotBeNil)
+
+		b, err := NewSecureAuthBackend(path)
+		c.So(err, c.ShouldBeNil)
+		c.So(b.Authenticate("alice", "first"), c.ShouldBeNil)
+		c.So(b.Authenticate("bob", "second"), c.ShouldBeNil)
+
+		c.So(ChangePassword(path, "alice", "changed"), c.ShouldBeNil)
+		c.So(ChangePassword(path, "carol", "changed"), c.ShouldEqual, ErrUserNotFound)
+		c.So(DeleteUser(path, "bob"), c.ShouldBeNil)
+		c.So(DeleteUser(path, "bob"), c.ShouldEqual, ErrUserNotFound)
+
+		c.So(b.Reload(), c.ShouldBeNil)
+		c.So(b.Authenticate("alice", "first"), c.ShouldEqual, ErrInvalidCredentials)
+		c.So(b.Authenticate("alice", "changed"), c.ShouldBeNil)
+		c.So(b.Authenticate("bob", "second"), c.ShouldEqual, ErrInvalidCredentials)
+
+		// Comments are kept.
+		content, err := ioutil.ReadFile(path)
+		c.So(err, c.ShouldBeNil)
+		c.So(string(content), c.ShouldStartWith, "# Our users\nalice:$argon2id$")
+		c.So(strings.Count(string(content), "\n"), c.ShouldEqual, 2)
+	})
+
+	c.Convey("Testing AddUser with a new file", t, func() {
+		newPath := path + ".new"
+		defer os.Remove(newPath)
+		c.So(AddUser(newPath, "alice", "first"), c.ShouldBeNil)
+		b, err := NewSecureAuthBackend(newPath)
+		c.So(err, c.ShouldBeNil)
+		c.So(b.Authenticate("alice", "first"), c.ShouldBeNil)
+	})
+}
@@ -0,0 +1,367 @@
+// Package scram implements the SCRAM-SHA-256 SASL mechanism (RFC 5802, RFC 7677)
+// for AUTH of the mta package.
+//
+// Channel binding (SCRAM-SHA-256-PLUS) and SASLprep are not supported,
+// usernames and passwords are used as they are.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Mechanism is the SASL name of the mechanism.
+const Mechanism = "SCRAM-SHA-256"
+
+// DefaultIterations is the iteration count for new credentials, the minimum
+// RFC 7677 recommends.
+const DefaultIterations = 4096
+
+var (
+	// ErrInvalidCredentials is returned when the username or password is wrong.
+	ErrInvalidCredentials = errors.New("scram: invalid username or password")
+	// ErrUnknownUser is returned by a store that doesn't have the user.
+	ErrUnknownUser = errors.New("scram: unknown user")
+	// ErrInvalidMessage is returned for messages that don't follow the
+	// protocol or use unsupported features, errors.Is matches them all.
+	ErrInvalidMessage = errors.New("scram: invalid message")
+)
+
+// Credentials are what the server stores of a password: the salted password
+// can't be recovered from them, and they can't be used to log in.
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials salts and iterates a password with a random salt.
+func NewCredentials(password string, iterations int) (Credentials, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return Credentials{}, err
+	}
+	salted := saltPassword(password, salt, iterations)
+	return Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  hash(hmacSum(salted, "Client Key")),
+		ServerKey:  hmacSum(salted, "Server Key"),
+	}, nil
+}
+
+func saltPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+func hmacSum(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func hash(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+// nonce returns a random nonce, the tests replace it.
+var nonce = func() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// Store is an in-memory ScramAuthBackend of the mta package.
+type Store struct {
+	lock  sync.RWMutex
+	users map[string]Credentials
+}
+
+// NewStore creates an empty store.
+func NewStore() *Store {
+	return &Store{users: map[string]Credentials{}}
+}
+
+// Add adds or replaces a user, with DefaultIterations.
+func (s *Store) Add(username, password string) error {
+	credentials, err := NewCredentials(password, DefaultIterations)
+	if err != nil {
+		return err
+	}
+	s.Set(username, credentials)
+	return nil
+}
+
+// Set adds or replaces a user with stored credentials.
+func (s *Store) Set(username string, credentials Credentials) {
+	s.lock.Lock()
+	s.users[username] = credentials
+	s.lock.Unlock()
+}
+
+// Credentials returns the credentials of a user, ErrUnknownUser if there is none.
+func (s *Store) Credentials(username string) (Credentials, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	credentials, ok := s.users[username]
+	if !ok {
+		return Credentials{}, ErrUnknownUser
+	}
+	return credentials, nil
+}
+
+// parseAttributes parses the "k=value" attributes of a message.
+// The keys are checked against keys, optional ones end in "?". Extensions
+// after them are ignored.
+func parseAttributes(message string, keys ...string) (map[string]string, error) {
+	parts := strings.Split(message, ",")
+	attributes := map[string]string{}
+	i := 0
+	for _, key := range keys {
+		optional := strings.HasSuffix(key, "?")
+		key = strings.TrimSuffix(key, "?")
+		if i < len(parts) && strings.HasPrefix(parts[i], key+"=") {
+			attributes[key] = parts[i][len(key)+1:]
+			i++
+		} else if !optional {
+			return nil, ErrInvalidMessage
+		}
+	}
+	return attributes, nil
+}
+
+// decodeName decodes a saslname, ',' and '=' are "=2C" and "=3D".
+func decodeName(name string) (string, error) {
+	decoded := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+	if strings.Count(name, "=") != strings.Count(name, "=2C")+strings.Count(name, "=3D") {
+		return "", ErrInvalidMessage
+	}
+	return decoded, nil
+}
+
+func encodeName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// Server is the server side of one SCRAM exchange:
+// client-first, server-first, client-final and server-final.
+type Server struct {
+	lookup func(username string) (Credentials, error)
+
+	username        string
+	credentials     Credentials
+	unknown         bool
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+// NewServer starts an exchange, lookup returns the credentials of a user.
+func NewServer(lookup func(username string) (Credentials, error)) *Server {
+	return &Server{lookup: lookup}
+}
+
+// Username returns the user of the exchange, after Start.
+func (s *Server) Username() string {
+	return s.username
+}
+
+// Start handles the client-first message and returns the server-first message.
+// An error is returned if the message is invalid or the credentials can't be
+// looked up. Unknown users get fake credentials, and fail in Finish.
+func (s *Server) Start(clientFirst []byte) ([]byte, error) {
+	message := string(clientFirst)
+
+	// gs2-header: the channel binding flag and the authzid.
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidMessage
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		// "p=" asks for channel binding.
+		return nil, fmt.Errorf("%w: channel binding is not supported", ErrInvalidMessage)
+	}
+	authzid := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, ErrInvalidMessage
+		}
+		var err error
+		if authzid, err = decodeName(parts[1][2:]); err != nil {
+			return nil, err
+		}
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attributes, err := parseAttributes(s.clientFirstBare, "m?", "n", "r")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attributes["m"]; ok {
+		return nil, fmt.Errorf("%w: unsupported extension", ErrInvalidMessage)
+	}
+	if s.username, err = decodeName(attributes["n"]); err != nil || s.username == "" {
+		return nil, ErrInvalidMessage
+	}
+	if authzid != "" && authzid != s.username {
+		return nil, ErrInvalidCredentials
+	}
+	clientNonce := attributes["r"]
+	if clientNonce == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	s.credentials, err = s.lookup(s.username)
+	if err == ErrUnknownUser {
+		// Don't tell that the user doesn't exist.
+		s.unknown = true
+		s.credentials, err = NewCredentials("", DefaultIterations)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serverNonce, err := nonce()
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.credentials.Salt), s.credentials.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+// Finish handles the client-final message and returns the server-final
+// message. ErrInvalidCredentials is returned if the proof is wrong.
+func (s *Server) Finish(clientFinal []byte) ([]byte, error) {
+	message := string(clientFinal)
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, ErrInvalidMessage
+	}
+	withoutProof := message[:i]
+	proof, err := base64.StdEncoding.DecodeString(message[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrInvalidMessage
+	}
+
+	attributes, err := parseAttributes(withoutProof, "c", "r")
+	if err != nil {
+		return nil, err
+	}
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attributes["r"] != s.nonce {
+		return nil, ErrInvalidMessage
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := hmacSum(s.credentials.StoredKey, authMessage)
+	clientKey := xor(proof, clientSignature)
+	if subtle.ConstantTimeCompare(hash(clientKey), s.credentials.StoredKey) != 1 || s.unknown {
+		return nil, ErrInvalidCredentials
+	}
+
+	serverSignature := hmacSum(s.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// Client is the client side of one SCRAM exchange, without authzid.
+type Client struct {
+	username string
+	password string
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+// NewClient starts an exchange.
+func NewClient(username, password string) *Client {
+	return &Client{username: username, password: password}
+}
+
+// First returns the client-first message.
+func (c *Client) First() ([]byte, error) {
+	clientNonce, err := nonce()
+	if err != nil {
+		return nil, err
+	}
+	c.clientFirstBare = "n=" + encodeName(c.username) + ",r=" + clientNonce
+	return []byte("n,," + c.clientFirstBare), nil
+}
+
+// Final handles the server-first message and returns the client-final message.
+func (c *Client) Final(serverFirst []byte) ([]byte, error) {
+	attributes, err := parseAttributes(string(serverFirst), "m?", "r", "s", "i")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attributes["m"]; ok {
+		return nil, fmt.Errorf("%w: unsupported extension", ErrInvalidMessage)
+	}
+	serverNonce := attributes["r"]
+	clientNonce := strings.TrimPrefix(c.clientFirstBare[strings.Index(c.clientFirstBare, ",r="):], ",r=")
+	if !strings.HasPrefix(serverNonce, clientNonce) || len(serverNonce) == len(clientNonce) {
+		return nil, ErrInvalidMessage
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return nil, ErrInvalidMessage
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + serverNonce
+	c.authMessage = c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	c.saltedPassword = saltPassword(c.password, salt, iterations)
+	clientKey := hmacSum(c.saltedPassword, "Client Key")
+	clientSignature := hmacSum(hash(clientKey), c.authMessage)
+	proof := xor(clientKey, clientSignature)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks the server-final message, so the client knows the server
+// has the credentials.
+func (c *Client) Verify(serverFinal []byte) error {
+	message := string(serverFinal)
+	if strings.HasPrefix(message, "e=") {
+		return fmt.Errorf("scram: server error: %s", message[2:])
+	}
+	attributes, err := parseAttributes(message, "v")
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil {
+		return ErrInvalidMessage
+	}
+	expected := hmacSum(hmacSum(c.saltedPassword, "Server Key"), c.authMessage)
+	if !hmac.Equal(signature, expected) {
+		return errors.New("scram: invalid server signature")
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package scram
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+// exchange runs a SCRAM exchange between a Client and a Server.
+func exchange(store *Store, username, password string) (*Client, *Server, []byte, error) {
+	client := NewClient(username, password)
+	server := NewServer(store.Credentials)
+
+	clientFirst, err := client.First()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serverFirst, err := server.Start(clientFirst)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	clientFinal, err := client.Final(serverFirst)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serverFinal, err := server.Finish(clientFinal)
+	return client, server, serverFinal, err
+}
+
+func TestExchange(t *testing.T) {
+	store := NewStore()
+	if err := store.Add("user", "pencil"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("a,b=c", "pencil"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Convey("Testing a SCRAM exchange", t, func() {
+		client, server, serverFinal, err := exchange(store, "user", "pencil")
+		c.So(err, c.ShouldBeNil)
+		c.So(server.Username(), c.ShouldEqual, "user")
+		c.So(client.Verify(serverFinal), c.ShouldBeNil)
+
+		_, server, _, err = exchange(store, "a,b=c", "pencil")
+		c.So(err, c.ShouldBeNil)
+		c.So(server.Username(), c.ShouldEqual, "a,b=c")
+	})
+
+	c.Convey("Testing a SCRAM exchange with invalid credentials", t, func() {
+		_, _, _, err := exchange(store, "user", "pen")
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+
+		// Unknown users only fail at the end.
+		_, _, _, err = exchange(store, "nobody", "pencil")
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+	})
+
+	c.Convey("Testing a server without the credentials", t, func() {
+		other := NewStore()
+		credentials, _ := store.Credentials("user")
+		credentials.ServerKey = make([]byte, len(credentials.ServerKey))
+		other.Set("user", credentials)
+
+		client, _, serverFinal, err := exchange(other, "user", "pencil")
+		c.So(err, c.ShouldBeNil)
+		c.So(client.Verify(serverFinal), c.ShouldNotBeNil)
+		c.So(client.Verify([]byte("e=other-error")), c.ShouldNotBeNil)
+	})
+
+	c.Convey("Testing invalid client messages", t, func() {
+		for _, clientFirst := range []string{
+			"",
+			"n,,r=abc",
+			"p=tls-unique,,n=user,r=abc",
+			"n,,m=ext,n=user,r=abc",
+			"n,,n=user,r=",
+			"n,,n=us=er,r=abc",
+			"x,,n=user,r=abc",
+		} {
+			_, err := NewServer(store.Credentials).Start([]byte(clientFirst))
+			c.So(errors.Is(err, ErrInvalidMessage), c.ShouldBeTrue)
+		}
+
+		_, err := NewServer(store.Credentials).Start([]byte("n,a=other,n=user,r=abc"))
+		c.So(err, c.ShouldEqual, ErrInvalidCredentials)
+
+		server := NewServer(store.Credentials)
+		_, err = server.Start([]byte("n,,n=user,r=abc"))
+		c.So(err, c.ShouldBeNil)
+		for _, clientFinal := range []string{
+			"",
+			"c=biws,r=abc,p=!!!",
+			"c=biws,r=abc,p=" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+			"c=eSws,r=" + server.nonce + ",p=" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		} {
+			_, err := server.Finish([]byte(clientFinal))
+			c.So(errors.Is(err, ErrInvalidMessage), c.ShouldBeTrue)
+		}
+	})
+
+	c.Convey("Testing backend errors", t, func() {
+		backendErr := errors.New("backend down")
+		server := NewServer(func(username string) (Credentials, error) {
+			return Credentials{}, backendErr
+		})
+		_, err := server.Start([]byte("n,,n=user,r=abc"))
+		c.So(err, c.ShouldEqual, backendErr)
+	})
+}
+
+// The example of RFC 7677 3.
+func TestRFC7677(t *testing.T) {
+	defer func(original func() (string, error)) { nonce = original }(nonce)
+
+	c.Convey("Testing the RFC 7677 example", t, func() {
+		salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+		salted := saltPassword("pencil", salt, 4096)
+		store := NewStore()
+		store.Set("user", Credentials{
+			Salt:       salt,
+			Iterations: 4096,
+			StoredKey:  hash(hmacSum(salted, "Client Key")),
+			ServerKey:  hmacSum(salted, "Server Key"),
+		})
+
+		client := NewClient("user", "pencil")
+		server := NewServer(store.Credentials)
+
+		nonce = func() (string, error) { return "rOprNGfwEbeRWgbNEkqO", nil }
+		clientFirst, err := client.First()
+		c.So(err, c.ShouldBeNil)
+		c.So(string(clientFirst), c.ShouldEqual, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO")
+
+		nonce = func() (string, error) { return "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", nil }
+		serverFirst, err := server.Start(clientFirst)
+		c.So(err, c.ShouldBeNil)
+		c.So(string(serverFirst), c.ShouldEqual, "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+
+		clientFinal, err := client.Final(serverFirst)
+		c.So(err, c.ShouldBeNil)
+		c.So(string(clientFinal), c.ShouldEqual, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+
+		serverFinal, err := server.Finish(clientFinal)
+		c.So(err, c.ShouldBeNil)
+		c.So(string(serverFinal), c.ShouldEqual, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+		c.So(client.Verify(serverFinal), c.ShouldBeNil)
+	})
+}
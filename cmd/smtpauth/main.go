@@ -0,0 +1,72 @@
+// Command smtpauth manages the users file of auth.SecureAuthBackend.
+//
+// The password is read from the first line of stdin.
+//
+//	smtpauth --file users add alice
+//	smtpauth --file users passwd alice
+//	smtpauth --file users delete alice
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gopistolet/smtp/auth"
+)
+
+func main() {
+	file := flag.String("file", "users", "users file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--file users] add|passwd|delete <username>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, username := flag.Arg(0), flag.Arg(1)
+
+	var err error
+	switch command {
+	case "add":
+		var password string
+		if password, err = readPassword(); err == nil {
+			err = auth.AddUser(*file, username, password)
+		}
+	case "passwd":
+		var password string
+		if password, err = readPassword(); err == nil {
+			err = auth.ChangePassword(*file, username, password)
+		}
+	case "delete":
+		err = auth.DeleteUser(*file, username)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// readPassword reads the password from the first line of stdin.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password given")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("the password can't be empty")
+	}
+	return password, nil
+}
@@ -0,0 +1,193 @@
+// Command smtpbench measures the throughput of an SMTP server.
+//
+// It starts a number of concurrent outbound clients, which each send a number
+// of messages over their own connection to the server, and prints the latency
+// percentiles and the number of messages per second.
+//
+//	smtpbench --target 127.0.0.1:25 --concurrency 10 --messages 100
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gopistolet/smtp/outbound"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+type options struct {
+	target      string
+	concurrency int
+	messages    int
+	bodySize    int
+	from        string
+	to          string
+}
+
+// Results of a benchmark run. Durations are in milliseconds in the JSON output.
+type results struct {
+	Messages   int     `json:"messages"`
+	Errors     int     `json:"errors"`
+	Seconds    float64 `json:"seconds"`
+	Throughput float64 `json:"messages_per_second"`
+	P50        float64 `json:"p50_ms"`
+	P95        float64 `json:"p95_ms"`
+	P99        float64 `json:"p99_ms"`
+}
+
+func main() {
+	opts := options{}
+	flag.StringVar(&opts.target, "target", "127.0.0.1:25", "address of the SMTP server")
+	flag.IntVar(&opts.concurrency, "concurrency", 10, "number of concurrent connections")
+	flag.IntVar(&opts.messages, "messages", 100, "number of messages per connection")
+	flag.IntVar(&opts.bodySize, "body-size", 1024, "size of the message body in bytes")
+	flag.StringVar(&opts.from, "from", "bench@example.com", "envelope sender")
+	flag.StringVar(&opts.to, "to", "bench@example.com", "envelope recipient")
+	asJSON := flag.Bool("json", false, "print the results as JSON")
+	flag.Parse()
+
+	if opts.concurrency < 1 || opts.messages < 1 || opts.bodySize < 0 {
+		fmt.Fprintln(os.Stderr, "concurrency and messages should be at least 1, body-size can't be negative")
+		os.Exit(2)
+	}
+
+	res := run(opts)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Messages\t%d\n", res.Messages)
+		fmt.Fprintf(w, "Errors\t%d\n", res.Errors)
+		fmt.Fprintf(w, "Duration\t%.2fs\n", res.Seconds)
+		fmt.Fprintf(w, "Throughput\t%.1f msg/s\n", res.Throughput)
+		fmt.Fprintf(w, "p50\t%.2fms\n", res.P50)
+		fmt.Fprintf(w, "p95\t%.2fms\n", res.P95)
+		fmt.Fprintf(w, "p99\t%.2fms\n", res.P99)
+		w.Flush()
+	}
+
+	if res.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// run starts the clients and waits untill they are done.
+func run(opts options) results {
+	msg := message(opts)
+
+	var mutex sync.Mutex
+	latencies := []time.Duration{}
+	errors := 0
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, errs := client(opts, msg)
+			mutex.Lock()
+			latencies = append(latencies, l...)
+			errors += errs
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return results{
+		Messages:   len(latencies),
+		Errors:     errors,
+		Seconds:    elapsed.Seconds(),
+		Throughput: float64(len(latencies)) / elapsed.Seconds(),
+		P50:        percentile(latencies, 50),
+		P95:        percentile(latencies, 95),
+		P99:        percentile(latencies, 99),
+	}
+}
+
+// client sends the messages with its own outbound client. The connection is
+// kept in a pool for the next message, and replaced when a message failed.
+func client(opts options, msg []byte) ([]time.Duration, int) {
+	pool := &outbound.ConnectionPool{}
+	defer pool.Close()
+	c := &outbound.Client{
+		Hostname: "smtpbench.localhost",
+		// Benchmark the server, not the TLS handshakes.
+		DisableOpportunisticTLS: true,
+		Pool:                    pool,
+	}
+
+	from, err := smtp.ParseAddress(opts.from)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid from address: %v\n", err)
+		return nil, opts.messages
+	}
+	to, err := smtp.ParseAddress(opts.to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid to address: %v\n", err)
+		return nil, opts.messages
+	}
+	state := &smtp.State{
+		From: &from,
+		To:   []*smtp.MailAddress{&to},
+		Data: msg,
+	}
+
+	latencies := []time.Duration{}
+	errors := 0
+	for i := 0; i < opts.messages; i++ {
+		start := time.Now()
+		if err := c.Deliver(opts.target, state); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not send message: %v\n", err)
+			errors++
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	return latencies, errors
+}
+
+// message builds a message with a body of opts.bodySize bytes.
+func message(opts options) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: <%s>\r\n", opts.from)
+	fmt.Fprintf(&b, "To: <%s>\r\n", opts.to)
+	b.WriteString("Subject: smtpbench\r\n\r\n")
+
+	line := bytes.Repeat([]byte("x"), 76)
+	for size := opts.bodySize; size > 0; size -= len(line) + 2 {
+		if size < len(line)+2 {
+			line = line[:0]
+			if size > 2 {
+				line = bytes.Repeat([]byte("x"), size-2)
+			}
+		}
+		b.Write(line)
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// percentile returns the p-th percentile of the sorted latencies in milliseconds.
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
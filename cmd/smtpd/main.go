@@ -0,0 +1,201 @@
+// Command smtpd is an SMTP server for development and testing.
+//
+// It is configured with environment variables and writes every mail it
+// receives as a .eml file to a directory:
+//
+//	SMTP_PORT      port to listen on (2525)
+//	SMTP_HOSTNAME  hostname in the greeting (the hostname of the machine)
+//	SMTP_TLS_CERT  certificate file for STARTTLS
+//	SMTP_TLS_KEY   key file for STARTTLS
+//	SMTP_MAX_SIZE  maximum message size in bytes (no limit)
+//	SMTP_AUTH_FILE users file for AUTH PLAIN, made with smtpauth,
+//	               which is only offered after STARTTLS
+//	SMTP_MAILDIR   directory for the .eml files (./mail)
+//
+// The server stops on SIGINT or SIGTERM.
+//
+// If stdin is not a terminal, smtpd serves a single session over stdin and
+// stdout instead of listening, and exits when it is done:
+//
+//	printf 'EHLO foo\r\nQUIT\r\n' | smtpd
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gopistolet/smtp/auth"
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Config is the mta.Config with the settings of the command itself.
+type Config struct {
+	mta.Config
+	// Maildir is the directory the mails are written to.
+	Maildir string
+	// AuthFile contains the users for AUTH PLAIN, empty to disable AUTH.
+	AuthFile string
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(cfg.Maildir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if cfg.AuthFile != "" {
+		backend, err := auth.NewSecureAuthBackend(cfg.AuthFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.AuthBackend = backend
+	}
+
+	if piped() {
+		// Stdout is the session, so we report on stderr.
+		handler := &maildirHandler{dir: cfg.Maildir, out: os.Stderr}
+		mta.New(cfg.Config, handler).HandleClient(smtp.NewPipeProtocol(os.Stdin, os.Stdout))
+		return
+	}
+
+	printSummary(cfg)
+
+	server := mta.NewDefault(cfg.Config, &maildirHandler{dir: cfg.Maildir, out: os.Stdout})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Stop()
+	}()
+
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads the config from the environment.
+func loadConfig() (Config, error) {
+	cfg := Config{
+		Config: mta.Config{
+			Port:    2525,
+			TlsCert: os.Getenv("SMTP_TLS_CERT"),
+			TlsKey:  os.Getenv("SMTP_TLS_KEY"),
+		},
+		Maildir:  os.Getenv("SMTP_MAILDIR"),
+		AuthFile: os.Getenv("SMTP_AUTH_FILE"),
+	}
+
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SMTP_PORT %q", port)
+		}
+		cfg.Port = uint32(p)
+	}
+
+	cfg.Hostname = os.Getenv("SMTP_HOSTNAME")
+	if cfg.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return cfg, fmt.Errorf("could not get the hostname, set SMTP_HOSTNAME: %v", err)
+		}
+		cfg.Hostname = hostname
+	}
+
+	if (cfg.TlsCert == "") != (cfg.TlsKey == "") {
+		return cfg, errors.New("SMTP_TLS_CERT and SMTP_TLS_KEY should be set together")
+	}
+
+	if size := os.Getenv("SMTP_MAX_SIZE"); size != "" {
+		maxSize, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || maxSize < 0 {
+			return cfg, fmt.Errorf("invalid SMTP_MAX_SIZE %q", size)
+		}
+		cfg.DomainPolicies = map[string]mta.DomainPolicy{
+			"*": {MaxMessageSize: maxSize},
+		}
+	}
+
+	if cfg.Maildir == "" {
+		cfg.Maildir = "mail"
+	}
+	return cfg, nil
+}
+
+// piped tells if stdin is a pipe or file instead of a terminal.
+func piped() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+func printSummary(cfg Config) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Listening on\t:%d\n", cfg.Port)
+	fmt.Fprintf(w, "Hostname\t%s\n", cfg.Hostname)
+	if cfg.TlsCert != "" {
+		fmt.Fprintf(w, "STARTTLS\t%s\n", cfg.TlsCert)
+	} else {
+		fmt.Fprintf(w, "STARTTLS\tdisabled\n")
+	}
+	if size := cfg.DomainPolicies["*"].MaxMessageSize; size > 0 {
+		fmt.Fprintf(w, "Max size\t%d bytes\n", size)
+	} else {
+		fmt.Fprintf(w, "Max size\tno limit\n")
+	}
+	if cfg.AuthFile != "" {
+		fmt.Fprintf(w, "AUTH\tusers from %s\n", cfg.AuthFile)
+	} else {
+		fmt.Fprintf(w, "AUTH\tdisabled\n")
+	}
+	fmt.Fprintf(w, "Maildir\t%s\n", cfg.Maildir)
+	w.Flush()
+}
+
+// maildirHandler writes the mails to a directory.
+type maildirHandler struct {
+	dir string
+	// The received mails are reported to out.
+	out io.Writer
+	// Makes the file names unique.
+	count uint64
+}
+
+func (h *maildirHandler) Handle(state *smtp.State) error {
+	name := fmt.Sprintf("%d-%s-%d.eml", time.Now().Unix(), state.SessionId.String(), atomic.AddUint64(&h.count, 1))
+
+	// The mail has LF line endings, .eml files use CRLF.
+	data := bytes.Replace(state.Data, []byte("\n"), []byte("\r\n"), -1)
+
+	// Write to a temporary file first, so readers never see half a mail.
+	tmp := filepath.Join(h.dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return mta.TempError{Err: err}
+	}
+	if err := os.Rename(tmp, filepath.Join(h.dir, name)); err != nil {
+		os.Remove(tmp)
+		return mta.TempError{Err: err}
+	}
+	fmt.Fprintf(h.out, "Received mail from %s for %d recipients: %s\n", state.From.GetAddress(), len(state.To), name)
+	return nil
+}
@@ -0,0 +1,53 @@
+// Command spfutil prints the SPF record for a mail server, to publish as TXT
+// record of the domains it sends mail for:
+//
+//	spfutil --ip 192.0.2.1 --hostname mail.example.com
+//	v=spf1 ip4:192.0.2.1 mx a include:mail.example.com ~all
+//
+// With --check it validates an existing record instead:
+//
+//	spfutil --check "v=spf1 mx -all"
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/gopistolet/smtp/mta"
+)
+
+func main() {
+	ip := flag.String("ip", "", "ip address the server sends mail from")
+	hostname := flag.String("hostname", "", "hostname of the server")
+	all := flag.String("all", "~all", "the final all mechanism, e.g. -all")
+	check := flag.String("check", "", "SPF record to validate")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s --ip <ip> [--hostname <hostname>] [--all -all]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s --check <record>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *check != "" {
+		if err := mta.ValidateSPFRecord(*check); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("OK")
+		return
+	}
+
+	parsed := net.ParseIP(*ip)
+	if parsed == nil || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	record := mta.GenerateSPFRecord(parsed, *hostname, *all)
+	if err := mta.ValidateSPFRecord(record); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(record)
+}
@@ -0,0 +1,50 @@
+// Command tlscheck checks a certificate and key for the STARTTLS of the
+// server, like the server does at startup.
+//
+//	tlscheck --cert cert.pem --key key.pem --hostname mx.example.com
+//
+// It prints the problems it finds, and exits with 1 if TLS can't work.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gopistolet/smtp/mta"
+)
+
+func main() {
+	certFile := flag.String("cert", "", "certificate file")
+	keyFile := flag.String("key", "", "key file")
+	hostname := flag.String("hostname", "", "hostname the certificate should be valid for")
+	flag.Parse()
+
+	if *certFile == "" || *keyFile == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := mta.ValidateTLS(*certFile, *keyFile, *hostname)
+	warnings, ok := err.(mta.TLSWarnings)
+	if err != nil && !ok {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, warning := range warnings {
+		if warning.IsError() {
+			failed = true
+			fmt.Printf("error: %s\n", warning)
+		} else {
+			fmt.Printf("warning: %s\n", warning)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	if len(warnings) == 0 {
+		fmt.Println("OK")
+	}
+}
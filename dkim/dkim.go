@@ -0,0 +1,457 @@
+// Package dkim verifies DKIM signatures (RFC 6376) for the DKIMVerifier of
+// the mta package, and signs messages with MultiKeySigner. The rsa-sha256
+// and ed25519-sha256 (RFC 8463) algorithms are supported, rsa-sha1
+// signatures are not accepted (RFC 8301).
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Verdicts of a DKIMResult.
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	None      = "none"
+	PermError = "permerror"
+	TempError = "temperror"
+)
+
+// minRSABits is the minimum size of RSA keys (RFC 8301).
+const minRSABits = 1024
+
+// TXTResolver looks up TXT records, e.g. a net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Verifier verifies the DKIM signatures of messages.
+type Verifier struct {
+	// Resolver looks up the keys. If nil net.DefaultResolver is used.
+	Resolver TXTResolver
+	// Timeout for all key lookups of a message. Defaults to 10 seconds.
+	Timeout time.Duration
+	// MaxSignatures is the maximum number of signatures that are verified,
+	// 5 if 0. Other signatures are ignored.
+	MaxSignatures int
+}
+
+// Verify verifies the DKIM-Signature headers of data, a message with LF or
+// CRLF line endings. There is a result for every signature, or one with
+// verdict "none" if the message isn't signed. An error is only returned if
+// the message can't be parsed.
+func (v *Verifier) Verify(data []byte) ([]smtp.DKIMResult, error) {
+	headers, body, err := splitMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	maxSignatures := v.MaxSignatures
+	if maxSignatures <= 0 {
+		maxSignatures = 5
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := []smtp.DKIMResult{}
+	for i, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == maxSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, resolver, headers, i, body))
+	}
+	if len(results) == 0 {
+		results = append(results, smtp.DKIMResult{Verdict: None})
+	}
+	return results, nil
+}
+
+// header is a header field of the message, raw is the field as it was
+// received, including the CRLF at the end.
+type header struct {
+	name string
+	raw  string
+}
+
+// splitMessage splits a message in its header fields and body, with CRLF
+// line endings.
+func splitMessage(data []byte) ([]header, []byte, error) {
+	// The mta passes data with LF line endings.
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+
+	headers := []header{}
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += 2
+		}
+		line := string(data[:end])
+		if line == "\r\n" {
+			return headers, data[end:], nil
+		}
+		data = data[end:]
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, nil, errors.New("dkim: message starts with a continuation line")
+			}
+			headers[len(headers)-1].raw += line
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("dkim: invalid header line %q", strings.TrimSpace(line))
+		}
+		headers = append(headers, header{name: strings.TrimSpace(line[:i]), raw: line})
+	}
+	// A message without a body.
+	return headers, nil, nil
+}
+
+// signature is a parsed DKIM-Signature.
+type signature struct {
+	algorithm        string
+	headerCanon      string
+	bodyCanon        string
+	domain           string
+	selector         string
+	headers          []string
+	bodyHash         []byte
+	sig              []byte
+	bodyLength       int64
+	hasBodyLength    bool
+	expires          int64
+	rawWithoutSigVal string
+}
+
+// parseTags parses a tag-list, e.g. "v=1; a=rsa-sha256". Whitespace is removed
+// from the values.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("dkim: invalid tag %q", part)
+		}
+		name := strings.TrimSpace(part[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("dkim: duplicate tag %q", name)
+		}
+		tags[name] = removeWhitespace(part[i+1:])
+	}
+	return tags, nil
+}
+
+func removeWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseSignature parses a DKIM-Signature header field.
+func parseSignature(h header) (*signature, error) {
+	value := h.raw[strings.Index(h.raw, ":")+1:]
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return nil, fmt.Errorf("dkim: missing tag %s=", required)
+		}
+	}
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("dkim: unsupported version %q", tags["v"])
+	}
+
+	s := &signature{
+		algorithm: strings.ToLower(tags["a"]),
+		domain:    strings.ToLower(tags["d"]),
+		selector:  tags["s"],
+	}
+	if s.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil {
+		return nil, errors.New("dkim: invalid bh=")
+	}
+	if s.sig, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return nil, errors.New("dkim: invalid b=")
+	}
+
+	s.headerCanon, s.bodyCanon = "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		s.headerCanon = parts[0]
+		if len(parts) == 2 {
+			s.bodyCanon = parts[1]
+		}
+	}
+	for _, canon := range []string{s.headerCanon, s.bodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return nil, fmt.Errorf("dkim: unsupported canonicalization %q", canon)
+		}
+	}
+
+	fromSigned := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		if name == "" {
+			continue
+		}
+		s.headers = append(s.headers, name)
+		if strings.EqualFold(name, "From") {
+			fromSigned = true
+		}
+	}
+	if !fromSigned {
+		return nil, errors.New("dkim: From is not signed")
+	}
+
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndex(i, "@")
+		domain := strings.ToLower(i[at+1:])
+		if at < 0 || (domain != s.domain && !strings.HasSuffix(domain, "."+s.domain)) {
+			return nil, errors.New("dkim: i= is not in the domain of d=")
+		}
+	}
+	if l, ok := tags["l"]; ok {
+		if s.bodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || s.bodyLength < 0 {
+			return nil, errors.New("dkim: invalid l=")
+		}
+		s.hasBodyLength = true
+	}
+	if x, ok := tags["x"]; ok {
+		if s.expires, err = strconv.ParseInt(x, 10, 64); err != nil {
+			return nil, errors.New("dkim: invalid x=")
+		}
+	}
+
+	s.rawWithoutSigVal = removeSignatureValue(h.raw)
+	return s, nil
+}
+
+// signatureValue matches the value of the b= tag of a DKIM-Signature.
+var signatureValue = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// removeSignatureValue removes the value of the b= tag from the raw header,
+// as it was when it was signed.
+func removeSignatureValue(raw string) string {
+	raw = strings.TrimSuffix(raw, "\r\n")
+	colon := strings.Index(raw, ":")
+	return raw[:colon+1] + signatureValue.ReplaceAllString(raw[colon+1:], "$1$2")
+}
+
+func verifySignature(ctx context.Context, resolver TXTResolver, headers []header, index int, body []byte) smtp.DKIMResult {
+	s, err := parseSignature(headers[index])
+	if err != nil {
+		return smtp.DKIMResult{Verdict: PermError}
+	}
+	result := smtp.DKIMResult{
+		Domain:    s.domain,
+		Selector:  s.selector,
+		Algorithm: s.algorithm,
+	}
+	if s.algorithm != "rsa-sha256" && s.algorithm != "ed25519-sha256" {
+		result.Verdict = PermError
+		return result
+	}
+	if s.expires > 0 && time.Now().Unix() > s.expires {
+		result.Verdict = PermError
+		return result
+	}
+
+	canonical := canonicalBody(body, s.bodyCanon)
+	if s.hasBodyLength {
+		if s.bodyLength > int64(len(canonical)) {
+			result.Verdict = PermError
+			return result
+		}
+		canonical = canonical[:s.bodyLength]
+	}
+	bodyHash := sha256.Sum256(canonical)
+	if !bytes.Equal(bodyHash[:], s.bodyHash) {
+		result.Verdict = Fail
+		return result
+	}
+
+	key, verdict := lookupKey(ctx, resolver, s)
+	if key == nil {
+		result.Verdict = verdict
+		return result
+	}
+
+	hash := sha256.Sum256(signedHeaders(headers, index, s))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], s.sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hash[:], s.sig) {
+			err = errors.New("dkim: invalid signature")
+		}
+	}
+	if err != nil {
+		result.Verdict = Fail
+		return result
+	}
+	result.Verdict = Pass
+	return result
+}
+
+// signedHeaders returns the canonicalized header fields of the signature,
+// followed by the signature itself without its value.
+func signedHeaders(headers []header, index int, s *signature) []byte {
+	var b bytes.Buffer
+	used := map[int]bool{}
+	for _, name := range s.headers {
+		// The last unused instance of the header field is signed.
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headers[i].name, name) {
+				used[i] = true
+				b.WriteString(canonicalHeader(headers[i].raw, s.headerCanon))
+				break
+			}
+		}
+	}
+	b.WriteString(strings.TrimSuffix(canonicalHeader(s.rawWithoutSigVal, s.headerCanon), "\r\n"))
+	return b.Bytes()
+}
+
+// canonicalHeader canonicalizes a raw header field (RFC 6376, section 3.4).
+func canonicalHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+	i := strings.Index(raw, ":")
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+	value := strings.ReplaceAll(raw[i+1:], "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalizes a body with CRLF line endings
+// (RFC 6376, section 3.4).
+func canonicalBody(body []byte, canon string) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+	if canon == "relaxed" {
+		for i, line := range lines {
+			ending := ""
+			if strings.HasSuffix(line, "\r\n") {
+				line, ending = strings.TrimSuffix(line, "\r\n"), "\r\n"
+			}
+			line = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+				return r == ' ' || r == '\t'
+			}), " ")
+			// Leading whitespace is kept as one space.
+			if len(lines[i]) > 0 && (lines[i][0] == ' ' || lines[i][0] == '\t') && line != "" {
+				line = " " + line
+			}
+			lines[i] = line + ending
+		}
+	}
+
+	result := strings.Join(lines, "")
+	if result != "" && !strings.HasSuffix(result, "\r\n") {
+		result += "\r\n"
+	}
+	// Empty lines at the end are ignored.
+	for strings.HasSuffix(result, "\r\n\r\n") {
+		result = strings.TrimSuffix(result, "\r\n")
+	}
+	if result == "\r\n" && canon == "relaxed" {
+		result = ""
+	}
+	if result == "" && canon == "simple" {
+		result = "\r\n"
+	}
+	return []byte(result)
+}
+
+// lookupKey returns the public key of the signature, or nil and the verdict
+// if there is no valid key.
+func lookupKey(ctx context.Context, resolver TXTResolver, s *signature) (crypto.PublicKey, string) {
+	records, err := resolver.LookupTXT(ctx, s.selector+"._domainkey."+s.domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, PermError
+		}
+		return nil, TempError
+	}
+	if len(records) != 1 {
+		return nil, PermError
+	}
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, PermError
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, PermError
+	}
+	keyType := strings.ToLower(tags["k"])
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if keyType+"-sha256" != s.algorithm {
+		return nil, PermError
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, PermError
+	}
+	if len(der) == 0 {
+		// The key was revoked.
+		return nil, PermError
+	}
+
+	if keyType == "ed25519" {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, PermError
+		}
+		return ed25519.PublicKey(der), ""
+	}
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(der); err == nil {
+		key, _ = parsed.(*rsa.PublicKey)
+	} else {
+		key, _ = x509.ParsePKCS1PublicKey(der)
+	}
+	if key == nil || key.N.BitLen() < minRSABits {
+		return nil, PermError
+	}
+	return key, ""
+}
@@ -0,0 +1,320 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+type stubTXTResolver struct {
+	records map[string][]string
+	err     error
+}
+
+func (r *stubTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	records, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+const testMessage = "From: Joe <joe@example.com>\n" +
+	"To: Suzie <suzie@example.org>\n" +
+	"Subject:  Is dinner   ready?\n" +
+	"\n" +
+	"Hi.\n" +
+	"\n" +
+	"We lost the game.  Are you hungry yet?\n" +
+	"\n" +
+	"Joe.\n"
+
+// sign adds a DKIM-Signature to message, signing the From, To and Subject
+// headers.
+func sign(message, domain, selector, canon string, key crypto.Signer) string {
+	headers, body, err := splitMessage([]byte(message))
+	if err != nil {
+		panic(err)
+	}
+	parts := strings.SplitN(canon, "/", 2)
+	bodyHash := sha256.Sum256(canonicalBody(body, parts[1]))
+
+	algorithm := "rsa-sha256"
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+	raw := "DKIM-Signature: v=1; a=" + algorithm + "; c=" + canon + "; d=" + domain + ";\r\n" +
+		"\ts=" + selector + "; h=From:To:Subject;\r\n" +
+		"\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n" +
+		"\tb=\r\n"
+	headers = append(headers, header{name: "DKIM-Signature", raw: raw})
+	s, err := parseSignature(headers[len(headers)-1])
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(signedHeaders(headers, len(headers)-1, s))
+
+	var sig []byte
+	if algorithm == "ed25519-sha256" {
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	} else {
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+	signed := strings.TrimSuffix(raw, "\r\n") + base64.StdEncoding.EncodeToString(sig) + "\n"
+	return strings.ReplaceAll(signed, "\r\n", "\n") + message
+}
+
+func TestCanonicalization(t *testing.T) {
+	c.Convey("Testing canonicalization (RFC 6376, section 3.4.5)", t, func() {
+		c.So(canonicalHeader("A: X\r\n", "relaxed"), c.ShouldEqual, "a:X\r\n")
+		c.So(canonicalHeader("B : Y\t\r\n\tZ  \r\n", "relaxed"), c.ShouldEqual, "b:Y Z\r\n")
+		c.So(canonicalHeader("B : Y\t\r\n\tZ  \r\n", "simple"), c.ShouldEqual, "B : Y\t\r\n\tZ  \r\n")
+
+		body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+		c.So(string(canonicalBody(body, "relaxed")), c.ShouldEqual, " C\r\nD E\r\n")
+		c.So(string(canonicalBody(body, "simple")), c.ShouldEqual, " C \r\nD \t E\r\n")
+
+		c.So(string(canonicalBody(nil, "relaxed")), c.ShouldEqual, "")
+		c.So(string(canonicalBody(nil, "simple")), c.ShouldEqual, "\r\n")
+	})
+}
+
+func TestVerify(t *testing.T) {
+	c.Convey("Testing DKIM verification", t, func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		c.So(err, c.ShouldBeNil)
+		rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+		c.So(err, c.ShouldBeNil)
+		edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+		c.So(err, c.ShouldBeNil)
+
+		resolver := &stubTXTResolver{records: map[string][]string{
+			"rsa._domainkey.example.com":     {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+			"ed._domainkey.example.com":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+			"revoked._domainkey.example.com": {"v=DKIM1; p="},
+		}}
+		v := &Verifier{Resolver: resolver}
+
+		c.Convey("Valid signatures pass", func() {
+			for _, canon := range []string{"relaxed/relaxed", "simple/simple", "relaxed/simple"} {
+				results, err := v.Verify([]byte(sign(testMessage, "example.com", "rsa", canon, rsaKey)))
+				c.So(err, c.ShouldBeNil)
+				c.So(results, c.ShouldResemble, []smtp.DKIMResult{
+					{Domain: "example.com", Selector: "rsa", Verdict: Pass, Algorithm: "rsa-sha256"},
+				})
+			}
+
+			results, err := v.Verify([]byte(sign(testMessage, "example.com", "ed", "relaxed/relaxed", edKey)))
+			c.So(err, c.ShouldBeNil)
+			c.So(results, c.ShouldResemble, []smtp.DKIMResult{
+				{Domain: "example.com", Selector: "ed", Verdict: Pass, Algorithm: "ed25519-sha256"},
+			})
+
+			// CRLF line endings.
+			signed := sign(testMessage, "example.com", "rsa", "relaxed/relaxed", rsaKey)
+			results, _ = v.Verify([]byte(strings.ReplaceAll(signed, "\n", "\r\n")))
+			c.So(results[0].Verdict, c.ShouldEqual, Pass)
+		})
+
+		c.Convey("Relaxed signatures survive whitespace changes", func() {
+			signed := sign(testMessage, "example.com", "rsa", "relaxed/relaxed", rsaKey)
+			signed = strings.Replace(signed, "Subject:  Is dinner", "Subject: Is\n  dinner", 1)
+			signed = strings.Replace(signed, "game.  Are", "game. Are", 1)
+			results, _ := v.Verify([]byte(signed + "\n\n"))
+			c.So(results[0].Verdict, c.ShouldEqual, Pass)
+
+			signed = sign(testMessage, "example.com", "rsa", "simple/simple", rsaKey)
+			signed = strings.Replace(signed, "game.  Are", "game. Are", 1)
+			results, _ = v.Verify([]byte(signed))
+			c.So(results[0].Verdict, c.ShouldEqual, Fail)
+		})
+
+		c.Convey("Modified messages fail", func() {
+			signed := sign(testMessage, "example.com", "rsa", "relaxed/relaxed", rsaKey)
+			results, _ := v.Verify([]byte(strings.Replace(signed, "lost", "won", 1)))
+			c.So(results[0].Verdict, c.ShouldEqual, Fail)
+
+			results, _ = v.Verify([]byte(strings.Replace(signed, "Is dinner", "Is lunch", 1)))
+			c.So(results[0].Verdict, c.ShouldEqual, Fail)
+
+			// An added From header is signed instead of the original one.
+			extraFrom := strings.Replace(signed, "To: Suzie", "From: Mallory <mallory@example.net>\nTo: Suzie", 1)
+			results, _ = v.Verify([]byte(extraFrom))
+			c.So(results[0].Verdict, c.ShouldEqual, Fail)
+
+			signed = sign(testMessage, "example.com", "ed", "relaxed/relaxed", edKey)
+			results, _ = v.Verify([]byte(strings.Replace(signed, "Is dinner", "Is lunch", 1)))
+			c.So(results[0].Verdict, c.ShouldEqual, Fail)
+		})
+
+		c.Convey("Unsigned messages have no signature", func() {
+			results, err := v.Verify([]byte(testMessage))
+			c.So(err, c.ShouldBeNil)
+			c.So(results, c.ShouldResemble, []smtp.DKIMResult{{Verdict: None}})
+		})
+
+		c.Convey("Missing keys and invalid signatures are permanent errors", func() {
+			results, _ := v.Verify([]byte(sign(testMessage, "example.com", "missing", "relaxed/relaxed", rsaKey)))
+			c.So(results[0].Verdict, c.ShouldEqual, PermError)
+
+			// The key type doesn't match the algorithm.
+			results, _ = v.Verify([]byte(sign(testMessage, "example.com", "ed", "relaxed/relaxed", rsaKey)))
+			c.So(results[0].Verdict, c.ShouldEqual, PermError)
+
+			signed := sign(testMessage, "example.com", "rsa", "relaxed/relaxed", rsaKey)
+			results, _ = v.Verify([]byte(strings.Replace(signed, "a=rsa-sha256", "a=rsa-sha1", 1)))
+			c.So(results[0].Verdict, c.ShouldEqual, PermError)
+			c.So(results[0].Algorithm, c.ShouldEqual, "rsa-sha1")
+
+			results, _ = v.Verify([]byte(strings.Replace(signed, "h=From:To:Subject", "h=To:Subject", 1)))
+			c.So(results[0].Verdict, c.ShouldEqual, PermError)
+
+			results, _ = v.Verify([]byte(strings.Replace(signed, "v=1;", "v=1; x=1;", 1)))
+			c.So(results[0].Verdict, c.ShouldEqual, PermError)
+		})
+
+		c.Convey("Revoked keys are permanent errors", func() {
+			results, _ := v.Verify([]byte(sign(testMessage, "example.com", "revoked", "relaxed/relaxed", rsaKey)))
+			c.So(results[0].Verdict, c.ShouldEqual, PermError)
+		})
+
+		c.Convey("DNS failures are temporary errors", func() {
+			signed := sign(testMessage, "example.com", "rsa", "relaxed/relaxed", rsaKey)
+			resolver.err = &net.DNSError{Err: "server misbehaving", Name: "rsa._domainkey.example.com", IsTemporary: true}
+			results, _ := v.Verify([]byte(signed))
+			c.So(results[0].Verdict, c.ShouldEqual, TempError)
+
+			resolver.err = errors.New("timeout")
+			results, _ = v.Verify([]byte(signed))
+			c.So(results[0].Verdict, c.ShouldEqual, TempError)
+		})
+
+		c.Convey("Every signature has a result", func() {
+			signed := sign(testMessage, "example.com", "rsa", "relaxed/relaxed", rsaKey)
+			signed = sign(signed, "example.com", "ed", "relaxed/relaxed", edKey)
+			results, _ := v.Verify([]byte(signed))
+			c.So(results, c.ShouldHaveLength, 2)
+			c.So(results[0].Verdict, c.ShouldEqual, Pass)
+			c.So(results[1].Verdict, c.ShouldEqual, Pass)
+		})
+	})
+}
+
+func TestMultiKeySigner(t *testing.T) {
+	c.Convey("Testing signing with MultiKeySigner", t, func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		c.So(err, c.ShouldBeNil)
+		rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+		c.So(err, c.ShouldBeNil)
+		edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+		c.So(err, c.ShouldBeNil)
+
+		v := &Verifier{Resolver: &stubTXTResolver{records: map[string][]string{
+			"2025._domainkey.example.com": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+			"2026._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		}}}
+		s := &MultiKeySigner{Domain: "example.com"}
+
+		verify := func(message string) smtp.DKIMResult {
+			signed, err := s.Sign([]byte(message))
+			c.So(err, c.ShouldBeNil)
+			results, err := v.Verify(signed)
+			c.So(err, c.ShouldBeNil)
+			c.So(results, c.ShouldHaveLength, 1)
+			return results[0]
+		}
+
+		c.Convey("Messages can't be signed without keys", func() {
+			_, err := s.Sign([]byte(testMessage))
+			c.So(err, c.ShouldNotBeNil)
+		})
+
+		c.Convey("Messages are signed with the newest key", func() {
+			s.AddKey("2025", rsaKey)
+			c.So(verify(testMessage), c.ShouldResemble, smtp.DKIMResult{
+				Domain: "example.com", Selector: "2025", Verdict: Pass, Algorithm: "rsa-sha256",
+			})
+
+			s.AddKey("2026", edKey)
+			c.So(verify(testMessage), c.ShouldResemble, smtp.DKIMResult{
+				Domain: "example.com", Selector: "2026", Verdict: Pass, Algorithm: "ed25519-sha256",
+			})
+
+			// CRLF line endings are kept.
+			signed, err := s.Sign([]byte(strings.ReplaceAll(testMessage, "\n", "\r\n")))
+			c.So(err, c.ShouldBeNil)
+			c.So(string(signed), c.ShouldNotContainSubstring, "\r\r")
+			c.So(strings.Count(string(signed), "\n"), c.ShouldEqual, strings.Count(string(signed), "\r\n"))
+
+			c.Convey("Removed keys are not used anymore", func() {
+				s.RemoveKey("2026")
+				c.So(verify(testMessage).Selector, c.ShouldEqual, "2025")
+
+				s.RemoveKey("2025")
+				_, err := s.Sign([]byte(testMessage))
+				c.So(err, c.ShouldNotBeNil)
+			})
+
+			c.Convey("Adding a key again makes it the newest", func() {
+				s.AddKey("2025", rsaKey)
+				c.So(verify(testMessage).Selector, c.ShouldEqual, "2025")
+			})
+		})
+
+		c.Convey("Only the headers in the message are signed", func() {
+			s.AddKey("2025", rsaKey)
+			signed, err := s.Sign([]byte(testMessage))
+			c.So(err, c.ShouldBeNil)
+			c.So(string(signed), c.ShouldContainSubstring, "h=From:Subject:To;")
+
+			// From is signed even if it isn't in Headers.
+			s.Headers = []string{"Subject"}
+			signed, err = s.Sign([]byte(testMessage))
+			c.So(err, c.ShouldBeNil)
+			c.So(string(signed), c.ShouldContainSubstring, "h=Subject:From;")
+		})
+
+		c.Convey("Keys can be rotated while signing", func() {
+			s.AddKey("2025", rsaKey)
+			var wg sync.WaitGroup
+			errs := make(chan error, 20)
+			for i := 0; i < 10; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					s.AddKey("2026", edKey)
+					s.RemoveKey("2026")
+				}()
+				go func() {
+					defer wg.Done()
+					_, err := s.Sign([]byte(testMessage))
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				c.So(err, c.ShouldBeNil)
+			}
+		})
+	})
+}
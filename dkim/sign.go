@@ -0,0 +1,163 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSignedHeaders are the header fields MultiKeySigner signs if
+// Headers is empty.
+var DefaultSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// MultiKeySigner signs messages with DKIM, with relaxed/relaxed
+// canonicalization. It holds several keys by selector, so keys can be
+// rotated: a new key is added and published, the old one is removed when
+// it isn't needed anymore. Messages are signed with the newest key.
+// It is safe for concurrent use.
+type MultiKeySigner struct {
+	// Domain is the d= tag of the signatures.
+	Domain string
+	// Headers are the header fields that are signed, DefaultSignedHeaders
+	// if empty. From is always signed.
+	Headers []string
+
+	mutex sync.RWMutex
+	keys  map[string]crypto.Signer
+	// The selectors of keys, the newest last.
+	selectors []string
+}
+
+// AddKey adds the key of selector, and makes it the key new messages are
+// signed with. The key has to be an RSA or Ed25519 key.
+func (s *MultiKeySigner) AddKey(selector string, key crypto.Signer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.keys == nil {
+		s.keys = map[string]crypto.Signer{}
+	}
+	s.removeSelector(selector)
+	s.keys[selector] = key
+	s.selectors = append(s.selectors, selector)
+}
+
+// RemoveKey removes the key of selector. The newest of the other keys is
+// used for new messages.
+func (s *MultiKeySigner) RemoveKey(selector string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.keys, selector)
+	s.removeSelector(selector)
+}
+
+func (s *MultiKeySigner) removeSelector(selector string) {
+	for i, sel := range s.selectors {
+		if sel == selector {
+			s.selectors = append(s.selectors[:i], s.selectors[i+1:]...)
+			return
+		}
+	}
+}
+
+// currentKey returns the newest key, "" and nil if there are no keys.
+func (s *MultiKeySigner) currentKey() (string, crypto.Signer) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if len(s.selectors) == 0 {
+		return "", nil
+	}
+	selector := s.selectors[len(s.selectors)-1]
+	return selector, s.keys[selector]
+}
+
+// Sign returns data with a DKIM-Signature header field of the newest key
+// added at the top. data is a message with LF or CRLF line endings, the
+// signature has the same line endings.
+func (s *MultiKeySigner) Sign(data []byte) ([]byte, error) {
+	selector, key := s.currentKey()
+	if key == nil {
+		return nil, errors.New("dkim: no signing key")
+	}
+	var algorithm string
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm = "rsa-sha256"
+	case ed25519.PublicKey:
+		algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key type %T", key.Public())
+	}
+
+	headers, body, err := splitMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	bodyHash := sha256.Sum256(canonicalBody(body, "relaxed"))
+
+	raw := "DKIM-Signature: v=1; a=" + algorithm + "; c=relaxed/relaxed;\r\n" +
+		"\td=" + s.Domain + "; s=" + selector + "; t=" + fmt.Sprint(time.Now().Unix()) + ";\r\n" +
+		"\th=" + strings.Join(s.signedHeaderNames(headers), ":") + ";\r\n" +
+		"\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n" +
+		"\tb="
+	headers = append(headers, header{name: "DKIM-Signature", raw: raw + "\r\n"})
+	sig, err := parseSignature(headers[len(headers)-1])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(signedHeaders(headers, len(headers)-1, sig))
+
+	opts := crypto.Hash(0)
+	if algorithm == "rsa-sha256" {
+		opts = crypto.SHA256
+	}
+	value, err := key.Sign(rand.Reader, hash[:], opts)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := raw + base64.StdEncoding.EncodeToString(value) + "\r\n"
+	if !bytes.Contains(data, []byte("\r\n")) {
+		signature = strings.ReplaceAll(signature, "\r\n", "\n")
+	}
+	return append([]byte(signature), data...), nil
+}
+
+// signedHeaderNames returns the names for h=, every header field that is
+// signed as often as it is in the message. From is always signed.
+func (s *MultiKeySigner) signedHeaderNames(headers []header) []string {
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultSignedHeaders
+	}
+
+	signed := []string{}
+	fromSigned := false
+	for _, name := range names {
+		for _, h := range headers {
+			if strings.EqualFold(h.name, name) {
+				signed = append(signed, name)
+				fromSigned = fromSigned || strings.EqualFold(name, "From")
+			}
+		}
+	}
+	if !fromSigned {
+		signed = append(signed, "From")
+	}
+	return signed
+}
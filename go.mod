@@ -4,5 +4,9 @@ go 1.15
 
 require (
 	github.com/gopistolet/gopistolet v0.0.0-20210418093520-a5395f728f8d
+	github.com/sirupsen/logrus v1.8.1
 	github.com/smartystreets/goconvey v1.6.4
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/sys v0.7.0 // indirect
 )
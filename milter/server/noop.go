@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gopistolet/gopistolet/log"
+)
+
+// MilterExchange is a command of the MTA and our response to it.
+type MilterExchange struct {
+	// Command is the milter command, e.g. 'M' for MAIL.
+	Command byte
+	// Data of the command.
+	Data []byte
+	// Response is the response we sent, 0 for commands without a
+	// response, like macros.
+	Response byte
+}
+
+// NoOpMilterServer is a milter that accepts every message without changing
+// it, and records the exchanges with the MTA. It is meant for testing milter
+// integration without a real filter.
+type NoOpMilterServer struct {
+	ln net.Listener
+
+	mutex     sync.Mutex
+	exchanges []MilterExchange
+}
+
+// NewNoOpMilterServer starts a NoOpMilterServer listening on the tcp address
+// addr, e.g. "127.0.0.1:0". It should be closed with Close when done.
+func NewNoOpMilterServer(addr string) (*NoOpMilterServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &NoOpMilterServer{ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				// The listener is closed.
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *NoOpMilterServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops listening. Existing connections are handled untill the MTA closes them.
+func (s *NoOpMilterServer) Close() error {
+	return s.ln.Close()
+}
+
+// Exchanges returns the exchanges of all connections so far, in order.
+func (s *NoOpMilterServer) Exchanges() []MilterExchange {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]MilterExchange{}, s.exchanges...)
+}
+
+func (s *NoOpMilterServer) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	for {
+		cmd, data, err := readPacket(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("Milter connection failed: %v", err)
+			}
+			return
+		}
+
+		var resp byte
+		var respData []byte
+		switch cmd {
+		case cmdOptNeg:
+			if respData, err = noOpOptNeg(data); err != nil {
+				log.Warnf("Milter connection failed: %v", err)
+				return
+			}
+			resp = respOptNeg
+		case cmdMacro, cmdAbort, cmdQuitNC, cmdQuit:
+			// No response.
+		case cmdEOB:
+			resp = respAccept
+		default:
+			resp = respContinue
+		}
+
+		// Record before responding, so the MTA sees it after our response.
+		s.mutex.Lock()
+		s.exchanges = append(s.exchanges, MilterExchange{Command: cmd, Data: data, Response: resp})
+		s.mutex.Unlock()
+
+		if cmd == cmdQuit {
+			return
+		}
+		if resp != 0 {
+			if err := writePacket(c, resp, respData); err != nil {
+				log.Warnf("Milter connection failed: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// noOpOptNeg returns the option negotiation response without any actions.
+func noOpOptNeg(data []byte) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("Invalid option negotiation packet")
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	resp := make([]byte, 12)
+	binary.BigEndian.PutUint32(resp[0:4], version)
+	return resp, nil
+}
@@ -0,0 +1,169 @@
+// Package server implements the milter protocol, so Postfix or Sendmail can
+// use the same Handler and RcptValidator as the mta package without a
+// separate relay.
+//
+// The Handler is called at the end of every message. Changes it makes to
+// State.To and to the headers in State.Data are sent back to the MTA, as far
+// as the MTA allows them. Changes to the body are not sent back.
+//
+// NoOpMilterServer accepts every message, to test milter integration
+// without a real filter.
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/mta"
+)
+
+// Commands sent by the MTA.
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdQuitNC  = 'K'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+	cmdUnknown = 'U'
+)
+
+// Responses sent by us.
+const (
+	respAddRcpt   = '+'
+	respDelRcpt   = '-'
+	respAccept    = 'a'
+	respContinue  = 'c'
+	respAddHeader = 'h'
+	respChgHeader = 'm'
+	respOptNeg    = 'O'
+	respReplyCode = 'y'
+)
+
+// Actions we can do at the end of a message.
+const (
+	actAddHeaders = 0x01
+	actAddRcpt    = 0x04
+	actDelRcpt    = 0x08
+	actChgHeaders = 0x10
+
+	supportedActions = actAddHeaders | actAddRcpt | actDelRcpt | actChgHeaders
+)
+
+const (
+	// Version of the milter protocol we speak.
+	protocolVersion = 6
+	// Maximum size of a packet, body chunks are at most 64KB.
+	maxPacketSize = 1 << 20
+)
+
+var errPacketTooLarge = errors.New("Milter packet too large")
+
+// Server is a milter server.
+type Server struct {
+	// Handler is called at the end of every message.
+	Handler mta.Handler
+	// RcptValidator checks the recipients, nil to accept all recipients.
+	RcptValidator mta.RcptValidator
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+}
+
+// ListenAndServe listens on a "tcp" or "unix" address and handles the
+// connections of the MTA.
+func (s *Server) ListenAndServe(network, address string) error {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		log.Errorf("Could not start listening: %v", err)
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve handles the connections accepted on ln untill Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, ln)
+	s.mutex.Unlock()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Warnf("Accept error: %v", err)
+				continue
+			}
+			// The listener is closed.
+			return nil
+		}
+
+		go s.serve(c)
+	}
+}
+
+// Close stops listening. Existing connections are handled untill the MTA closes them.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for _, ln := range s.listeners {
+		if e := ln.Close(); e != nil {
+			err = e
+		}
+	}
+	s.listeners = nil
+	return err
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer c.Close()
+
+	session := newSession(s, c)
+	if err := session.handle(); err != nil && err != io.EOF {
+		log.Warnf("Milter connection failed: %v", err)
+	}
+}
+
+// readPacket reads a command with its data.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 {
+		return 0, nil, errors.New("Empty milter packet")
+	}
+	if length > maxPacketSize {
+		return 0, nil, errPacketTooLarge
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// writePacket writes a response with its data.
+func writePacket(w io.Writer, cmd byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = cmd
+	copy(packet[5:], data)
+	_, err := w.Write(packet)
+	return err
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+type rcptValidator struct{}
+
+func (rcptValidator) ValidateRcpt(to smtp.MailAddress) error {
+	if to.GetLocal() == "bad" {
+		return errors.New("No such user")
+	}
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	c.Convey("Testing milter server", t, func() {
+		var state smtp.State
+		s := &Server{
+			Handler: mta.HandlerFunc(func(st *smtp.State) error {
+				state = *st
+				st.To = append(st.To, &smtp.MailAddress{Address: "guy2@somewhere.test"})
+				st.Data = []byte("Subject: [tagged] test\nX-Checked: yes\n\nSome test email\n")
+				return nil
+			}),
+			RcptValidator: rcptValidator{},
+		}
+
+		server, client := net.Pipe()
+		defer client.Close()
+		go s.serve(server)
+
+		send := func(cmd byte, data string) {
+			c.So(writePacket(client, cmd, []byte(data)), c.ShouldBeNil)
+		}
+		expect := func(cmd byte, data string) {
+			resp, respData, err := readPacket(client)
+			c.So(err, c.ShouldBeNil)
+			c.So(string(resp), c.ShouldEqual, string(cmd))
+			c.So(string(respData), c.ShouldEqual, data)
+		}
+
+		optneg := make([]byte, 12)
+		binary.BigEndian.PutUint32(optneg[0:4], 6)
+		binary.BigEndian.PutUint32(optneg[4:8], 0x1ff)
+		send(cmdOptNeg, string(optneg))
+		binary.BigEndian.PutUint32(optneg[4:8], supportedActions)
+		expect(respOptNeg, string(optneg))
+
+		send(cmdMacro, "C{auth_authen}\x00alice\x00")
+		send(cmdConnect, "client.example.com\x004\x00\x1910.0.0.1\x00")
+		expect(respContinue, "")
+		send(cmdHelo, "some.sender\x00")
+		expect(respContinue, "")
+		send(cmdMail, "<someone@somewhere.test>\x00BODY=8BITMIME\x00")
+		expect(respContinue, "")
+		send(cmdRcpt, "<bad@somewhere.test>\x00")
+		expect(respReplyCode, "550 5.1.1 Mailbox unavailable\x00")
+		send(cmdRcpt, "<guy1@somewhere.test>\x00")
+		expect(respContinue, "")
+		send(cmdData, "")
+		expect(respContinue, "")
+		send(cmdHeader, "Subject\x00 test\x00")
+		expect(respContinue, "")
+		send(cmdHeader, "X-Spam\x00 yes\x00")
+		expect(respContinue, "")
+		send(cmdEOH, "")
+		expect(respContinue, "")
+		send(cmdBody, "Some test email\r\n")
+		expect(respContinue, "")
+		send(cmdEOB, "")
+
+		expect(respAddRcpt, "<guy2@somewhere.test>\x00")
+		expect(respChgHeader, "\x00\x00\x00\x01Subject\x00[tagged] test\x00")
+		expect(respAddHeader, "X-Checked\x00yes\x00")
+		expect(respChgHeader, "\x00\x00\x00\x01X-Spam\x00\x00")
+		expect(respContinue, "")
+
+		c.So(state.ClientName, c.ShouldEqual, "client.example.com")
+		c.So(state.Ip.String(), c.ShouldEqual, "10.0.0.1")
+		c.So(state.Hostname, c.ShouldEqual, "some.sender")
+		c.So(state.AuthUser, c.ShouldEqual, "alice")
+		c.So(state.From.GetAddress(), c.ShouldEqual, "someone@somewhere.test")
+		c.So(len(state.To), c.ShouldEqual, 1)
+		c.So(string(state.Data), c.ShouldEqual, "Subject: test\nX-Spam: yes\n\nSome test email\n")
+
+		send(cmdQuit, "")
+	})
+}
+
+func TestNoOpMilterServer(t *testing.T) {
+	c.Convey("Testing the no-op milter server", t, func() {
+		s, err := NewNoOpMilterServer("127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+		defer s.Close()
+
+		client, err := net.Dial("tcp", s.Addr())
+		c.So(err, c.ShouldBeNil)
+		defer client.Close()
+
+		send := func(cmd byte, data string) {
+			c.So(writePacket(client, cmd, []byte(data)), c.ShouldBeNil)
+		}
+		expect := func(cmd byte) []byte {
+			resp, respData, err := readPacket(client)
+			c.So(err, c.ShouldBeNil)
+			c.So(string(resp), c.ShouldEqual, string(cmd))
+			return respData
+		}
+
+		optneg := make([]byte, 12)
+		binary.BigEndian.PutUint32(optneg[0:4], 6)
+		binary.BigEndian.PutUint32(optneg[4:8], 0x1ff)
+		send(cmdOptNeg, string(optneg))
+		c.So(expect(respOptNeg), c.ShouldResemble, []byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0})
+
+		send(cmdMacro, "C{auth_authen}\x00alice\x00")
+		send(cmdConnect, "client.example.com\x004\x00\x1910.0.0.1\x00")
+		expect(respContinue)
+		send(cmdHelo, "some.sender\x00")
+		expect(respContinue)
+		send(cmdMail, "<someone@somewhere.test>\x00")
+		expect(respContinue)
+		send(cmdRcpt, "<guy1@somewhere.test>\x00")
+		expect(respContinue)
+		send(cmdHeader, "Subject\x00 test\x00")
+		expect(respContinue)
+		send(cmdEOH, "")
+		expect(respContinue)
+		send(cmdBody, "Some test email\r\n")
+		expect(respContinue)
+		send(cmdEOB, "")
+		expect(respAccept)
+
+		commands := ""
+		responses := ""
+		for _, e := range s.Exchanges() {
+			commands += string(e.Command)
+			if e.Response != 0 {
+				responses += string(e.Response)
+			}
+		}
+		c.So(commands, c.ShouldEqual, "ODCHMRLNBE")
+		c.So(responses, c.ShouldEqual, "Occccccca")
+		c.So(string(s.Exchanges()[4].Data), c.ShouldEqual, "<someone@somewhere.test>\x00")
+
+		send(cmdQuit, "")
+	})
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// header is a header field as sent by the MTA.
+type header struct {
+	name  string
+	value string
+}
+
+// session is the state of a single connection of the MTA.
+// With protocol version 6 it can contain multiple SMTP sessions.
+type session struct {
+	server *Server
+	r      *bufio.Reader
+	w      net.Conn
+	// Actions the MTA allows us to do.
+	actions uint32
+	state   smtp.State
+	headers []header
+	body    []byte
+}
+
+func newSession(s *Server, c net.Conn) *session {
+	session := &session{
+		server: s,
+		r:      bufio.NewReader(c),
+		w:      c,
+	}
+	session.state.Reset()
+	return session
+}
+
+// handle reads commands untill the MTA quits.
+func (s *session) handle() error {
+	for {
+		cmd, data, err := readPacket(s.r)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case cmdOptNeg:
+			err = s.optNeg(data)
+
+		case cmdMacro:
+			s.macros(data)
+
+		case cmdConnect:
+			err = s.connect(data)
+
+		case cmdHelo:
+			s.state.Hostname = string(bytes.TrimRight(data, "\x00"))
+			err = s.reply(respContinue, nil)
+
+		case cmdMail:
+			err = s.mail(data)
+
+		case cmdRcpt:
+			err = s.rcpt(data)
+
+		case cmdHeader:
+			fields := splitStrings(data)
+			if len(fields) < 2 {
+				return errors.New("Invalid header packet")
+			}
+			s.headers = append(s.headers, header{name: fields[0], value: trimHeaderValue(fields[1])})
+			err = s.reply(respContinue, nil)
+
+		case cmdBody:
+			s.body = append(s.body, data...)
+			err = s.reply(respContinue, nil)
+
+		case cmdEOB:
+			s.body = append(s.body, data...)
+			err = s.endOfMessage()
+
+		case cmdAbort:
+			s.resetMessage()
+
+		case cmdQuitNC:
+			s.state = smtp.State{}
+			s.state.Reset()
+			s.resetMessage()
+
+		case cmdQuit:
+			return nil
+
+		case cmdData, cmdEOH, cmdUnknown:
+			err = s.reply(respContinue, nil)
+
+		default:
+			// Unknown commands from newer protocol versions.
+			log.Debugf("Unknown milter command %q", cmd)
+			err = s.reply(respContinue, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) reply(cmd byte, data []byte) error {
+	return writePacket(s.w, cmd, data)
+}
+
+// replyCode rejects the current command with an SMTP answer.
+func (s *session) replyCode(answer smtp.Answer) error {
+	return s.reply(respReplyCode, append([]byte(answer.String()), 0))
+}
+
+// resetMessage clears the state of the current message.
+func (s *session) resetMessage() {
+	s.state.Reset()
+	s.headers = nil
+	s.body = nil
+}
+
+// optNeg negotiates the protocol version and the actions.
+func (s *session) optNeg(data []byte) error {
+	if len(data) < 12 {
+		return errors.New("Invalid option negotiation packet")
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	if version < 2 {
+		return fmt.Errorf("Unsupported milter protocol version %d", version)
+	}
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	s.actions = binary.BigEndian.Uint32(data[4:8]) & supportedActions
+
+	resp := make([]byte, 12)
+	binary.BigEndian.PutUint32(resp[0:4], version)
+	binary.BigEndian.PutUint32(resp[4:8], s.actions)
+	// We want to see all steps of the SMTP session.
+	binary.BigEndian.PutUint32(resp[8:12], 0)
+	return s.reply(respOptNeg, resp)
+}
+
+// macros stores the macros we are interested in, there is no reply.
+func (s *session) macros(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	fields := splitStrings(data[1:])
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch strings.Trim(fields[i], "{}") {
+		case "auth_authen":
+			s.state.Authenticated = fields[i+1] != ""
+			s.state.AuthUser = fields[i+1]
+		case "tls_version":
+			s.state.Secure = fields[i+1] != ""
+		}
+	}
+}
+
+// connect reads the information about the client.
+func (s *session) connect(data []byte) error {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+1 >= len(data) {
+		return errors.New("Invalid connect packet")
+	}
+	s.state.ClientName = string(data[:i])
+
+	family := data[i+1]
+	if (family == '4' || family == '6') && len(data) > i+4 {
+		// Skip the port.
+		address := string(bytes.TrimRight(data[i+4:], "\x00"))
+		if strings.HasPrefix(strings.ToUpper(address), "IPV6:") {
+			address = address[5:]
+		}
+		s.state.Ip = net.ParseIP(address)
+	}
+	return s.reply(respContinue, nil)
+}
+
+// parsePath parses an address between angle brackets.
+// The null sender <> gives an empty address.
+func parsePath(data []byte) (*smtp.MailAddress, error) {
+	fields := splitStrings(data)
+	if len(fields) < 1 {
+		return nil, errors.New("No address")
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(fields[0], "<"), ">")
+	if path == "" {
+		return &smtp.MailAddress{}, nil
+	}
+	address, err := smtp.ParseAddress(path)
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+func (s *session) mail(data []byte) error {
+	from, err := parsePath(data)
+	if err != nil {
+		return s.replyCode(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "5.1.7 Bad sender address syntax",
+		})
+	}
+	s.resetMessage()
+	s.state.From = from
+	return s.reply(respContinue, nil)
+}
+
+func (s *session) rcpt(data []byte) error {
+	to, err := parsePath(data)
+	if err != nil {
+		return s.replyCode(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "5.1.3 Bad recipient address syntax",
+		})
+	}
+
+	if s.server.RcptValidator != nil {
+		if err := s.server.RcptValidator.ValidateRcpt(*to); err != nil {
+			log.Debugf("Recipient %s rejected: %v", to.GetAddress(), err)
+			return s.replyCode(smtp.Answer{
+				Status:  smtp.MailboxUnavailable,
+				Message: "5.1.1 Mailbox unavailable",
+			})
+		}
+	}
+
+	s.state.To = append(s.state.To, to)
+	return s.reply(respContinue, nil)
+}
+
+// endOfMessage calls the handler and sends its changes back to the MTA.
+func (s *session) endOfMessage() error {
+	var data bytes.Buffer
+	for _, h := range s.headers {
+		fmt.Fprintf(&data, "%s: %s\n", h.name, h.value)
+	}
+	data.WriteString("\n")
+	data.Write(s.body)
+	// The mta package gives handlers the data with LF line endings.
+	s.state.Data = bytes.Replace(data.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+
+	to := make([]string, len(s.state.To))
+	for i, rcpt := range s.state.To {
+		to[i] = rcpt.GetAddress()
+	}
+
+	if err := s.server.Handler.Handle(&s.state); err != nil {
+		log.Warnf("Handler did not accept mail: %v", err)
+		s.resetMessage()
+		return s.replyCode(mta.HandlerErrorAnswer(err))
+	}
+
+	if err := s.sendRcptChanges(to); err != nil {
+		return err
+	}
+	if err := s.sendHeaderChanges(parseHeaders(s.state.Data)); err != nil {
+		return err
+	}
+
+	s.resetMessage()
+	return s.reply(respContinue, nil)
+}
+
+// sendRcptChanges compares the recipients with the original ones.
+func (s *session) sendRcptChanges(original []string) error {
+	current := make([]string, len(s.state.To))
+	for i, rcpt := range s.state.To {
+		current[i] = rcpt.GetAddress()
+	}
+
+	for _, rcpt := range current {
+		if !contains(original, rcpt) {
+			if s.actions&actAddRcpt == 0 {
+				log.Warnf("Handler added recipient %s, but the MTA doesn't allow it", rcpt)
+				continue
+			}
+			if err := s.reply(respAddRcpt, []byte("<"+rcpt+">\x00")); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rcpt := range original {
+		if !contains(current, rcpt) {
+			if s.actions&actDelRcpt == 0 {
+				log.Warnf("Handler removed recipient %s, but the MTA doesn't allow it", rcpt)
+				continue
+			}
+			if err := s.reply(respDelRcpt, []byte("<"+rcpt+">\x00")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendHeaderChanges compares the headers with the original ones.
+// Headers are matched by name and occurrence, like the MTA does.
+func (s *session) sendHeaderChanges(current []header) error {
+	original := map[string][]header{}
+	for _, h := range s.headers {
+		name := strings.ToLower(h.name)
+		original[name] = append(original[name], h)
+	}
+	changed := map[string][]header{}
+	names := []string{}
+	for _, h := range current {
+		name := strings.ToLower(h.name)
+		if _, ok := changed[name]; !ok {
+			names = append(names, name)
+		}
+		changed[name] = append(changed[name], h)
+	}
+	for _, h := range s.headers {
+		name := strings.ToLower(h.name)
+		if _, ok := changed[name]; !ok {
+			changed[name] = nil
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		o, c := original[name], changed[name]
+		for i := 0; i < len(o) && i < len(c); i++ {
+			if o[i].value != c[i].value {
+				if err := s.changeHeader(i+1, c[i].name, c[i].value); err != nil {
+					return err
+				}
+			}
+		}
+		// Delete from the back so the indexes of the others don't change.
+		for i := len(o) - 1; i >= len(c); i-- {
+			if err := s.changeHeader(i+1, o[i].name, ""); err != nil {
+				return err
+			}
+		}
+		for i := len(o); i < len(c); i++ {
+			if s.actions&actAddHeaders == 0 {
+				log.Warnf("Handler added header %s, but the MTA doesn't allow it", c[i].name)
+				continue
+			}
+			if err := s.reply(respAddHeader, []byte(c[i].name+"\x00"+c[i].value+"\x00")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// changeHeader changes the index-th occurrence of a header, an empty value deletes it.
+func (s *session) changeHeader(index int, name, value string) error {
+	if s.actions&actChgHeaders == 0 {
+		log.Warnf("Handler changed header %s, but the MTA doesn't allow it", name)
+		return nil
+	}
+	data := make([]byte, 4, 4+len(name)+len(value)+2)
+	binary.BigEndian.PutUint32(data, uint32(index))
+	data = append(data, name+"\x00"+value+"\x00"...)
+	return s.reply(respChgHeader, data)
+}
+
+// parseHeaders parses the header section of the mail data.
+func parseHeaders(data []byte) []header {
+	headers := []header{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].value += "\n" + line
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		headers = append(headers, header{name: line[:i], value: trimHeaderValue(line[i+1:])})
+	}
+	return headers
+}
+
+// trimHeaderValue removes the leading whitespace and uses LF line endings.
+func trimHeaderValue(value string) string {
+	return strings.Replace(strings.TrimLeft(value, " \t"), "\r\n", "\n", -1)
+}
+
+// splitStrings splits NUL terminated strings.
+func splitStrings(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\x00")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package mta
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// AddressRewriter rewrites addresses, e.g. aliases to their target.
+type AddressRewriter interface {
+	Rewrite(address smtp.MailAddress) (smtp.MailAddress, error)
+}
+
+// maxAliasDepth is the maximum length of a chain of aliases.
+const maxAliasDepth = 10
+
+// fileAliasRewriter rewrites the local parts of addresses with an aliases file.
+type fileAliasRewriter struct {
+	path string
+	// The file is checked for changes at most once per checkInterval.
+	checkInterval time.Duration
+
+	lock    sync.Mutex
+	aliases map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+// NewFileAliasRewriter reads aliases of local parts from a file in the
+// sendmail format, one "alias: target" per line:
+//
+//	# Comment
+//	admin: root
+//	info: admin
+//	webmaster: root@example.com
+//
+// Aliases are case-insensitive and apply to all domains. A target without
+// domain keeps the domain of the address, a target can be an alias itself.
+// Only a single target per alias is supported, use a ListExpander for lists.
+// The file is read again when it was modified, if that fails the old aliases
+// are kept.
+func NewFileAliasRewriter(path string) (AddressRewriter, error) {
+	r := &fileAliasRewriter{
+		path:          path,
+		checkInterval: time.Second,
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := readAliases(path)
+	if err != nil {
+		return nil, err
+	}
+	r.aliases = aliases
+	r.modTime = info.ModTime()
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *fileAliasRewriter) Rewrite(address smtp.MailAddress) (smtp.MailAddress, error) {
+	aliases := r.load()
+
+	local, domain := splitAddress(address.GetAddress())
+	for i := 0; ; i++ {
+		target, ok := aliases[strings.ToLower(local)]
+		if !ok {
+			break
+		}
+		if i == maxAliasDepth {
+			return address, fmt.Errorf("alias %s: too many levels of aliases", address.GetAddress())
+		}
+		var targetDomain string
+		local, targetDomain = splitAddress(target)
+		if targetDomain != "" {
+			domain = targetDomain
+		}
+	}
+
+	if domain == "" {
+		return smtp.MailAddress{Address: local}, nil
+	}
+	return smtp.MailAddress{Address: local + "@" + domain}, nil
+}
+
+// splitAddress splits an address in its local part and domain, the domain is
+// empty if there is no @.
+func splitAddress(address string) (local, domain string) {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return address[:at], address[at+1:]
+	}
+	return address, ""
+}
+
+// load returns the aliases, after reading the file again if it changed.
+func (r *fileAliasRewriter) load() map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.checked) < r.checkInterval {
+		return r.aliases
+	}
+	r.checked = time.Now()
+
+	info, err := os.Stat(r.path)
+	if err == nil && info.ModTime().Equal(r.modTime) {
+		return r.aliases
+	}
+	var aliases map[string]string
+	if err == nil {
+		aliases, err = readAliases(r.path)
+	}
+	if err != nil {
+		log.Errorf("Could not reload aliases, keeping the old ones: %v", err)
+		return r.aliases
+	}
+	r.aliases = aliases
+	r.modTime = info.ModTime()
+	return r.aliases
+}
+
+func readAliases(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	aliases := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		colon := strings.Index(text, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"alias: target\"", path, line)
+		}
+		alias := strings.ToLower(strings.TrimSpace(text[:colon]))
+		target := strings.TrimSpace(text[colon+1:])
+		if alias == "" || strings.Contains(alias, "@") {
+			return nil, fmt.Errorf("%s:%d: invalid alias %q", path, line, alias)
+		}
+		if target == "" || strings.ContainsAny(target, ", \t") {
+			return nil, fmt.Errorf("%s:%d: alias %s needs a single target", path, line, alias)
+		}
+		aliases[alias] = target
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
@@ -0,0 +1,191 @@
+package mta
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/outbound"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// ATRNQueueDrainer has the mail for the domains of clients that connect now
+// and then to get it with ATRN (RFC 2645), e.g. over a dial-up link.
+type ATRNQueueDrainer interface {
+	// DrainFor removes the mails for domain from the queue and returns them.
+	DrainFor(domain string) ([]*smtp.State, error)
+	// Requeue takes back a mail DrainFor returned that could not be
+	// delivered. err is an outbound.PermanentError if the client rejected
+	// the mail, it should bounce then instead of being queued again.
+	Requeue(domain string, state *smtp.State, err error) error
+}
+
+// reverser is implemented by protocols that can hand over their connection
+// for ATRN, like smtp.MtaProtocol.
+type reverser interface {
+	Reverse() net.Conn
+}
+
+// drainedMail is a mail the ATRNQueueDrainer returned for domain.
+type drainedMail struct {
+	domain string
+	state  *smtp.State
+}
+
+// atrnDomains returns the domains user may get the mail for with ATRN.
+func (s *Mta) atrnDomains(user string) []string {
+	domains := []string{}
+	for _, domain := range s.config.ATRNDomains[user] {
+		domains = append(domains, strings.ToLower(domain))
+	}
+	return domains
+}
+
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAtrn delivers the queued mail for the domains of the client over the
+// connection, if the client may have it. It returns true if the connection
+// was reversed, the session is over then.
+func (s *Mta) handleAtrn(proto smtp.Protocol, state *smtp.State, cmd smtp.AtrnCmd) bool {
+	if !s.config.EnableATRN || s.config.ATRNQueueDrainer == nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxError,
+			Message: "Command not recognized",
+		})
+		return false
+	}
+
+	if !state.Authenticated {
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthRequired,
+			Message: "Authentication required",
+		})
+		return false
+	}
+
+	if state.From != nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.BadSequence,
+			Message: "ATRN not permitted during a mail transaction",
+		})
+		return false
+	}
+
+	r, ok := baseProtocol(proto).(reverser)
+	if !ok {
+		proto.Send(smtp.Answer{
+			Status:  smtp.NotImplemented,
+			Message: "Command not implemented",
+		})
+		return false
+	}
+
+	allowed := s.atrnDomains(state.AuthUser)
+	domains := cmd.Domains
+	if len(domains) == 0 {
+		domains = allowed
+	}
+	for _, domain := range domains {
+		if !containsDomain(allowed, domain) {
+			log.WithFields(log.Fields{
+				"Ip":        state.Ip.String(),
+				"SessionId": state.SessionId.String(),
+				"User":      state.AuthUser,
+			}).Warnf("ATRN for %s not allowed", domain)
+			proto.Send(smtp.Answer{
+				Status:       smtp.MailboxBusy,
+				EnhancedCode: "4.7.1",
+				Message:      "Access denied to you",
+			})
+			return false
+		}
+	}
+
+	drained := []drainedMail{}
+	for _, domain := range domains {
+		states, err := s.config.ATRNQueueDrainer.DrainFor(domain)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+			}).Errorf("Could not drain the queue for %s: %v", domain, err)
+			s.requeueATRN(drained, errors.New("ATRN was aborted"))
+			proto.Send(smtp.Answer{
+				Status:  smtp.LocalError,
+				Message: "Unable to process ATRN request now",
+			})
+			return false
+		}
+		for _, mail := range states {
+			drained = append(drained, drainedMail{domain: domain, state: mail})
+		}
+	}
+
+	// Mails that need TLS stay queued untill the client gets them over TLS.
+	mails := []drainedMail{}
+	for _, mail := range drained {
+		if mail.state.RequireTLS && !state.Secure {
+			s.requeueATRN([]drainedMail{mail}, errors.New("REQUIRETLS mail, ATRN without TLS"))
+			continue
+		}
+		mails = append(mails, mail)
+	}
+
+	if len(mails) == 0 {
+		proto.Send(smtp.Answer{
+			Status:  smtp.NoMail,
+			Message: "You have no mail",
+		})
+		return false
+	}
+
+	proto.Send(smtp.Answer{
+		Status:  smtp.Ok,
+		Message: "OK now reversing the connection",
+	})
+	flushProtocol(proto)
+
+	states := make([]*smtp.State, len(mails))
+	for i, mail := range mails {
+		states[i] = mail.state
+	}
+	client := outbound.Client{
+		Hostname: s.config.Hostname,
+		Timeout:  s.commandTimeout("MAIL"),
+	}
+	errs := client.DeliverReversed(r.Reverse(), state.Hostname, states)
+
+	delivered := 0
+	for i, err := range errs {
+		if err == nil {
+			delivered++
+			continue
+		}
+		s.requeueATRN(mails[i:i+1], err)
+	}
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"User":      state.AuthUser,
+	}).Infof("Delivered %d of %d mails after ATRN", delivered, len(mails))
+	return true
+}
+
+// requeueATRN gives the mails that could not be delivered back to the
+// ATRNQueueDrainer.
+func (s *Mta) requeueATRN(mails []drainedMail, err error) {
+	for _, mail := range mails {
+		if rerr := s.config.ATRNQueueDrainer.Requeue(mail.domain, mail.state, err); rerr != nil {
+			log.WithFields(log.Fields{
+				"SessionId": mail.state.SessionId.String(),
+			}).Errorf("Could not requeue mail for %s: %v", mail.domain, rerr)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package mta
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/auth/scram"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// AuthBackend authenticates clients with a username and password (AUTH PLAIN).
+type AuthBackend interface {
+	Authenticate(username, password string) error
+}
+
+// CertAuthBackend authenticates clients with the certificate they presented
+// during the TLS handshake (SASL EXTERNAL).
+// The server only requests the certificate, so the backend has to verify it.
+type CertAuthBackend interface {
+	AuthenticateCert(cert *x509.Certificate) error
+}
+
+// ScramAuthBackend has the credentials for AUTH SCRAM-SHA-256.
+// Credentials returns scram.ErrUnknownUser for unknown users.
+type ScramAuthBackend interface {
+	Credentials(username string) (scram.Credentials, error)
+}
+
+// certIdentity returns the identity of a client certificate:
+// the first email address, or the common name if there is none.
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// peerCert returns the certificate the client presented, nil if there is none.
+func peerCert(state *smtp.State) *x509.Certificate {
+	if !state.Secure || state.TLSState == nil || len(state.TLSState.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.TLSState.PeerCertificates[0]
+}
+
+// authMechanisms returns the AUTH mechanisms that can be used in the current state.
+func authMechanisms(config Config, state *smtp.State) []string {
+	mechanisms := []string{}
+	if config.CertAuthBackend != nil && peerCert(state) != nil {
+		mechanisms = append(mechanisms, "EXTERNAL")
+	}
+	if scramAuthAllowed(config, state) {
+		mechanisms = append(mechanisms, scram.Mechanism)
+	}
+	if passwordAuthAllowed(config, state) {
+		mechanisms = append(mechanisms, "PLAIN", "LOGIN")
+	}
+	return mechanisms
+}
+
+func (s *Mta) handleAuth(proto smtp.Protocol, state *smtp.State, cmd smtp.AuthCmd) {
+	if state.Authenticated {
+		proto.Send(smtp.Answer{
+			Status:  smtp.BadSequence,
+			Message: "Already authenticated",
+		})
+		return
+	}
+
+	if state.From != nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.BadSequence,
+			Message: "AUTH not permitted during a mail transaction",
+		})
+		return
+	}
+
+	switch cmd.Mechanism {
+	case "EXTERNAL":
+		s.authExternal(proto, state, cmd)
+
+	case "PLAIN":
+		s.authPlain(proto, state, cmd)
+
+	case "LOGIN":
+		s.authLogin(proto, state, cmd)
+
+	case scram.Mechanism:
+		s.authScram(proto, state, cmd)
+
+	default:
+		proto.Send(smtp.Answer{
+			Status:  smtp.ParamNotImplemented,
+			Message: "Unrecognized authentication type",
+		})
+	}
+}
+
+// authExternal implements the SASL EXTERNAL mechanism (RFC 4422) with the client certificate.
+func (s *Mta) authExternal(proto smtp.Protocol, state *smtp.State, cmd smtp.AuthCmd) {
+	cert := peerCert(state)
+	if s.config.CertAuthBackend == nil || cert == nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.ParamNotImplemented,
+			Message: "Unrecognized authentication type",
+		})
+		return
+	}
+
+	// The response is the optional authorization identity. Without an
+	// initial response the client gets an empty challenge (RFC 4954 4).
+	var decoded []byte
+	ok := false
+	if cmd.InitialResponse == "" {
+		decoded, ok = s.authChallenge(proto, "")
+	} else {
+		decoded, ok = decodeAuthResponse(proto, cmd.InitialResponse)
+	}
+	if !ok {
+		return
+	}
+	authzid := string(decoded)
+
+	identity := certIdentity(cert)
+	if authzid != "" && authzid != identity {
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthFailed,
+			Message: "Authentication credentials invalid",
+		})
+		return
+	}
+
+	if err := s.config.CertAuthBackend.AuthenticateCert(cert); err != nil {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Identity":  identity,
+		}).Warnf("Certificate authentication failed: %v", err)
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthFailed,
+			Message: "Authentication credentials invalid",
+		})
+		return
+	}
+
+	state.Authenticated = true
+	state.AuthUser = identity
+	proto.Send(smtp.Answer{
+		Status:  smtp.AuthSucceeded,
+		Message: "Authentication successful",
+	})
+}
+
+// lineReader is implemented by protocols that can read the responses to
+// AUTH challenges (334 answers).
+type lineReader interface {
+	ReadLine() (string, error)
+}
+
+// passwordAuthAllowed tells if PLAIN and LOGIN can be used.
+func passwordAuthAllowed(config Config, state *smtp.State) bool {
+	return config.AuthBackend != nil && (state.Secure || config.AllowInsecureAuth)
+}
+
+// scramAuthAllowed tells if SCRAM-SHA-256 can be used.
+func scramAuthAllowed(config Config, state *smtp.State) bool {
+	return config.ScramAuthBackend != nil && (state.Secure || config.AllowInsecureAuth)
+}
+
+// authChallenge sends a 334 challenge and returns the decoded response.
+// ok is false if the client cancelled or the response was invalid, the
+// answer was sent then.
+func (s *Mta) authChallenge(proto smtp.Protocol, challenge string) (response []byte, ok bool) {
+	r, isLineReader := baseProtocol(proto).(lineReader)
+	if !isLineReader {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Credentials must be sent with the AUTH command",
+		})
+		return nil, false
+	}
+
+	proto.Send(smtp.Answer{
+		Status:  smtp.AuthContinue,
+		Message: challenge,
+	})
+	line, err := r.ReadLine()
+	if err != nil {
+		// The connection is closed by the next GetCmd.
+		return nil, false
+	}
+	if line == "*" {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Authentication cancelled",
+		})
+		return nil, false
+	}
+	return decodeAuthResponse(proto, line)
+}
+
+// decodeAuthResponse decodes a base64 response, "=" is an empty response.
+// An answer is sent if it is invalid.
+func decodeAuthResponse(proto smtp.Protocol, response string) ([]byte, bool) {
+	if response == "=" {
+		return []byte{}, true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Invalid base64 data",
+		})
+		return nil, false
+	}
+	return decoded, true
+}
+
+// authPlain implements the SASL PLAIN mechanism (RFC 4616).
+func (s *Mta) authPlain(proto smtp.Protocol, state *smtp.State, cmd smtp.AuthCmd) {
+	if !passwordAuthAllowed(s.config, state) {
+		proto.Send(smtp.Answer{
+			Status:  smtp.ParamNotImplemented,
+			Message: "Unrecognized authentication type",
+		})
+		return
+	}
+
+	var decoded []byte
+	ok := false
+	if cmd.InitialResponse == "" {
+		decoded, ok = s.authChallenge(proto, "")
+	} else {
+		decoded, ok = decodeAuthResponse(proto, cmd.InitialResponse)
+	}
+	if !ok {
+		return
+	}
+
+	// authzid NUL authcid NUL passwd
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 || parts[1] == "" {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Invalid PLAIN credentials",
+		})
+		return
+	}
+	authzid, username, password := parts[0], parts[1], parts[2]
+
+	if authzid != "" && authzid != username {
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthFailed,
+			Message: "Authentication credentials invalid",
+		})
+		return
+	}
+
+	s.authPassword(proto, state, username, password)
+}
+
+// The default LOGIN prompts, "Username:" and "Password:" in base64.
+const (
+	defaultLoginUsernamePrompt = "VXNlcm5hbWU6"
+	defaultLoginPasswordPrompt = "UGFzc3dvcmQ6"
+)
+
+// authLogin implements the LOGIN mechanism (draft-murchison-sasl-login).
+// The initial response is the username.
+func (s *Mta) authLogin(proto smtp.Protocol, state *smtp.State, cmd smtp.AuthCmd) {
+	if !passwordAuthAllowed(s.config, state) {
+		proto.Send(smtp.Answer{
+			Status:  smtp.ParamNotImplemented,
+			Message: "Unrecognized authentication type",
+		})
+		return
+	}
+
+	usernamePrompt := s.config.LoginUsernamePrompt
+	if usernamePrompt == "" {
+		usernamePrompt = defaultLoginUsernamePrompt
+	}
+	passwordPrompt := s.config.LoginPasswordPrompt
+	if passwordPrompt == "" {
+		passwordPrompt = defaultLoginPasswordPrompt
+	}
+
+	var username []byte
+	ok := false
+	if cmd.InitialResponse == "" {
+		username, ok = s.authChallenge(proto, usernamePrompt)
+	} else {
+		username, ok = decodeAuthResponse(proto, cmd.InitialResponse)
+	}
+	if !ok {
+		return
+	}
+	password, ok := s.authChallenge(proto, passwordPrompt)
+	if !ok {
+		return
+	}
+
+	s.authPassword(proto, state, string(username), string(password))
+}
+
+// authPassword checks the credentials of PLAIN and LOGIN with the AuthBackend.
+func (s *Mta) authPassword(proto smtp.Protocol, state *smtp.State, username, password string) {
+	if username == "" {
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthFailed,
+			Message: "Authentication credentials invalid",
+		})
+		return
+	}
+
+	if err := s.config.AuthBackend.Authenticate(username, password); err != nil {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Username":  username,
+		}).Warnf("Password authentication failed: %v", err)
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthFailed,
+			Message: "Authentication credentials invalid",
+		})
+		return
+	}
+
+	state.Authenticated = true
+	state.AuthUser = username
+	proto.Send(smtp.Answer{
+		Status:  smtp.AuthSucceeded,
+		Message: "Authentication successful",
+	})
+}
+
+// authScram implements the SCRAM-SHA-256 mechanism (RFC 7677). The
+// server-final message is sent as a last challenge, with an empty response.
+func (s *Mta) authScram(proto smtp.Protocol, state *smtp.State, cmd smtp.AuthCmd) {
+	if !scramAuthAllowed(s.config, state) {
+		proto.Send(smtp.Answer{
+			Status:  smtp.ParamNotImplemented,
+			Message: "Unrecognized authentication type",
+		})
+		return
+	}
+
+	var clientFirst []byte
+	ok := false
+	if cmd.InitialResponse == "" {
+		clientFirst, ok = s.authChallenge(proto, "")
+	} else {
+		clientFirst, ok = decodeAuthResponse(proto, cmd.InitialResponse)
+	}
+	if !ok {
+		return
+	}
+
+	server := scram.NewServer(s.config.ScramAuthBackend.Credentials)
+	serverFirst, err := server.Start(clientFirst)
+	if err != nil {
+		s.scramFailed(proto, state, server.Username(), err)
+		return
+	}
+	clientFinal, ok := s.authChallenge(proto, base64.StdEncoding.EncodeToString(serverFirst))
+	if !ok {
+		return
+	}
+	serverFinal, err := server.Finish(clientFinal)
+	if err != nil {
+		s.scramFailed(proto, state, server.Username(), err)
+		return
+	}
+	response, ok := s.authChallenge(proto, base64.StdEncoding.EncodeToString(serverFinal))
+	if !ok {
+		return
+	}
+	if len(response) != 0 {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Invalid SCRAM response",
+		})
+		return
+	}
+
+	state.Authenticated = true
+	state.AuthUser = server.Username()
+	proto.Send(smtp.Answer{
+		Status:  smtp.AuthSucceeded,
+		Message: "Authentication successful",
+	})
+}
+
+// scramFailed answers a failed SCRAM exchange.
+func (s *Mta) scramFailed(proto smtp.Protocol, state *smtp.State, username string, err error) {
+	if errors.Is(err, scram.ErrInvalidMessage) {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Invalid SCRAM message",
+		})
+		return
+	}
+	if err != scram.ErrInvalidCredentials {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Username":  username,
+		}).Errorf("Could not get SCRAM credentials: %v", err)
+		proto.Send(smtp.Answer{
+			Status:  smtp.TempAuthFailure,
+			Message: "Temporary authentication failure",
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"Username":  username,
+	}).Warnf("SCRAM authentication failed: %v", err)
+	proto.Send(smtp.Answer{
+		Status:  smtp.AuthFailed,
+		Message: "Authentication credentials invalid",
+	})
+}
@@ -0,0 +1,139 @@
+package mta
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// bdatTransfer holds the state of a mail that is sent in chunks with BDAT.
+type bdatTransfer struct {
+	// A BDAT chunk was received and LAST wasn't seen yet.
+	active bool
+	// The answer the mail was rejected with, nil if it wasn't rejected.
+	rejected *smtp.Answer
+	// Number of bytes discarded since the mail was rejected.
+	discarded int64
+}
+
+func (t *bdatTransfer) reset() {
+	*t = bdatTransfer{}
+}
+
+// reject sends answer and discards the rest of the mail.
+func (t *bdatTransfer) reject(proto smtp.Protocol, state *smtp.State, answer smtp.Answer, last bool) {
+	proto.Send(answer)
+	state.Reset()
+	if last {
+		t.reset()
+		return
+	}
+	t.active = true
+	t.rejected = &answer
+}
+
+// handleBdat handles a chunk of the CHUNKING extension (RFC 3030).
+// Returns true and the reason if the connection should be closed.
+func (s *Mta) handleBdat(proto smtp.Protocol, state *smtp.State, cmd smtp.BdatCmd, t *bdatTransfer, rc *runtimeConfig, emptyExpansion bool) (bool, SessionEndReason) {
+	// The answer the chunk is rejected with, nil if we keep it.
+	var rejection *smtp.Answer
+	if t.rejected != nil {
+		rejection = t.rejected
+	} else if ok, reason := state.CanReceiveData(); !ok {
+		answer := s.cannotReceiveDataAnswer(state, reason, emptyExpansion)
+		rejection = &answer
+	} else if maxMessageSize, _ := rc.recipientLimits(state.To); maxMessageSize > 0 && int64(len(state.Data))+cmd.Size > maxMessageSize {
+		rejection = &smtp.Answer{
+			Status:  smtp.AbortMail,
+			Message: "Message exceeds maximum size",
+		}
+	}
+
+	// The chunk has to be read, even if we reject it. Otherwise it would be parsed as commands.
+	// Chunks we reject are discarded, they don't have to fit in memory.
+	var chunk []byte
+	var n int64
+	var stopped bool
+	var err error
+	if rejection == nil {
+		chunk, stopped, err = s.readData(s.dataReader(proto, cmd.R))
+		n = int64(len(chunk))
+	} else {
+		n, stopped, err = s.discardData(s.dataReader(proto, cmd.R), cmd.Size)
+	}
+	if stopped {
+		proto.Send(smtp.Answer{
+			Status:  smtp.ShuttingDown,
+			Message: "Server is going down.",
+		})
+		return true, EndServerShutdown
+	}
+	if isTimeout(err) {
+		proto.Send(dataTimeoutAnswer)
+		state.Reset()
+		return true, EndTimeout
+	}
+	if err != nil || n != cmd.Size {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Warnf("Could not read BDAT chunk: %v", err)
+		if err == nil {
+			return true, EndClientDisconnect
+		}
+		return true, endReason(err)
+	}
+
+	if t.rejected != nil {
+		/*
+			RFC 3030 4
+
+			If a 5XX or 4XX code is received by the sender-SMTP in response to
+			a BDAT chunk, the transaction should be considered failed and the
+			sender-SMTP MUST NOT send any additional BDAT segments.
+
+			The client still has to send the chunks it already pipelined,
+			so we keep discarding them untill the last one.
+		*/
+		t.discarded += cmd.Size
+		proto.Send(*t.rejected)
+		if cmd.Last {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+			}).Debugf("Discarded %d bytes of rejected BDAT mail", t.discarded)
+			t.reset()
+		}
+		return false, 0
+	}
+
+	if rejection != nil {
+		t.reject(proto, state, *rejection, cmd.Last)
+		return false, 0
+	}
+
+	if !t.active {
+		state.DataStart = time.Now()
+	}
+	t.active = true
+	state.Data = append(state.Data, chunk...)
+
+	if !cmd.Last {
+		proto.Send(smtp.Answer{
+			Status:  smtp.Ok,
+			Message: fmt.Sprintf("%d octets received", cmd.Size),
+		})
+		return false, 0
+	}
+
+	// Normalize after the last chunk, a CRLF can be split over two chunks.
+	state.Data = bytes.Replace(state.Data, []byte("\r\n"), []byte("\n"), -1)
+	if s.config.NormalizeCRLF {
+		state.Data = bytes.Replace(state.Data, []byte("\n"), []byte("\r\n"), -1)
+	}
+
+	t.reset()
+	s.deliver(proto, state, rc)
+	return false, 0
+}
@@ -0,0 +1,125 @@
+package mta
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConfigBuilder builds a Config with method chaining:
+//
+//	cfg, err := NewConfigBuilder("mx.example.com").
+//		Port(25).
+//		TLS("cert.pem", "key.pem").
+//		MaxSize(10 << 20).
+//		Build()
+//
+// The settings are validated by Build.
+type ConfigBuilder struct {
+	config        Config
+	port          int
+	maxSize       *int64
+	maxRecipients *int
+	dnsbls        []string
+}
+
+// NewConfigBuilder starts a Config for a server with the hostname, on port 25.
+func NewConfigBuilder(hostname string) *ConfigBuilder {
+	return &ConfigBuilder{
+		config: Config{Hostname: hostname},
+		port:   25,
+	}
+}
+
+// Port sets the port to listen on.
+func (b *ConfigBuilder) Port(port int) *ConfigBuilder {
+	b.port = port
+	return b
+}
+
+// TLS sets the certificate and key for STARTTLS.
+func (b *ConfigBuilder) TLS(certFile, keyFile string) *ConfigBuilder {
+	b.config.TlsCert = certFile
+	b.config.TlsKey = keyFile
+	return b
+}
+
+// MaxSize sets the maximum size of the mail data in bytes, for all domains.
+func (b *ConfigBuilder) MaxSize(bytes int64) *ConfigBuilder {
+	b.maxSize = &bytes
+	return b
+}
+
+// MaxRecipients sets the maximum number of recipients per mail.
+func (b *ConfigBuilder) MaxRecipients(n int) *ConfigBuilder {
+	b.maxRecipients = &n
+	return b
+}
+
+// Auth sets the backend for AUTH PLAIN and LOGIN.
+func (b *ConfigBuilder) Auth(backend AuthBackend) *ConfigBuilder {
+	b.config.AuthBackend = backend
+	return b
+}
+
+// DNSBL adds a DNS blocklist zone, e.g. "zen.spamhaus.org". Clients listed
+// in one of the zones are disconnected.
+func (b *ConfigBuilder) DNSBL(zone string) *ConfigBuilder {
+	b.dnsbls = append(b.dnsbls, zone)
+	return b
+}
+
+// Build validates the settings and returns the Config. The error lists all
+// invalid settings.
+func (b *ConfigBuilder) Build() (Config, error) {
+	config := b.config
+	problems := []string{}
+
+	if config.Hostname == "" {
+		problems = append(problems, "hostname can't be empty")
+	}
+
+	if b.port < 1 || b.port > 65535 {
+		problems = append(problems, fmt.Sprintf("port must be 1-65535, got %d", b.port))
+	}
+	config.Port = uint32(b.port)
+
+	if config.TlsCert != "" || config.TlsKey != "" {
+		if config.TlsCert == "" || config.TlsKey == "" {
+			problems = append(problems, "TLS needs both a certificate and a key")
+		} else if _, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey); err != nil {
+			problems = append(problems, fmt.Sprintf("could not load TLS certificate: %v", err))
+		}
+	}
+
+	if b.maxSize != nil {
+		if *b.maxSize <= 0 {
+			problems = append(problems, fmt.Sprintf("max size must be more than 0 bytes, got %d", *b.maxSize))
+		}
+		config.DomainPolicies = map[string]DomainPolicy{
+			"*": {MaxMessageSize: *b.maxSize},
+		}
+	}
+
+	if b.maxRecipients != nil {
+		if *b.maxRecipients <= 0 {
+			problems = append(problems, fmt.Sprintf("max recipients must be more than 0, got %d", *b.maxRecipients))
+		}
+		config.MaxRecipients = *b.maxRecipients
+	}
+
+	if len(b.dnsbls) > 0 {
+		for _, zone := range b.dnsbls {
+			if zone == "" || strings.ContainsAny(zone, " /:@") {
+				problems = append(problems, fmt.Sprintf("invalid DNSBL zone %q", zone))
+			}
+		}
+		config.Blacklist = &DNSBL{Zones: append([]string{}, b.dnsbls...)}
+	}
+
+	if len(problems) > 0 {
+		return Config{}, errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return config, nil
+}
@@ -0,0 +1,69 @@
+package mta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// clientTokenHeader is the header with the token of RequireClientToken.
+const clientTokenHeader = "X-Gopistolet-Token"
+
+// clientTokenScanSize is how much of the mail is searched for the header.
+const clientTokenScanSize = 4 << 10
+
+// ClientToken returns the token a client has to send in the
+// X-Gopistolet-Token header with RequireClientToken: the hex HMAC-SHA256 of
+// the session id in the greeting, with the secret as key.
+func ClientToken(sessionId, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientTokenHeaderValue returns the value of the X-Gopistolet-Token header
+// in the first 4 KB of the headers of data, "" if there is none.
+func clientTokenHeaderValue(data []byte) string {
+	if len(data) > clientTokenScanSize {
+		data = data[:clientTokenScanSize]
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			// End of the headers.
+			break
+		}
+		i := strings.Index(line, ":")
+		if i > 0 && strings.EqualFold(line[:i], clientTokenHeader) {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// rejectClientToken answers 550 and returns true if the mail doesn't have the
+// token of this session.
+func (s *Mta) rejectClientToken(proto smtp.Protocol, state *smtp.State) bool {
+	expected := ClientToken(state.SessionId.String(), s.config.RequireClientToken)
+	if hmac.Equal([]byte(clientTokenHeaderValue(state.Data)), []byte(expected)) {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Info("Rejected mail without a valid client token")
+	proto.Send(smtp.Answer{
+		Status:       smtp.MailboxUnavailable,
+		EnhancedCode: "5.7.1",
+		Message:      "Client token mismatch",
+	})
+	return true
+}
@@ -0,0 +1,56 @@
+package mta
+
+import (
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// DKIMVerifier verifies the DKIM signatures (RFC 6376) of a mail, see the
+// dkim package. It returns a result for every signature, or a single result
+// with verdict "none" if the mail isn't signed.
+type DKIMVerifier interface {
+	Verify(data []byte) ([]smtp.DKIMResult, error)
+}
+
+// checkDKIM runs the DKIM verifier on the received data.
+func (s *Mta) checkDKIM(state *smtp.State) []smtp.DKIMResult {
+	results, err := s.config.DKIMVerifier.Verify(state.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Warnf("Could not verify DKIM: %v", err)
+		return []smtp.DKIMResult{{Verdict: "temperror"}}
+	}
+
+	for _, result := range results {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Domain":    result.Domain,
+			"Selector":  result.Selector,
+			"Verdict":   result.Verdict,
+		}).Debug("Checked DKIM")
+	}
+	return results
+}
+
+// dkimResultFor returns the DKIM result for DMARC: "pass" if a signature of a
+// domain aligned with the From: domain passed (relaxed alignment, without a
+// public suffix list), "fail" if there are other signatures and "none" if
+// there are none.
+func dkimResultFor(fromDomain string, results []smtp.DKIMResult) string {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	result := "none"
+	for _, r := range results {
+		if r.Verdict == "none" {
+			continue
+		}
+		domain := strings.ToLower(r.Domain)
+		if r.Verdict == "pass" && (domain == fromDomain || strings.HasSuffix(fromDomain, "."+domain)) {
+			return "pass"
+		}
+		result = "fail"
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package mta
+
+import (
+	"bytes"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// DMARCChecker checks the DMARC (RFC 7489) policy for the domain of the From: header.
+// It returns the published policy and the disposition that should be applied
+// to the message: "none", "quarantine" or "reject".
+type DMARCChecker interface {
+	CheckDMARC(from smtp.MailAddress, spfResult, dkimResult string) (policy, disposition string, err error)
+}
+
+// checkDMARC runs the DMARC checker on the received data and returns
+// the disposition that should be applied.
+func (s *Mta) checkDMARC(state *smtp.State, spfResult string) string {
+	msg, err := smtp.ReadMessage(bytes.NewReader(state.Data))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Debugf("Could not parse message for DMARC: %v", err)
+		return "none"
+	}
+
+	from, err := smtp.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Debugf("Could not parse From header for DMARC: %v", err)
+		return "none"
+	}
+
+	dkimResult := dkimResultFor(from.GetDomain(), state.DKIMResults)
+	policy, disposition, err := s.config.DMARCChecker.CheckDMARC(from, spfResult, dkimResult)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Warnf("Could not check DMARC: %v", err)
+		return "temperror"
+	}
+
+	log.WithFields(log.Fields{
+		"SessionId":   state.SessionId.String(),
+		"Policy":      policy,
+		"Disposition": disposition,
+	}).Debug("Checked DMARC")
+	return disposition
+}
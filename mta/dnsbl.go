@@ -0,0 +1,78 @@
+package mta
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+)
+
+// DNSBL is a Blacklist that looks up ips in DNS blocklists (RFC 5782).
+// An ip is listed if one of the zones has an A record in 127.0.0.0/8 for it.
+// Ips that can't be looked up are not listed.
+type DNSBL struct {
+	// Zones are the blocklists, e.g. "zen.spamhaus.org".
+	Zones []string
+	// Resolver to use. If nil a shared CachingResolver around
+	// net.DefaultResolver is used.
+	Resolver Resolver
+	// Timeout for all lookups combined. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (d *DNSBL) CheckIp(ip string) bool {
+	name := dnsblName(net.ParseIP(ip))
+	if name == "" {
+		return false
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = defaultResolver
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, zone := range d.Zones {
+		addrs, err := resolver.LookupIPAddr(ctx, name+"."+strings.TrimSuffix(zone, "."))
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				log.WithFields(log.Fields{
+					"Ip":   ip,
+					"Zone": zone,
+				}).Warnf("Could not check DNSBL: %v", err)
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if ip4 := addr.IP.To4(); ip4 != nil && ip4[0] == 127 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dnsblName returns the labels of an ip in a blocklist: the reversed octets
+// of IPv4 addresses, the reversed nibbles of IPv6 addresses.
+func dnsblName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	if ip == nil {
+		return ""
+	}
+	ip16 := ip.To16()
+	labels := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x.%x", ip16[i]&0xf, ip16[i]>>4))
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,109 @@
+package mta
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// dsnBoundary separates the parts of the DSNs we generate.
+const dsnBoundary = "=_gopistolet_dsn"
+
+// generateDSN returns a delivery status notification (RFC 3464) saying that
+// the mail in state could not be delivered to its recipients, because of
+// answer. The original headers are included, the body isn't.
+// The mail has LF line endings, like the mails handlers get.
+func generateDSN(reportingMTA string, to smtp.MailAddress, state *smtp.State, answer smtp.Answer, now time.Time) []byte {
+	var b bytes.Buffer
+	date := now.Format(time.RFC1123Z)
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\n", reportingMTA)
+	fmt.Fprintf(&b, "To: %s\n", to.String())
+	fmt.Fprintf(&b, "Subject: Undelivered Mail Returned to Sender\n")
+	fmt.Fprintf(&b, "Date: %s\n", date)
+	fmt.Fprintf(&b, "Message-ID: <%d.%s.dsn@%s>\n", now.UnixNano(), state.SessionId.String(), reportingMTA)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\n\tboundary=\"%s\"\n", dsnBoundary)
+	fmt.Fprintf(&b, "\n")
+
+	from := "<>"
+	if state.From != nil {
+		from = state.From.GetAddress()
+	}
+
+	fmt.Fprintf(&b, "--%s\n", dsnBoundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\n\n")
+	fmt.Fprintf(&b, "A mail could not be delivered, it was permanently rejected by the handler.\n\n")
+	fmt.Fprintf(&b, "Session:    %s\n", state.SessionId.String())
+	fmt.Fprintf(&b, "Client:     %s (HELO %s)\n", state.Ip.String(), state.Hostname)
+	fmt.Fprintf(&b, "Sender:     %s\n", from)
+	for _, rcpt := range state.To {
+		fmt.Fprintf(&b, "Recipient:  %s\n", rcpt.GetAddress())
+	}
+	fmt.Fprintf(&b, "Answer:     %s\n\n", answer.String())
+
+	fmt.Fprintf(&b, "--%s\n", dsnBoundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\n\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\n", reportingMTA)
+	fmt.Fprintf(&b, "X-Gopistolet-Session-Id: %s\n", state.SessionId.String())
+	if state.Hostname != "" {
+		fmt.Fprintf(&b, "Received-From-MTA: dns; %s\n", state.Hostname)
+	}
+	if !state.DataStart.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\n", state.DataStart.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range state.To {
+		fmt.Fprintf(&b, "\n")
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\n", rcpt.GetAddress())
+		fmt.Fprintf(&b, "Action: failed\n")
+		fmt.Fprintf(&b, "Status: %s\n", answer.EnhancedCode)
+		fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\n", answer.String())
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "--%s\n", dsnBoundary)
+	fmt.Fprintf(&b, "Content-Type: text/rfc822-headers\n\n")
+	headers := string(state.Data)
+	if i := strings.Index(headers, "\n\n"); i >= 0 {
+		headers = headers[:i+1]
+	}
+	b.WriteString(headers)
+	if !strings.HasSuffix(headers, "\n") {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\n--%s--\n", dsnBoundary)
+
+	return b.Bytes()
+}
+
+// notifyPostmaster passes a DSN for a mail the handler rejected permanently
+// to the handler, addressed to Config.PostmasterAddress.
+func (s *Mta) notifyPostmaster(state *smtp.State, answer smtp.Answer) {
+	// Never send notifications about notifications.
+	if state.From == nil || state.From.GetAddress() == "" {
+		return
+	}
+
+	postmaster := s.config.PostmasterAddress
+	dsn := &smtp.State{
+		// The null sender, so nobody answers the DSN.
+		From:      &smtp.MailAddress{},
+		To:        []*smtp.MailAddress{&postmaster},
+		Data:      generateDSN(s.config.Hostname, postmaster, state, answer, time.Now()),
+		SessionId: state.SessionId,
+		Ip:        state.Ip,
+		Hostname:  s.config.Hostname,
+		Proto:     state.Proto,
+	}
+
+	if err := s.MailHandler.Handle(dsn); err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Errorf("Could not notify postmaster: %v", err)
+	}
+}
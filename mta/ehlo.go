@@ -0,0 +1,93 @@
+package mta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// EhloResponse builds the answer to EHLO: the extensions the server supports
+// for a client in its current state.
+type EhloResponse struct {
+	Config Config
+	State  *smtp.State
+	// TLS is whether the server can STARTTLS.
+	TLS bool
+	// XForward is whether the client may send XFORWARD.
+	XForward bool
+	// MaxMessageSize is advertised with SIZE, 0 for no limit.
+	MaxMessageSize int64
+}
+
+// Extensions returns the extensions to advertise, with their parameters.
+// The DisabledExtensions of the Config are left out, and the rest is ordered
+// by the EhloCapabilityOrder of the Config.
+func (r EhloResponse) Extensions() []string {
+	extensions := []string{"8BITMIME", "CHUNKING", "ENHANCEDSTATUSCODES", "PIPELINING"}
+	if r.MaxMessageSize > 0 {
+		extensions = append(extensions, fmt.Sprintf("SIZE %d", r.MaxMessageSize))
+	} else {
+		extensions = append(extensions, "SIZE")
+	}
+	if r.TLS && !r.State.Secure {
+		extensions = append(extensions, "STARTTLS")
+	}
+	if r.Config.EnableRequireTLS && r.State.Secure {
+		extensions = append(extensions, "REQUIRETLS")
+	}
+	// A client can only authenticate once.
+	if !r.State.Authenticated {
+		if mechanisms := authMechanisms(r.Config, r.State); len(mechanisms) > 0 {
+			extensions = append(extensions, "AUTH "+strings.Join(mechanisms, " "))
+		}
+	}
+	if r.XForward {
+		extensions = append(extensions, "XFORWARD NAME ADDR PROTO HELO")
+	}
+	if r.Config.EnableATRN && r.Config.ATRNQueueDrainer != nil {
+		extensions = append(extensions, "ATRN")
+	}
+
+	filtered := []string{}
+	for _, extension := range extensions {
+		if !r.disabled(strings.Fields(extension)[0]) {
+			filtered = append(filtered, extension)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return r.position(filtered[i]) < r.position(filtered[j])
+	})
+	return filtered
+}
+
+// position returns the index of the extension in EhloCapabilityOrder, or the
+// length of EhloCapabilityOrder if it isn't listed.
+func (r EhloResponse) position(extension string) int {
+	name := strings.Fields(extension)[0]
+	for i, listed := range r.Config.EhloCapabilityOrder {
+		if strings.EqualFold(name, listed) {
+			return i
+		}
+	}
+	return len(r.Config.EhloCapabilityOrder)
+}
+
+func (r EhloResponse) disabled(name string) bool {
+	for _, extension := range r.Config.DisabledExtensions {
+		if strings.EqualFold(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer returns the answer to EHLO: our hostname, the extensions and OK.
+func (r EhloResponse) Answer() smtp.MultiAnswer {
+	messages := append([]string{r.Config.Hostname}, r.Extensions()...)
+	return smtp.MultiAnswer{
+		Status:   smtp.Ok,
+		Messages: append(messages, "OK"),
+	}
+}
@@ -0,0 +1,48 @@
+package mta
+
+import (
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// EventListener is notified of what happens in the sessions, e.g. for metrics.
+// The id is the session id. Listeners are called from the session goroutines,
+// so they should be safe for concurrent use and return quickly.
+type EventListener interface {
+	// OnConnect is called when a client connects.
+	OnConnect(id, ip string)
+	// OnEhlo is called when a HELO or EHLO is accepted.
+	OnEhlo(id, helo string)
+	// OnMail is called when the sender is accepted.
+	OnMail(id string, from smtp.MailAddress)
+	// OnRcpt is called when a recipient is accepted.
+	OnRcpt(id string, to smtp.MailAddress)
+	// OnData is called when the mail data is received, before it is checked
+	// and passed to the handler.
+	OnData(id string, size int)
+	// OnQuit is called when the client sends QUIT.
+	OnQuit(id string)
+	// OnDisconnect is called when the connection is closed. err is the error
+	// that ended the connection, nil if it was closed by QUIT or by us.
+	OnDisconnect(id string, err error)
+}
+
+// NopEventListener ignores all events. It can be embedded by listeners that
+// only need some events.
+type NopEventListener struct{}
+
+func (NopEventListener) OnConnect(id, ip string)                 {}
+func (NopEventListener) OnEhlo(id, helo string)                  {}
+func (NopEventListener) OnMail(id string, from smtp.MailAddress) {}
+func (NopEventListener) OnRcpt(id string, to smtp.MailAddress)   {}
+func (NopEventListener) OnData(id string, size int)              {}
+func (NopEventListener) OnQuit(id string)                        {}
+func (NopEventListener) OnDisconnect(id string, err error)       {}
+
+var _ EventListener = NopEventListener{}
+
+// notify calls f for all EventListeners.
+func (s *Mta) notify(f func(l EventListener)) {
+	for _, l := range s.config.EventListeners {
+		f(l)
+	}
+}
@@ -0,0 +1,86 @@
+package mta
+
+import (
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// handleExpn answers EXPN with the members of a list of the ListExpander.
+// Lists can only be expanded by the clients that are allowed to by
+// ExpnRequiresAuth and ExpnAllowedNets.
+func (s *Mta) handleExpn(proto smtp.Protocol, state *smtp.State, cmd smtp.ExpnCmd) {
+	if s.config.ListExpander == nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.NotImplemented,
+			Message: "Command not implemented",
+		})
+		return
+	}
+
+	if s.config.ExpnRequiresAuth && !state.Authenticated {
+		proto.Send(smtp.Answer{
+			Status:  smtp.AuthRequired,
+			Message: "Authentication required",
+		})
+		return
+	}
+	if len(s.config.ExpnAllowedNets) > 0 && !ipInNets(state.Ip, s.config.ExpnAllowedNets) {
+		proto.Send(smtp.Answer{
+			Status:       smtp.MailboxUnavailable,
+			EnhancedCode: "5.7.1",
+			Message:      "EXPN access denied",
+		})
+		return
+	}
+
+	// A list name without domain is one of ours.
+	name := strings.TrimSuffix(strings.TrimPrefix(cmd.ListName, "<"), ">")
+	if name != "" && !strings.Contains(name, "@") {
+		name += "@" + s.config.Hostname
+	}
+	list, err := smtp.ParseAddress(name)
+	if err != nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxErrorParam,
+			Message: "Syntax is EXPN <list>",
+		})
+		return
+	}
+
+	members, expanded, err := s.config.ListExpander.Expand(list)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Errorf("Could not expand %s: %v", list.GetAddress(), err)
+		proto.Send(smtp.Answer{
+			Status:  smtp.LocalError,
+			Message: "Could not expand list, try again later",
+		})
+		return
+	}
+	if !expanded {
+		proto.Send(smtp.Answer{
+			Status:  smtp.MailboxUnavailable,
+			Message: "Not a mailing list",
+		})
+		return
+	}
+	if len(members) == 0 {
+		proto.Send(smtp.Answer{
+			Status:  smtp.Ok,
+			Message: "List has no members",
+		})
+		return
+	}
+
+	messages := make([]string, len(members))
+	for i, member := range members {
+		messages[i] = "<" + member.GetAddress() + ">"
+	}
+	proto.Send(smtp.MultiAnswer{
+		Status:   smtp.Ok,
+		Messages: messages,
+	})
+}
@@ -0,0 +1,99 @@
+package mta
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// FCrDNSChecker does a forward-confirmed reverse DNS check of a client:
+// the ip should resolve to a hostname that resolves back to the same ip.
+type FCrDNSChecker interface {
+	Check(clientIP string) (fqdn string, ok bool, err error)
+}
+
+// Resolver does the DNS lookups for DefaultFCrDNSChecker.
+// It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultFCrDNSChecker is a FCrDNSChecker that uses DNS.
+type DefaultFCrDNSChecker struct {
+	// Resolver to use. If nil a shared CachingResolver around
+	// net.DefaultResolver is used.
+	Resolver Resolver
+	// Timeout for all lookups combined. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (c *DefaultFCrDNSChecker) Check(clientIP string) (string, bool, error) {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return "", false, nil
+	}
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = defaultResolver
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, clientIP)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	for _, name := range names {
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return strings.TrimSuffix(name, "."), true, nil
+			}
+		}
+	}
+
+	return "", false, nil
+}
+
+// checkFCrDNS checks the client with the FCrDNSChecker and stores the result
+// in the state. Returns false if the client should be rejected.
+func (s *Mta) checkFCrDNS(state *smtp.State) bool {
+	if s.config.FCrDNSChecker == nil {
+		return true
+	}
+
+	fqdn, ok, err := s.config.FCrDNSChecker.Check(state.Ip.String())
+	if err != nil {
+		// Don't reject clients because our DNS is having problems.
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Warnf("Could not check FCrDNS: %v", err)
+		state.FCrDNSOk = false
+		return true
+	}
+
+	state.FCrDNSOk = ok
+	if ok {
+		state.ClientName = fqdn
+		return true
+	}
+	return !s.config.RejectFailedFCrDNS
+}
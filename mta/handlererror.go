@@ -0,0 +1,59 @@
+package mta
+
+import (
+	"errors"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// TempError can be returned by a Handler when the mail can't be handled now,
+// but could be later. The client gets a 451 and should try again.
+type TempError struct {
+	Err error
+}
+
+func (e TempError) Error() string {
+	return e.Err.Error()
+}
+
+func (e TempError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports that the error is temporary, like net.Error does.
+func (e TempError) Temporary() bool {
+	return true
+}
+
+// PermError can be returned by a Handler when the mail will never be accepted.
+// The client gets a 554 and should not try again.
+type PermError struct {
+	Err error
+}
+
+func (e PermError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PermError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerErrorAnswer returns the answer for a mail the Handler returned err for.
+// Errors other than PermError are temporary, retrying is up to the client.
+func HandlerErrorAnswer(err error) smtp.Answer {
+	var permErr PermError
+	if errors.As(err, &permErr) {
+		return smtp.Answer{
+			Status:       smtp.NoValidRecipients,
+			EnhancedCode: "5.0.0",
+			Message:      "Transaction failed",
+		}
+	}
+
+	return smtp.Answer{
+		Status:       smtp.LocalError,
+		EnhancedCode: "4.3.0",
+		Message:      "Temporary local failure",
+	}
+}
@@ -0,0 +1,48 @@
+package mta
+
+import (
+	"sort"
+	"strings"
+)
+
+// defaultHelpText contains the answers for HELP <command>.
+// They can be overridden with Config.HelpText.
+var defaultHelpText = map[string]string{
+	"HELO":     "HELO <domain> - Identify the client",
+	"EHLO":     "EHLO <domain> - Identify the client and list the supported extensions",
+	"MAIL":     "MAIL FROM:<address> [BODY=8BITMIME|7BIT] - Start a mail transaction",
+	"RCPT":     "RCPT TO:<address> - Add a recipient",
+	"DATA":     "DATA - Send the message, end with <CRLF>.<CRLF>",
+	"BDAT":     "BDAT <chunk-size> [LAST] - Send a chunk of the message",
+	"RSET":     "RSET - Abort the current mail transaction",
+	"NOOP":     "NOOP - Do nothing",
+	"QUIT":     "QUIT - Close the connection",
+	"STARTTLS": "STARTTLS - Start a TLS handshake",
+	"AUTH":     "AUTH <mechanism> [initial-response] - Authenticate the client",
+	"HELP":     "HELP [command] - Show help",
+}
+
+// helpText returns the help text for a command.
+func (s *Mta) helpText(topic string) (string, bool) {
+	topic = strings.ToUpper(topic)
+	if text, ok := s.config.HelpText[topic]; ok {
+		return text, true
+	}
+	text, ok := defaultHelpText[topic]
+	return text, ok
+}
+
+// helpTopics returns all commands that have a help text.
+func (s *Mta) helpTopics() []string {
+	topics := []string{}
+	for topic := range defaultHelpText {
+		topics = append(topics, topic)
+	}
+	for topic := range s.config.HelpText {
+		if _, ok := defaultHelpText[strings.ToUpper(topic)]; !ok {
+			topics = append(topics, strings.ToUpper(topic))
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
@@ -0,0 +1,58 @@
+package mta
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// HistogramObserver counts message sizes per bucket.
+// Use its Observe method as Config.MessageSizeObserver.
+type HistogramObserver struct {
+	sync.Mutex
+	// Upper bounds of the buckets, sorted.
+	buckets []int64
+	counts  map[int64]int64
+}
+
+// NewHistogramObserver creates a histogram with the given bucket upper bounds.
+// A message is counted in the first bucket it fits in. Messages that are
+// larger than all buckets are counted in the math.MaxInt64 bucket.
+func NewHistogramObserver(buckets []int64) *HistogramObserver {
+	sorted := append([]int64{}, buckets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if len(sorted) == 0 || sorted[len(sorted)-1] != math.MaxInt64 {
+		sorted = append(sorted, math.MaxInt64)
+	}
+
+	counts := make(map[int64]int64, len(sorted))
+	for _, b := range sorted {
+		counts[b] = 0
+	}
+
+	return &HistogramObserver{
+		buckets: sorted,
+		counts:  counts,
+	}
+}
+
+// Observe counts a message of the given size.
+func (h *HistogramObserver) Observe(bytes int64) {
+	i := sort.Search(len(h.buckets), func(i int) bool { return h.buckets[i] >= bytes })
+
+	h.Lock()
+	defer h.Unlock()
+	h.counts[h.buckets[i]]++
+}
+
+// Snapshot returns the number of messages per bucket upper bound.
+func (h *HistogramObserver) Snapshot() map[int64]int64 {
+	h.Lock()
+	defer h.Unlock()
+
+	snapshot := make(map[int64]int64, len(h.counts))
+	for b, count := range h.counts {
+		snapshot[b] = count
+	}
+	return snapshot
+}
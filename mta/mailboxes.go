@@ -0,0 +1,76 @@
+package mta
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// LocalMailboxStore knows the mailboxes we deliver mail to.
+type LocalMailboxStore interface {
+	Exists(address smtp.MailAddress) (bool, error)
+}
+
+// FileMailboxStore is a LocalMailboxStore that reads the addresses of the
+// mailboxes from a file, one per line. Empty lines and lines starting with #
+// are ignored. Domains are compared case-insensitively, local parts aren't.
+type FileMailboxStore struct {
+	path      string
+	lock      sync.RWMutex
+	mailboxes map[string]bool
+}
+
+// NewFileMailboxStore reads the mailboxes from the file at path.
+func NewFileMailboxStore(path string) (*FileMailboxStore, error) {
+	s := &FileMailboxStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again, e.g. after mailboxes were added.
+// The old mailboxes are kept if the file is invalid.
+func (s *FileMailboxStore) Reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mailboxes := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		address, err := smtp.ParseAddress(text)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", s.path, line, err)
+		}
+		mailboxes[mailboxKey(address)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.mailboxes = mailboxes
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *FileMailboxStore) Exists(address smtp.MailAddress) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.mailboxes[mailboxKey(address)], nil
+}
+
+func mailboxKey(address smtp.MailAddress) string {
+	return address.GetLocal() + "@" + strings.ToLower(address.GetDomain())
+}
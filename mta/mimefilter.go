@@ -0,0 +1,106 @@
+package mta
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// maxMIMEDepth is how deep multiparts are walked by the MIMEFilter.
+const maxMIMEDepth = 10
+
+// MIMEFilter finds parts of a mail with a blocked content type.
+type MIMEFilter struct {
+	// BlockedContentTypes are media types like "application/zip", or
+	// prefixes ending in "/" like "application/". Case is ignored.
+	BlockedContentTypes []string
+}
+
+// BlockedPart walks all the parts of a mail and returns the content type
+// of the first blocked one, or "" if no part is blocked.
+// An error is returned if the mail isn't valid MIME.
+func (f MIMEFilter) BlockedPart(data []byte) (string, error) {
+	msg, err := smtp.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return f.walk(msg.Header.Get("Content-Type"), msg.Body, 0)
+}
+
+// walk checks the part with the given Content-Type header, and its children.
+func (f MIMEFilter) walk(contentType string, body io.Reader, depth int) (string, error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if f.blocked(mediaType) {
+		return mediaType, nil
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return "", nil
+	}
+
+	if depth >= maxMIMEDepth {
+		return "", errors.New("too many nested multiparts")
+	}
+	r := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		blocked, err := f.walk(part.Header.Get("Content-Type"), part, depth+1)
+		if blocked != "" || err != nil {
+			return blocked, err
+		}
+	}
+}
+
+func (f MIMEFilter) blocked(mediaType string) bool {
+	for _, blocked := range f.BlockedContentTypes {
+		blocked = strings.ToLower(blocked)
+		if mediaType == blocked || (strings.HasSuffix(blocked, "/") && strings.HasPrefix(mediaType, blocked)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectBlockedContent runs the MIMEFilter on the received data. It returns
+// true if the mail was rejected.
+// Mails that can't be parsed are accepted, like the other checks after DATA do.
+func (s *Mta) rejectBlockedContent(proto smtp.Protocol, state *smtp.State) bool {
+	filter := MIMEFilter{BlockedContentTypes: s.config.BlockedContentTypes}
+	blocked, err := filter.BlockedPart(state.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Debugf("Could not parse message for BlockedContentTypes: %v", err)
+	}
+	if blocked == "" {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Infof("Rejected mail with a part of type %s", blocked)
+	proto.Send(smtp.Answer{
+		Status:       smtp.AbortMail,
+		EnhancedCode: "5.7.1",
+		Message:      "Attachment type not allowed",
+	})
+	return true
+}
@@ -1,11 +1,16 @@
 package mta
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gopistolet/gopistolet/helpers"
@@ -14,12 +19,295 @@ import (
 )
 
 type Config struct {
-	Ip        string
+	// Ip and Port are the address we listen on, an empty Ip listens on
+	// all interfaces.
+	Ip string
+	// Hostname is our name in the greeting and the EHLO answer, e.g. the
+	// public name of the server. It is not used to listen.
 	Hostname  string
 	Port      uint32
 	TlsCert   string
 	TlsKey    string
 	Blacklist helpers.Blacklist
+	// TlsMinVersion is the minimum TLS version for STARTTLS, e.g.
+	// tls.VersionTLS12. 0 for the default of crypto/tls.
+	TlsMinVersion uint16
+	// GracePeriod is the time existing connections get to finish after Stop
+	// is called. Defaults to 10 seconds.
+	GracePeriod time.Duration
+	// WarnOnSTARTTLSDowngrade logs a warning when a client reconnects within
+	// a minute after its STARTTLS handshake failed. Clients that fall back to
+	// plaintext could be attacked by someone who interferes with the handshake
+	// or strips STARTTLS from our EHLO answer.
+	WarnOnSTARTTLSDowngrade bool
+	// StrictPipelining checks that the answers a pipelining client waits for
+	// (RFC 2920 3.2) are sent before the next command is read, and panics if
+	// they aren't. It is meant for tests. Without it the check is only done
+	// for protocols that buffer answers, and violations are logged.
+	StrictPipelining bool
+	// RecordSessionTrace makes HandleClient return the commands of the
+	// session with our answers, e.g. for tests. AUTH responses and mail data
+	// are left out. Off by default, sessions don't keep their commands then.
+	RecordSessionTrace bool
+	// DMARCChecker is called after DATA to check the DMARC policy of the sender.
+	// Nil if DMARC should not be checked.
+	DMARCChecker DMARCChecker
+	// DKIMVerifier is called after DATA to verify the DKIM signatures of the
+	// mail. The results are in State.DKIMResults. Nil if DKIM should not be
+	// verified.
+	DKIMVerifier DKIMVerifier
+	// SPFChecker is called after DATA to check the SPF policy of the sender.
+	// Nil if SPF should not be checked.
+	SPFChecker SPFChecker
+	// AddReceivedSPF prepends a Received-SPF: header with the result of the
+	// SPFChecker to the mail.
+	AddReceivedSPF bool
+	// GlobalBandwidthLimiter limits the bytes per second that can be received
+	// in DATA over all sessions combined. Nil if there is no limit.
+	GlobalBandwidthLimiter smtp.BandwidthLimiter
+	// HelpText overrides or extends the answers for HELP <command>.
+	// Keys are upper case command names.
+	HelpText map[string]string
+	// MaskServerInfo keeps answers as generic as possible so clients can't
+	// fingerprint the server. The greeting becomes "<hostname> ESMTP".
+	MaskServerInfo bool
+	// DomainPolicies contains restrictions per sender and recipient domain.
+	// The "*" entry is used for domains that are not in the map.
+	DomainPolicies map[string]DomainPolicy
+	// CertAuthBackend enables AUTH EXTERNAL with TLS client certificates.
+	CertAuthBackend CertAuthBackend
+	// AuthBackend enables AUTH PLAIN and LOGIN with a username and password.
+	// They are only offered over TLS, unless AllowInsecureAuth is set.
+	AuthBackend       AuthBackend
+	AllowInsecureAuth bool
+	// EnableRequireTLS advertises REQUIRETLS (RFC 8689) to clients that use
+	// TLS. Mails sent with it have State.RequireTLS set.
+	EnableRequireTLS bool
+	// ScramAuthBackend enables AUTH SCRAM-SHA-256, e.g. with a scram.Store.
+	// Like PLAIN it is only offered over TLS, unless AllowInsecureAuth is set.
+	ScramAuthBackend ScramAuthBackend
+	// LoginUsernamePrompt and LoginPasswordPrompt are the base64 encoded
+	// prompts of AUTH LOGIN. They default to "Username:" and "Password:".
+	LoginUsernamePrompt string
+	LoginPasswordPrompt string
+	// RelayDomains are the domains we accept mail for. Mail for other domains
+	// is rejected, unless AllowRelayForAuthenticated is set and the client
+	// is authenticated. Leave empty to accept mail for every domain.
+	RelayDomains               []string
+	AllowRelayForAuthenticated bool
+	// AcceptXFORWARD enables the Postfix XFORWARD command for clients
+	// in TrustedXFORWARDSources.
+	AcceptXFORWARD         bool
+	TrustedXFORWARDSources []net.IPNet
+	// EnableATRN lets authenticated clients get the mail ATRNQueueDrainer
+	// has for their domains with ATRN (On-Demand Mail Relay, RFC 2645).
+	// ATRNDomains are the domains every user may get the mail for, by
+	// State.AuthUser.
+	EnableATRN       bool
+	ATRNQueueDrainer ATRNQueueDrainer
+	ATRNDomains      map[string][]string
+	// EnableInternalHealthPing answers the non-standard PING command with
+	// "250 PONG" for clients in InternalNetworks, so load balancers can check
+	// the server without an EHLO. Other clients get a 500.
+	EnableInternalHealthPing bool
+	InternalNetworks         []net.IPNet
+	// WriteTimeout is the maximum time for sending an answer to a client.
+	// The connection is closed if it expires. 0 for no timeout.
+	WriteTimeout time.Duration
+	// MaxHeloLen is the maximum length of the HELO/EHLO hostname.
+	// Defaults to 255.
+	MaxHeloLen int
+	// NormalizeCRLF stores mails received with BDAT with CRLF line endings,
+	// also when the client sent bare LFs. The chunks are still read as the
+	// announced number of raw bytes. By default the mail gets LF line endings,
+	// like mails received with DATA.
+	NormalizeCRLF bool
+	// AcceptBareLF stores mails received with DATA with CRLF line endings.
+	// Bare LFs, which are always accepted as line endings, and bare CRs
+	// become CRLF too (RFC 5321 4.1.1.5). By default the mail gets LF line
+	// endings.
+	AcceptBareLF bool
+	// AuthenticatedSenderRateLimit limits the number of messages an
+	// authenticated user can send. Nil if there is no limit.
+	AuthenticatedSenderRateLimit *RateLimit
+	// SenderRewriter can rewrite the envelope sender, e.g. for SRS.
+	// The original sender is kept in State.OriginalFrom. Nil to keep the sender as is.
+	SenderRewriter func(from smtp.MailAddress) (smtp.MailAddress, error)
+	// MessageSizeObserver is called with the size of every accepted message,
+	// e.g. HistogramObserver.Observe. Nil if sizes don't need to be observed.
+	MessageSizeObserver func(bytes int64)
+	// RecipientRewriter rewrites the recipients at RCPT, e.g. aliases with
+	// NewFileAliasRewriter. Relaying is checked before, the other checks
+	// after the rewrite. Nil to keep the recipients as is.
+	RecipientRewriter AddressRewriter
+	// FCrDNSChecker checks the reverse DNS of clients after HELO/EHLO.
+	// The result is stored in State.FCrDNSOk. Nil to skip the check.
+	FCrDNSChecker FCrDNSChecker
+	// RejectFailedFCrDNS rejects HELO/EHLO of clients that fail the FCrDNS check.
+	RejectFailedFCrDNS bool
+	// RcptValidator checks if we accept mail for a recipient. Nil to accept all recipients.
+	RcptValidator RcptValidator
+	// MaxRcptErrors is the number of rejected recipients after which the client
+	// is disconnected, to make guessing addresses harder. 0 for no limit.
+	MaxRcptErrors int
+	// DeniedCIDRs are networks that can't connect to us.
+	DeniedCIDRs []net.IPNet
+	// AllowedCIDRs are the only networks that can connect to us if not empty.
+	// DeniedCIDRs take precedence over them.
+	AllowedCIDRs []net.IPNet
+	// MaxRecipients is the maximum number of recipients per mail, 0 for no limit.
+	// The MaxRecipients of the recipient domain policies is used if it is lower.
+	MaxRecipients int
+	// MaxRecipientsPerSenderDomain is the maximum number of recipients per
+	// mail in the domain of the sender, 0 for no limit. Further recipients
+	// in that domain get a 452.
+	MaxRecipientsPerSenderDomain int
+	// MaxEnvelopeSize is the maximum number of bytes of the MAIL and RCPT
+	// addresses of a session, 0 for no limit. It limits the memory a client
+	// uses before DATA, RSET doesn't clear it.
+	MaxEnvelopeSize int
+	// ListExpander expands mailing list addresses to their members.
+	// Nil if there are no mailing lists.
+	ListExpander ListExpander
+	// RejectEmptyExpansion answers 554 "No valid recipients" to DATA and BDAT
+	// when the accepted recipients expanded to no recipients at all, e.g.
+	// empty lists of the ListExpander. Otherwise the answer is a 503.
+	RejectEmptyExpansion bool
+	// LocalMailboxes makes us a final destination that only accepts mail for
+	// its mailboxes: other recipients get a 550 "User unknown". The lists of
+	// the ListExpander don't have to be mailboxes. Nil to accept all recipients.
+	LocalMailboxes LocalMailboxStore
+	// ExpnRequiresAuth only lets authenticated clients expand the lists of the
+	// ListExpander with EXPN. Without a ListExpander EXPN isn't implemented.
+	ExpnRequiresAuth bool
+	// ExpnAllowedNets are the only networks that can use EXPN if not empty.
+	ExpnAllowedNets []net.IPNet
+	// AddReceivedHeader adds a Received: header for the time the data was
+	// received, and one for the time the mail was passed to the handler.
+	AddReceivedHeader bool
+	// DisabledExtensions are not advertised in the EHLO answer, for clients
+	// that can't handle them. E.g. "STARTTLS" or "8BITMIME".
+	DisabledExtensions []string
+	// EhloCapabilityOrder is the order of the extensions in the EHLO answer,
+	// by name, e.g. []string{"SIZE", "8BITMIME", "AUTH"}. Extensions that
+	// aren't listed follow in the default order: 8BITMIME, CHUNKING,
+	// ENHANCEDSTATUSCODES, PIPELINING, SIZE, STARTTLS, REQUIRETLS, AUTH and
+	// XFORWARD.
+	EhloCapabilityOrder []string
+	// BannerDelay is the time we wait before sending the greeting.
+	// Clients that talk before it are marked with State.PipelinedBefore.
+	BannerDelay time.Duration
+	// RejectPipelinedBefore rejects clients that talk before the greeting.
+	RejectPipelinedBefore bool
+	// SessionResumptionEnabled adds a token to the greeting, with which a
+	// client can resume the session when it reconnects from the same ip:
+	// "EHLO <domain> session-token=<token>". The HELO name of the previous
+	// session is restored and the FCrDNS check is skipped. This is not standard.
+	SessionResumptionEnabled bool
+	// SessionSecret signs the session tokens, session resumption needs it.
+	SessionSecret []byte
+	// SessionTokenTTL is how long a session token can be used, 10 minutes by default.
+	SessionTokenTTL time.Duration
+	// RequireClientToken is a secret shared with the clients. When set, the
+	// greeting contains "(session-id=<id>)" and mails are rejected unless
+	// the first 4 KB have a header "X-Gopistolet-Token: <token>", with the
+	// token from ClientToken(id, secret). Old tokens can't be replayed.
+	RequireClientToken string
+	// Queue stores accepted mails before the 250 is sent. They are passed to
+	// the MailHandler in the background. If that fails they are retried after
+	// QueueRetryInterval, which doubles with every failure up to an hour, and
+	// after a restart. Nil to call the MailHandler before answering.
+	Queue Queue
+	// QueueRetryInterval is the time before a queued mail is retried the
+	// first time. Defaults to 1 minute.
+	QueueRetryInterval time.Duration
+	// CatchAllAddress replaces the recipients of every mail, so test
+	// environments don't send real mail. The recipients given by the client
+	// are kept in State.OriginalTo. Nil to keep the recipients.
+	CatchAllAddress *smtp.MailAddress
+	// EventListeners are notified of the events in every session.
+	EventListeners []EventListener
+	// OnSessionEnd is called when a session ends, after the connection is
+	// closed, e.g. to release resources of the session. Nil if nothing has
+	// to be done.
+	OnSessionEnd func(state *smtp.State, reason SessionEndReason)
+	// CommandTimeouts are the times we wait for the next command, by the
+	// command we expect: "EHLO", "MAIL", or "RCPT" for RCPT and DATA.
+	// "DATA" is the time we wait for every block of mail data.
+	// Missing commands use DefaultCommandTimeouts, 0 disables the timeout.
+	CommandTimeouts map[string]time.Duration
+	// DataChunkTimeout is the time we wait for more mail data in DATA and
+	// BDAT, instead of the "DATA" timeout. It starts again whenever data
+	// arrives, so slow clients can send as long as they keep sending.
+	// The client gets 421 "Data timeout" and is disconnected.
+	DataChunkTimeout time.Duration
+	// LargeMessageDelay is the time we wait before accepting a mail of more
+	// than LargeMessageThreshold bytes, so large mails from untrusted
+	// clients are received slowly. The wait ends early when the server is
+	// stopped. Authenticated clients don't wait with
+	// LargeMessageDelayBypassAuth.
+	LargeMessageThreshold       int64
+	LargeMessageDelay           time.Duration
+	LargeMessageDelayBypassAuth bool
+	// SequenceAnalyzer looks for unusual orders of commands, e.g.
+	// DefaultNgramAnalyzer(). Suspicious sessions are logged, and their
+	// commands are rejected if RejectSuspiciousSequences is set.
+	// Nil to not analyze the commands.
+	SequenceAnalyzer          SequenceAnalyzer
+	RejectSuspiciousSequences bool
+	// Smarthost is the "host:port" of a server that all mails are relayed to.
+	// The mail is only accepted when the smarthost accepted it, then it is
+	// passed to the MailHandler, which can't reject it anymore. The relay
+	// happens before the client gets an answer, use a Queue to answer once
+	// the mail is stored and relay it in the background. Empty to not relay.
+	// SmarthostURI can be used instead of the Smarthost fields.
+	Smarthost string
+	// SmarthostUser and SmarthostPassword are sent with AUTH PLAIN if
+	// SmarthostUser is set. They are only sent over TLS or to localhost.
+	SmarthostUser     string
+	SmarthostPassword string
+	// SmarthostTLS requires STARTTLS with a valid certificate for the smarthost.
+	SmarthostTLS bool
+	// SmarthostURI is the smarthost as SMTP URI, see ParseSmtpURI.
+	// It takes precedence over the other Smarthost fields.
+	SmarthostURI string
+	// TLSSessionTicketsEnabled lets clients resume TLS sessions with session
+	// tickets, without a full handshake. TLSSessionTicketKey encrypts the
+	// tickets, it should be rotated with RotateSessionTicketKey.
+	// Random keys are used if it is zero.
+	TLSSessionTicketsEnabled bool
+	TLSSessionTicketKey      [32]byte
+	// VerifySenderDomain rejects senders whose domain has no MX, A or AAAA
+	// record. The lookups are done with SenderDomainResolver (net.DefaultResolver
+	// if nil) and cached for SenderDomainCacheTTL, which defaults to 5 minutes.
+	VerifySenderDomain   bool
+	SenderDomainResolver DNSResolver
+	SenderDomainCacheTTL time.Duration
+	// NotifyPostmaster passes a delivery status notification to the
+	// MailHandler, for PostmasterAddress, when the MailHandler rejects a
+	// mail with a PermError. The notification has the null sender.
+	NotifyPostmaster  bool
+	PostmasterAddress smtp.MailAddress
+	// BlockedContentTypes rejects mails with a 552 if any of their MIME parts
+	// has one of these content types, e.g. "application/zip", or starts
+	// with one of them that ends in "/", e.g. "application/".
+	BlockedContentTypes []string
+	// MaxDataErrors is the number of too long lines that are allowed in the
+	// data of one mail. Each gets a 500, after that the mail is rejected with
+	// a 552. 0 means no limit.
+	MaxDataErrors int
+	// DeduplicateRecipients doesn't add a recipient to the mail again when
+	// a client sends the same RCPT twice. It still gets a 250.
+	DeduplicateRecipients bool
+	// AdminAddr is the "host:port" the admin.Server listens on, separate
+	// from the SMTP port. AdminToken is the bearer token its requests need.
+	AdminAddr  string
+	AdminToken string
+	// EnableCapture records the raw bytes of every session of ListenAndServe,
+	// see Mta.CaptureSession. CaptureBuffer is the number of reads and
+	// writes that are kept per session, 1000 if 0.
+	EnableCapture bool
+	CaptureBuffer int
 }
 
 // Session id
@@ -36,19 +324,38 @@ func generateSessionId() smtp.Id {
 }
 
 // Handler is the interface that will be used when a mail was received.
+// The state is reused after Handle returns, copy what should be kept. The
+// State.To and State.Data slices can be kept, the next mail of the session
+// doesn't overwrite them.
+// When Handle returns an error the mail is not accepted, see HandlerErrorAnswer.
 type Handler interface {
-	Handle(*smtp.State)
+	Handle(*smtp.State) error
 }
 
 // HandlerFunc is a wrapper to allow normal functions to be used as a handler.
-type HandlerFunc func(*smtp.State)
+type HandlerFunc func(*smtp.State) error
 
-func (h HandlerFunc) Handle(state *smtp.State) {
-	h(state)
+func (h HandlerFunc) Handle(state *smtp.State) error {
+	return h(state)
+}
+
+var _ Handler = HandlerFunc(nil)
+
+// ShutdownNotifier can be implemented by a Handler that wants to know when the
+// server is about to shut down. NotifyShutdown is called by Stop before new
+// connections are refused. The context expires when the grace period is over,
+// after which existing connections are closed. It should not block.
+type ShutdownNotifier interface {
+	NotifyShutdown(ctx context.Context)
 }
 
 // Mta Represents an MTA server
 type Mta struct {
+	// Statistics, keep them first so they are aligned for atomic access.
+	messagesAccepted  int64
+	activeConnections int32
+	failingQueued     int32
+
 	config Config
 	// The handler to be called when a mail is received.
 	MailHandler Handler
@@ -60,6 +367,28 @@ type Mta struct {
 	// When this is closed existing connections should stop.
 	quitC chan bool
 	wg    sync.WaitGroup
+	// Clients that recently started a TLS handshake.
+	tlsClients *tlsClients
+	// Messages sent by authenticated users.
+	senderRates *senderRates
+	// The part of the config that can be changed with ReloadConfig.
+	runtimeLock sync.RWMutex
+	runtime     *runtimeConfig
+	// Wakes up the queue worker, nil if there is no queue.
+	queueC chan bool
+	// The current and previous TLS session ticket key.
+	ticketLock sync.Mutex
+	ticketKeys [][32]byte
+	// Caches the lookups of VerifySenderDomain, nil if it is not set.
+	senderDomainResolver *CachingResolver
+	// Where mail is relayed to, nil if it isn't relayed.
+	smarthost *SmarthostConfig
+	// Set if the smarthost config is invalid, mails are not accepted then.
+	smarthostErr error
+	// The sessions that can be resumed, nil if session resumption is disabled.
+	resumable *resumableSessions
+	// The active sessions.
+	sessions *sessionRegistry
 }
 
 // New Create a new MTA server that doesn't handle the protocol.
@@ -69,6 +398,32 @@ func New(c Config, h Handler) *Mta {
 		MailHandler: h,
 		quitC:       make(chan bool),
 		shutDownC:   make(chan bool),
+		tlsClients:  newTlsClients(60 * time.Second),
+		senderRates: newSenderRates(),
+		runtime:     newRuntimeConfig(c),
+		sessions:    newSessionRegistry(),
+	}
+
+	mta.smarthost, mta.smarthostErr = smarthostConfig(c)
+	if mta.smarthostErr != nil {
+		log.Errorf("Invalid smarthost, mails will not be accepted: %v", mta.smarthostErr)
+	}
+
+	if c.VerifySenderDomain {
+		mta.senderDomainResolver = newSenderDomainResolver(c)
+	}
+
+	if c.SessionResumptionEnabled {
+		if len(c.SessionSecret) == 0 {
+			log.Errorf("Session resumption needs a SessionSecret, it is disabled")
+		} else {
+			mta.resumable = newResumableSessions(c.SessionSecret, c.SessionTokenTTL)
+		}
+	}
+
+	if c.Queue != nil {
+		mta.queueC = make(chan bool, 1)
+		go mta.runQueue()
 	}
 
 	if c.TlsCert != "" && c.TlsKey != "" {
@@ -78,7 +433,21 @@ func New(c Config, h Handler) *Mta {
 		} else {
 			mta.TlsConfig = &tls.Config{
 				Certificates: []tls.Certificate{cert},
+				ServerName:   c.Hostname,
+				MinVersion:   c.TlsMinVersion,
+			}
+			for _, warning := range ValidateTLSConfig(mta.TlsConfig) {
+				if warning.IsError() {
+					log.Errorf("TLS certificate: %s", warning)
+				} else {
+					log.Warnf("TLS certificate: %s", warning)
+				}
+			}
+			if c.CertAuthBackend != nil {
+				// The backend verifies the certificates.
+				mta.TlsConfig.ClientAuth = tls.RequestClientCert
 			}
+			mta.setupSessionTickets(mta.TlsConfig)
 		}
 	}
 
@@ -87,15 +456,39 @@ func New(c Config, h Handler) *Mta {
 
 func (s *Mta) Stop() {
 	log.Printf("Received stop command. Sending shutdown event...")
+	t := s.gracePeriod()
+	if n, ok := s.MailHandler.(ShutdownNotifier); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), t)
+		defer cancel()
+		n.NotifyShutdown(ctx)
+	}
 	close(s.shutDownC)
 	// Give existing connections some time to finish.
-	t := time.Duration(10)
-	log.Printf("Waiting for a maximum of %d seconds...", t)
-	time.Sleep(t * time.Second)
+	log.Printf("Waiting for a maximum of %v...", t)
+	time.Sleep(t)
 	log.Printf("Sending force quit event...")
 	close(s.quitC)
 }
 
+func (s *Mta) gracePeriod() time.Duration {
+	if s.config.GracePeriod <= 0 {
+		return 10 * time.Second
+	}
+	return s.config.GracePeriod
+}
+
+func (s *Mta) maxHeloLen() int {
+	if s.config.MaxHeloLen <= 0 {
+		return 255
+	}
+	return s.config.MaxHeloLen
+}
+
+// addr is the address we listen on.
+func (s *Mta) addr() string {
+	return fmt.Sprintf("%s:%d", s.config.Ip, s.config.Port)
+}
+
 func (s *Mta) hasTls() bool {
 	return s.TlsConfig != nil
 }
@@ -123,12 +516,18 @@ func (s *DefaultMta) Stop() {
 }
 
 func (s *DefaultMta) ListenAndServe() error {
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.mta.config.Ip, s.mta.config.Port))
+	ln, err := net.Listen("tcp", s.mta.addr())
 	if err != nil {
 		log.Errorf("Could not start listening: %v", err)
 		return err
 	}
 
+	return s.Serve(ln)
+}
+
+// Serve handles the connections accepted on ln untill the server is stopped.
+// The listener will be closed when done.
+func (s *DefaultMta) Serve(ln net.Listener) error {
 	// Close the listener so that listen well return from ln.Accept().
 	go func() {
 		_, ok := <-s.mta.shutDownC
@@ -137,7 +536,7 @@ func (s *DefaultMta) ListenAndServe() error {
 		}
 	}()
 
-	err = s.listen(ln)
+	err := s.listen(ln)
 	log.Printf("Waiting for connections to close...")
 	s.mta.wg.Wait()
 	return err
@@ -169,30 +568,376 @@ func (s *DefaultMta) listen(ln net.Listener) error {
 func (s *DefaultMta) serve(c net.Conn) {
 	defer s.mta.wg.Done()
 
-	proto := smtp.NewMtaProtocol(c)
-	if proto == nil {
-		log.Errorf("Could not create Mta protocol")
-		c.Close()
+	var proto smtp.Protocol
+	if s.mta.config.EnableCapture {
+		capturing := smtp.NewCapturingProtocol(c, s.mta.config.CaptureBuffer)
+		capturing.WriteTimeout = s.mta.config.WriteTimeout
+		proto = capturing
+	} else {
+		mtaProto := smtp.NewMtaProtocol(c)
+		mtaProto.WriteTimeout = s.mta.config.WriteTimeout
+		proto = mtaProto
+	}
+
+	if ip := proto.GetIP(); !s.mta.ipAllowed(ip) {
+		log.WithFields(log.Fields{
+			"Ip": ip.String(),
+		}).Warn("IP not allowed to connect, closing connection")
+		proto.Send(smtp.Answer{
+			Status:  smtp.TransactionFailed,
+			Message: "Access denied",
+		})
+		proto.Close()
 		return
 	}
+
 	s.mta.HandleClient(proto)
 }
 
+// withoutDuplicates returns the recipients that aren't in to yet.
+func withoutDuplicates(to, recipients []*smtp.MailAddress) []*smtp.MailAddress {
+	result := []*smtp.MailAddress{}
+	for _, rcpt := range recipients {
+		if !containsAddress(to, rcpt) && !containsAddress(result, rcpt) {
+			result = append(result, rcpt)
+		}
+	}
+	return result
+}
+
+// countDomain returns the number of addresses in domain, which is compared
+// case-insensitively.
+func countDomain(addresses []*smtp.MailAddress, domain string) int {
+	n := 0
+	for _, a := range addresses {
+		if strings.EqualFold(a.GetDomain(), domain) {
+			n++
+		}
+	}
+	return n
+}
+
+// containsAddress compares the domains case-insensitively, the local parts aren't.
+func containsAddress(addresses []*smtp.MailAddress, address *smtp.MailAddress) bool {
+	for _, a := range addresses {
+		if a.GetLocal() == address.GetLocal() && strings.EqualFold(a.GetDomain(), address.GetDomain()) {
+			return true
+		}
+	}
+	return false
+}
+
+// readData reads all data from r. It stops early when the server is quitting,
+// in which case stopped is true.
+func (s *Mta) readData(r io.Reader) (data []byte, stopped bool, err error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	resultC := make(chan result, 1)
+	go func() {
+		data, err := ioutil.ReadAll(r)
+		resultC <- result{data: data, err: err}
+	}()
+
+	select {
+	case _, ok := <-s.quitC:
+		if !ok {
+			return nil, true, nil
+		}
+	case r := <-resultC:
+		return r.data, false, r.err
+	}
+
+	return nil, false, nil
+}
+
+// discardData reads and drops n bytes of r, like readData. It returns the
+// number of bytes that were read.
+func (s *Mta) discardData(r io.Reader, n int64) (written int64, stopped bool, err error) {
+	type result struct {
+		written int64
+		err     error
+	}
+
+	resultC := make(chan result, 1)
+	go func() {
+		written, err := io.CopyN(ioutil.Discard, r, n)
+		resultC <- result{written: written, err: err}
+	}()
+
+	select {
+	case _, ok := <-s.quitC:
+		if !ok {
+			return 0, true, nil
+		}
+	case r := <-resultC:
+		return r.written, false, r.err
+	}
+
+	return 0, false, nil
+}
+
+// discardLongLines drops the data of the readers returned by r until one of
+// them ends without a line that is too long, like readData.
+func (s *Mta) discardLongLines(r func() io.Reader) (stopped bool, err error) {
+	errC := make(chan error, 1)
+	go func() {
+		err := smtp.ErrLtl
+		for err == smtp.ErrLtl {
+			_, err = io.Copy(ioutil.Discard, r())
+		}
+		errC <- err
+	}()
+
+	select {
+	case _, ok := <-s.quitC:
+		if !ok {
+			return true, nil
+		}
+	case err := <-errC:
+		return false, err
+	}
+
+	return false, nil
+}
+
+// cannotReceiveDataAnswer is the answer to DATA or BDAT when
+// State.CanReceiveData returned reason. With RejectEmptyExpansion it's a
+// 554 if the recipients of the transaction expanded to none.
+func (s *Mta) cannotReceiveDataAnswer(state *smtp.State, reason string, emptyExpansion bool) smtp.Answer {
+	if s.config.RejectEmptyExpansion && emptyExpansion && state.From != nil && len(state.To) == 0 {
+		return smtp.Answer{
+			Status:       smtp.NoValidRecipients,
+			EnhancedCode: "5.1.1",
+			Message:      "No valid recipients",
+		}
+	}
+	return smtp.Answer{
+		Status:  smtp.BadSequence,
+		Message: reason,
+	}
+}
+
+// deliver checks the received mail and passes it to the MailHandler or the Queue.
+// The state is reset afterwards so we can start from a clean slate.
+func (s *Mta) deliver(proto smtp.Protocol, state *smtp.State, rc *runtimeConfig) {
+	s.notify(func(l EventListener) { l.OnData(state.SessionId.String(), len(state.Data)) })
+	// The size as received, before we add headers.
+	size := int64(len(state.Data))
+
+	if maxMessageSize, _ := rc.recipientLimits(state.To); maxMessageSize > 0 && int64(len(state.Data)) > maxMessageSize {
+		proto.Send(smtp.Answer{
+			Status:  smtp.AbortMail,
+			Message: "Message exceeds maximum size",
+		})
+		state.Reset()
+		return
+	}
+
+	if s.config.RequireClientToken != "" && s.rejectClientToken(proto, state) {
+		state.Reset()
+		return
+	}
+
+	if len(s.config.BlockedContentTypes) > 0 && s.rejectBlockedContent(proto, state) {
+		state.Reset()
+		return
+	}
+
+	if s.config.DKIMVerifier != nil {
+		state.DKIMResults = s.checkDKIM(state)
+	}
+
+	spfResult := "none"
+	if s.config.SPFChecker != nil {
+		spfResult = s.checkSPF(state)
+	}
+
+	if s.config.DMARCChecker != nil {
+		state.DMARCResult = s.checkDMARC(state, spfResult)
+		if state.DMARCResult == "reject" {
+			proto.Send(smtp.Answer{
+				Status:       smtp.MailboxUnavailable,
+				EnhancedCode: "5.7.1",
+				Message:      "Rejected by DMARC policy",
+			})
+			state.Reset()
+			return
+		}
+		if state.DMARCResult == "quarantine" {
+			state.Data = prependHeader(state.Data, "X-DMARC-Quarantine: true\n")
+		}
+	}
+
+	if s.config.MessageSizeObserver != nil {
+		s.config.MessageSizeObserver(int64(len(state.Data)))
+	}
+
+	if s.config.AddReceivedHeader {
+		state.Data = prependHeader(state.Data, s.receivedHeaders(state, time.Now()))
+	}
+
+	if s.config.SPFChecker != nil && s.config.AddReceivedSPF {
+		// Above our Received: headers, see RFC 7208 9.1.
+		state.Data = prependHeader(state.Data, s.receivedSPFHeader(state, spfResult))
+	}
+
+	if s.config.CatchAllAddress != nil {
+		state.OriginalTo = state.To
+		state.To = []*smtp.MailAddress{s.config.CatchAllAddress}
+	}
+
+	s.delayLargeMessage(state, size)
+
+	// The handler and the queue can keep State.To, so it gets a new backing
+	// array instead of the one Reset would reuse.
+	defer func() {
+		state.To = nil
+	}()
+
+	message := "Mail delivered"
+	if s.config.Queue != nil {
+		if err := s.enqueue(state); err != nil {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+			}).Errorf("Could not queue mail: %v", err)
+			proto.Send(smtp.Answer{
+				Status:  smtp.LocalError,
+				Message: "Could not queue mail, try again later",
+			})
+			state.Reset()
+			return
+		}
+		message = "Mail queued"
+	} else if err := s.handle(state); err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Warnf("Handler did not accept mail: %v", err)
+		answer := HandlerErrorAnswer(err)
+		proto.Send(answer)
+		if s.config.NotifyPostmaster && errors.As(err, &PermError{}) {
+			s.notifyPostmaster(state, answer)
+		}
+		state.Reset()
+		return
+	}
+	atomic.AddInt64(&s.messagesAccepted, 1)
+	if rc.senderRateLimit != nil && state.Authenticated {
+		s.senderRates.add(state.AuthUser, rc.senderRateLimit.Window)
+	}
+
+	proto.Send(smtp.Answer{
+		Status:  smtp.Ok,
+		Message: message,
+	})
+
+	state.Reset()
+}
+
+// delayLargeMessage waits LargeMessageDelay before a mail of size bytes is
+// accepted if it is large, or until the server is stopped.
+func (s *Mta) delayLargeMessage(state *smtp.State, size int64) {
+	if s.config.LargeMessageDelay <= 0 || size <= s.config.LargeMessageThreshold {
+		return
+	}
+	if state.Authenticated && s.config.LargeMessageDelayBypassAuth {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"SessionId": state.SessionId.String(),
+		"Size":      size,
+	}).Debugf("Delaying large mail for %v", s.config.LargeMessageDelay)
+	timer := time.NewTimer(s.config.LargeMessageDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.quitC:
+	}
+}
+
+// MessagesAccepted returns the number of mails that were passed to the MailHandler,
+// or to the Queue if there is one.
+func (s *Mta) MessagesAccepted() int64 {
+	return atomic.LoadInt64(&s.messagesAccepted)
+}
+
+// FailingQueuedMails returns the number of mails in the Queue the MailHandler
+// failed for, that are waiting to be retried.
+func (s *Mta) FailingQueuedMails() int32 {
+	return atomic.LoadInt32(&s.failingQueued)
+}
+
+// ActiveConnections returns the number of clients that are being handled.
+func (s *Mta) ActiveConnections() int32 {
+	return atomic.LoadInt32(&s.activeConnections)
+}
+
+// inputWaiter is implemented by protocols that can tell if the client sent
+// something, without waiting for a complete command.
+type inputWaiter interface {
+	WaitForInput(d time.Duration) bool
+}
+
 // HandleClient Start communicating with a client
-func (s *Mta) HandleClient(proto smtp.Protocol) {
+// Returns the commands of the session with our answers to them if
+// Config.RecordSessionTrace is set, otherwise an empty trace.
+func (s *Mta) HandleClient(proto smtp.Protocol) (trace SessionTrace) {
+	atomic.AddInt32(&s.activeConnections, 1)
+	defer atomic.AddInt32(&s.activeConnections, -1)
+
 	//log.Printf("Received connection")
 
+	if _, ok := proto.(flusher); ok || s.config.StrictPipelining {
+		proto = newPipelineEnforcer(proto, s.config.StrictPipelining)
+	}
+	if s.config.RecordSessionTrace {
+		recorder := newTraceRecorder(proto)
+		proto = recorder
+		defer func() {
+			trace = recorder.Trace()
+		}()
+	}
+
 	// Hold state for this client connection
 	state := proto.GetState()
 	state.Reset()
 	state.SessionId = generateSessionId()
 	state.Ip = proto.GetIP()
+	// The session keeps using this config when it is reloaded.
+	rc := s.loadRuntimeConfig()
 
 	log.WithFields(log.Fields{
 		"SessionId": state.SessionId.String(),
 		"Ip":        state.Ip.String(),
 	}).Debug("Received connection")
 
+	id := state.SessionId.String()
+	s.notify(func(l EventListener) { l.OnConnect(id, state.Ip.String()) })
+	// The error that ended the connection, nil if it was closed by QUIT or by us.
+	var disconnectErr error
+	defer func() {
+		s.notify(func(l EventListener) { l.OnDisconnect(id, disconnectErr) })
+	}()
+	// Why the session ended, for OnSessionEnd.
+	reason := EndError
+	if s.config.OnSessionEnd != nil {
+		defer func() {
+			s.config.OnSessionEnd(state, reason)
+		}()
+	}
+
+	// Canceled by KillSession.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sessions.add(id, state.Ip.String(), cancel)
+	if c, ok := baseProtocol(proto).(capturer); ok {
+		s.sessions.setCapture(id, c)
+	}
+	defer s.sessions.remove(id)
+
 	if s.config.Blacklist != nil {
 		if s.config.Blacklist.CheckIp(state.Ip.String()) {
 			log.WithFields(log.Fields{
@@ -208,19 +953,86 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 		}
 	}
 
+	if s.config.BannerDelay > 0 {
+		if w, ok := baseProtocol(proto).(inputWaiter); ok {
+			state.PipelinedBefore = w.WaitForInput(s.config.BannerDelay)
+		} else {
+			time.Sleep(s.config.BannerDelay)
+		}
+
+		if state.PipelinedBefore {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+				"Ip":        state.Ip.String(),
+			}).Warn("Client sent data before the greeting")
+
+			if s.config.RejectPipelinedBefore {
+				proto.Send(smtp.Answer{
+					Status:  smtp.MailboxUnavailable,
+					Message: "Protocol violation: data sent before greeting",
+				})
+				proto.Close()
+				return
+			}
+		}
+	}
+
+	// Connections start without TLS, so a client that just failed to start
+	// TLS is now trying without it.
+	if s.config.WarnOnSTARTTLSDowngrade && s.tlsClients.recent(state.Ip.String()) {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+		}).Warn("Client recently failed a STARTTLS handshake and reconnected without TLS, possible downgrade attack")
+	}
+
 	// Start with welcome message
+	banner := s.config.Hostname + " Service Ready"
+	if s.config.MaskServerInfo {
+		banner = s.config.Hostname + " ESMTP"
+	}
+	var tokenExpires time.Time
+	if s.resumable != nil {
+		tokenExpires = time.Now().Add(s.resumable.ttl)
+		banner += " (session-token=" + s.resumable.token(state.SessionId, tokenExpires) + ")"
+	}
+	if s.config.RequireClientToken != "" {
+		banner += " (session-id=" + state.SessionId.String() + ")"
+	}
 	proto.Send(smtp.Answer{
 		Status:  smtp.Ready,
-		Message: s.config.Hostname + " Service Ready",
+		Message: banner,
 	})
 
+	bdat := bdatTransfer{}
+	// Number of rejected RCPT commands in this session, RSET doesn't clear it.
+	rcptErrors := 0
+	// Bytes of the accepted MAIL and RCPT addresses in this session.
+	envelopeSize := 0
+	// A recipient of this transaction expanded to no recipients.
+	emptyExpansion := false
+	// The commands of this session, for the SequenceAnalyzer.
+	history := []smtp.Cmd{}
+
 	var c *smtp.Cmd
 	var err error
 
 	quit := false
 	cmdC := make(chan bool)
 
+	// flush sends the buffered answers, before we wait for the client.
+	flush := func() {
+		if err := flushProtocol(proto); err != nil {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+				"Ip":        state.Ip.String(),
+			}).Warnf("Could not flush answers: %v", err)
+		}
+	}
+
 	nextCmd := func() bool {
+		flush()
+		s.setCommandDeadline(proto, state)
 		go func() {
 			for {
 				c, err = proto.GetCmd()
@@ -232,6 +1044,9 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 							Message: "Line too long.",
 						})
 					} else {
+						if isTimeout(err) {
+							proto.Send(timeoutAnswer)
+						}
 						// Not a line too long error. What to do?
 						cmdC <- true
 						return
@@ -250,9 +1065,24 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 					Status:  smtp.ShuttingDown,
 					Message: "Server is going down.",
 				})
+				reason = EndServerShutdown
 				return true
 			}
+		case <-ctx.Done():
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+				"Ip":        state.Ip.String(),
+			}).Info("Session killed")
+			proto.Send(smtp.Answer{
+				Status:  smtp.ShuttingDown,
+				Message: "Session terminated by administrator",
+			})
+			return true
 		case q := <-cmdC:
+			if q {
+				disconnectErr = err
+				reason = endReason(err)
+			}
 			return q
 
 		}
@@ -260,41 +1090,158 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 		return false
 	}
 
+	// saveResumable makes the session resumable with the token of the greeting,
+	// after HELO or EHLO.
+	saveResumable := func() {
+		if s.resumable == nil {
+			return
+		}
+		s.resumable.save(state.SessionId, resumableSession{
+			ip:         state.Ip.String(),
+			hostname:   state.Hostname,
+			fcrdnsOk:   state.FCrDNSOk,
+			clientName: state.ClientName,
+			expires:    tokenExpires,
+		})
+	}
+
+	// envelopeFull tells if accepting the address would exceed MaxEnvelopeSize,
+	// the answer is sent then.
+	envelopeFull := func(address *smtp.MailAddress) bool {
+		if s.config.MaxEnvelopeSize <= 0 || envelopeSize+len(address.GetAddress()) <= s.config.MaxEnvelopeSize {
+			return false
+		}
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+			"Ip":        state.Ip.String(),
+		}).Warnf("Envelope of more than %d bytes", s.config.MaxEnvelopeSize)
+		proto.Send(smtp.Answer{
+			Status:       smtp.InsufficientStorage,
+			EnhancedCode: "4.3.1",
+			Message:      "Insufficient system storage",
+		})
+		return true
+	}
+
+	// rejectRcpt sends the answer for a rejected recipient. Clients that keep
+	// sending bad recipients are probably guessing addresses, so they are
+	// disconnected when they go over the limit.
+	rejectRcpt := func(answer smtp.Answer) {
+		if s.config.MaxRcptErrors > 0 && rcptErrors >= s.config.MaxRcptErrors {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+				"Ip":        state.Ip.String(),
+			}).Warn("Too many invalid recipients, closing connection")
+			proto.Send(smtp.Answer{
+				Status:       smtp.ShuttingDown,
+				EnhancedCode: "4.7.0",
+				Message:      "Too many invalid recipients",
+			})
+			quit = true
+			return
+		}
+		rcptErrors++
+		proto.Send(answer)
+	}
+
 	quit = nextCmd()
 
 	for quit == false {
 
 		//log.Printf("Received cmd: %#v", *c)
 
+		if s.config.SequenceAnalyzer != nil {
+			history = appendHistory(history, *c)
+			if s.rejectSuspiciousSequence(proto, state, history) {
+				quit = nextCmd()
+				continue
+			}
+		}
+
 		switch cmd := (*c).(type) {
 		case smtp.HeloCmd:
+			if len(cmd.Domain) > s.maxHeloLen() {
+				proto.Send(smtp.Answer{
+					Status:  smtp.SyntaxErrorParam,
+					Message: "HELO hostname too long",
+				})
+				break
+			}
+
+			if !s.checkFCrDNS(state) {
+				proto.Send(smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: "5.7.25",
+					Message:      "Reverse DNS of your ip does not match",
+				})
+				break
+			}
+
 			state.Hostname = cmd.Domain
+			state.Proto = "SMTP"
+			saveResumable()
+			s.sessions.setHostname(id, cmd.Domain)
+			s.notify(func(l EventListener) { l.OnEhlo(id, cmd.Domain) })
 			proto.Send(smtp.Answer{
 				Status:  smtp.Ok,
 				Message: s.config.Hostname,
 			})
 
 		case smtp.EhloCmd:
-			state.Reset()
-			state.Hostname = cmd.Domain
+			if len(cmd.Domain) > s.maxHeloLen() {
+				proto.Send(smtp.Answer{
+					Status:  smtp.SyntaxErrorParam,
+					Message: "EHLO hostname too long",
+				})
+				break
+			}
 
-			messages := []string{s.config.Hostname, "8BITMIME"}
-			if s.hasTls() && !state.Secure {
-				messages = append(messages, "STARTTLS")
+			hostname, resumed := cmd.Domain, false
+			if cmd.SessionToken != "" && s.resumable != nil {
+				session, err := s.resumable.resume(cmd.SessionToken, state.Ip.String())
+				if err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+						"Ip":        state.Ip.String(),
+					}).Debugf("Could not resume session: %v", err)
+				} else {
+					hostname, resumed = session.hostname, true
+					state.FCrDNSOk, state.ClientName = session.fcrdnsOk, session.clientName
+				}
 			}
 
-			messages = append(messages, "OK")
+			if !resumed && !s.checkFCrDNS(state) {
+				proto.Send(smtp.Answer{
+					Status:       smtp.MailboxUnavailable,
+					EnhancedCode: "5.7.25",
+					Message:      "Reverse DNS of your ip does not match",
+				})
+				break
+			}
 
-			proto.Send(smtp.MultiAnswer{
-				Status:   smtp.Ok,
-				Messages: messages,
-			})
+			state.Reset()
+			state.Hostname = hostname
+			state.Proto = "ESMTP"
+			saveResumable()
+			s.sessions.setHostname(id, hostname)
+			s.notify(func(l EventListener) { l.OnEhlo(id, hostname) })
+
+			ehlo := EhloResponse{
+				Config:         s.config,
+				State:          state,
+				TLS:            s.hasTls(),
+				XForward:       s.canXForward(proto),
+				MaxMessageSize: rc.domainPolicy("*").MaxMessageSize,
+			}
+			proto.Send(ehlo.Answer())
 
 		case smtp.QuitCmd:
+			s.notify(func(l EventListener) { l.OnQuit(id) })
 			proto.Send(smtp.Answer{
 				Status:  smtp.Closing,
 				Message: "Bye!",
 			})
+			reason = EndQuit
 			quit = true
 
 		case smtp.MailCmd:
@@ -306,14 +1253,97 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				break
 			}
 
+			if cmd.RequireTLS && !s.config.EnableRequireTLS {
+				proto.Send(smtp.Answer{
+					Status:       smtp.SyntaxErrorParam,
+					EnhancedCode: "5.5.4",
+					Message:      "REQUIRETLS not supported",
+				})
+				break
+			}
+			if cmd.RequireTLS && !state.Secure {
+				proto.Send(smtp.Answer{
+					Status:       smtp.EncryptionRequired,
+					EnhancedCode: "5.7.10",
+					Message:      "REQUIRETLS needs a TLS session",
+				})
+				break
+			}
+
+			if envelopeFull(cmd.From) {
+				break
+			}
+
+			policy := rc.domainPolicy(cmd.From.GetDomain())
+			if policy.RequireAuth && !state.Authenticated {
+				proto.Send(smtp.Answer{
+					Status:  smtp.AuthRequired,
+					Message: "Authentication required",
+				})
+				break
+			}
+
+			if rc.senderRateLimit != nil && state.Authenticated && s.senderRates.exceeded(state.AuthUser, *rc.senderRateLimit) {
+				proto.Send(smtp.Answer{
+					Status:       smtp.InsufficientStorage,
+					EnhancedCode: "4.7.0",
+					Message:      "Too many messages, try again later",
+				})
+				break
+			}
+
+			if domain := cmd.From.GetDomain(); s.senderDomainResolver != nil && domain != "" {
+				exists, err := s.senderDomainExists(domain)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+					}).Warnf("Could not verify sender domain %s: %v", domain, err)
+					proto.Send(smtp.Answer{
+						Status:       smtp.LocalError,
+						EnhancedCode: "4.4.3",
+						Message:      "Could not verify sender domain, try again later",
+					})
+					break
+				}
+				if !exists {
+					proto.Send(smtp.Answer{
+						Status:       smtp.MailboxUnavailable,
+						EnhancedCode: "5.1.8",
+						Message:      "Sender domain does not exist",
+					})
+					break
+				}
+			}
+
 			state.From = cmd.From
+			if s.config.SenderRewriter != nil {
+				from, err := s.config.SenderRewriter(*cmd.From)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+					}).Errorf("Could not rewrite sender %s: %v", cmd.From.GetAddress(), err)
+					state.From = nil
+					proto.Send(smtp.Answer{
+						Status:  smtp.LocalError,
+						Message: "Could not process sender, try again later",
+					})
+					break
+				}
+				state.From = &from
+				state.OriginalFrom = cmd.From
+			}
+			envelopeSize += len(cmd.From.GetAddress())
+			emptyExpansion = false
+			state.RateLimitGroup = policy.RateLimitGroup
 			state.EightBitMIME = cmd.EightBitMIME
+			state.RequireTLS = cmd.RequireTLS
 			message := "Sender"
 			if state.EightBitMIME {
 				message += " and 8BITMIME"
 			}
 			message += " ok"
 
+			s.notify(func(l EventListener) { l.OnMail(id, *state.From) })
 			proto.Send(smtp.Answer{
 				Status:  smtp.Ok,
 				Message: message,
@@ -321,21 +1351,147 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 
 		case smtp.RcptCmd:
 			if ok, reason := state.CanReceiveRcpt(); !ok {
-				proto.Send(smtp.Answer{
+				rejectRcpt(smtp.Answer{
 					Status:  smtp.BadSequence,
 					Message: reason,
 				})
 				break
 			}
 
-			state.To = append(state.To, cmd.To)
+			if envelopeFull(cmd.To) {
+				break
+			}
+
+			if !rc.canRelay(state, cmd.To) {
+				rejectRcpt(smtp.Answer{
+					Status:       smtp.NoValidRecipients,
+					EnhancedCode: "5.7.1",
+					Message:      "Relay access denied",
+				})
+				break
+			}
+
+			// The envelope size counts the address the client sent.
+			rcptSize := len(cmd.To.GetAddress())
+			if s.config.RecipientRewriter != nil {
+				to, err := s.config.RecipientRewriter.Rewrite(*cmd.To)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+					}).Errorf("Could not rewrite recipient %s: %v", cmd.To.GetAddress(), err)
+					proto.Send(smtp.Answer{
+						Status:  smtp.LocalError,
+						Message: "Could not process recipient, try again later",
+					})
+					break
+				}
+				cmd.To = &to
+			}
+
+			if s.config.RcptValidator != nil {
+				if err := s.config.RcptValidator.ValidateRcpt(*cmd.To); err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+					}).Debugf("Recipient %s rejected: %v", cmd.To.GetAddress(), err)
+					rejectRcpt(smtp.Answer{
+						Status:  smtp.MailboxUnavailable,
+						Message: "Mailbox unavailable",
+					})
+					break
+				}
+			}
+
+			recipients := []*smtp.MailAddress{cmd.To}
+			isList := false
+			if s.config.ListExpander != nil {
+				members, expanded, err := s.config.ListExpander.Expand(*cmd.To)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+					}).Errorf("Could not expand %s: %v", cmd.To.GetAddress(), err)
+					proto.Send(smtp.Answer{
+						Status:  smtp.LocalError,
+						Message: "Could not process recipient, try again later",
+					})
+					break
+				}
+				if expanded {
+					isList = true
+					emptyExpansion = emptyExpansion || len(members) == 0
+					recipients = make([]*smtp.MailAddress, len(members))
+					for i := range members {
+						recipients[i] = &members[i]
+					}
+				}
+			}
+
+			if !isList && s.config.LocalMailboxes != nil {
+				exists, err := s.config.LocalMailboxes.Exists(*cmd.To)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"SessionId": state.SessionId.String(),
+					}).Errorf("Could not check mailbox %s: %v", cmd.To.GetAddress(), err)
+					proto.Send(smtp.Answer{
+						Status:  smtp.LocalError,
+						Message: "Could not check recipient, try again later",
+					})
+					break
+				}
+				if !exists {
+					rejectRcpt(smtp.Answer{
+						Status:  smtp.MailboxUnavailable,
+						Message: "User unknown",
+					})
+					break
+				}
+			}
+
+			if s.config.DeduplicateRecipients {
+				recipients = withoutDuplicates(state.To, recipients)
+			}
+
+			// Don't append the recipients to state.To for this, that copies all
+			// recipients for every RCPT.
+			_, maxRecipients := rc.recipientLimits(state.To)
+			if _, max := rc.recipientLimits(recipients); max > 0 && (maxRecipients <= 0 || max < maxRecipients) {
+				maxRecipients = max
+			}
+			if maxRecipients > 0 && len(state.To)+len(recipients) > maxRecipients {
+				proto.Send(smtp.Answer{
+					Status:  smtp.InsufficientStorage,
+					Message: "Too many recipients",
+				})
+				break
+			}
+			if max := s.config.MaxRecipientsPerSenderDomain; max > 0 && state.From.GetDomain() != "" {
+				domain := state.From.GetDomain()
+				if added := countDomain(recipients, domain); added > 0 && countDomain(state.To, domain)+added > max {
+					proto.Send(smtp.Answer{
+						Status:  smtp.InsufficientStorage,
+						Message: "Too many recipients in the sender domain",
+					})
+					break
+				}
+			}
+
+			state.To = append(state.To, recipients...)
+			envelopeSize += rcptSize
 
+			s.notify(func(l EventListener) { l.OnRcpt(id, *cmd.To) })
 			proto.Send(smtp.Answer{
 				Status:  smtp.Ok,
 				Message: "OK",
 			})
 
 		case smtp.DataCmd:
+			if bdat.active {
+				proto.Send(smtp.Answer{
+					Status:  smtp.BadSequence,
+					Message: "DATA not allowed during BDAT transfer",
+				})
+				break
+			}
+
 			if ok, reason := state.CanReceiveData(); !ok {
 				/*
 					RFC 5321 3.3
@@ -347,10 +1503,7 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 					client MUST NOT send the message data; more generally, message data
 					MUST NOT be sent unless a 354 reply is received.
 				*/
-				proto.Send(smtp.Answer{
-					Status:  smtp.BadSequence,
-					Message: reason,
-				})
+				proto.Send(s.cannotReceiveDataAnswer(state, reason, emptyExpansion))
 				break
 			}
 
@@ -363,11 +1516,57 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				Status:  smtp.StartData,
 				Message: message,
 			})
+			flush()
+			state.DataStart = time.Now()
+
+			cmd.R.Limiter = s.config.GlobalBandwidthLimiter
+			cmd.R.CRLF = s.config.AcceptBareLF
+
+			// Number of lines that were too long in this DATA.
+			dataErrors := 0
 
 		tryAgain:
-			tmpData, err := ioutil.ReadAll(&cmd.R)
+			tmpData, stopped, err := s.readData(s.dataReader(proto, &cmd.R))
+			if stopped {
+				proto.Send(smtp.Answer{
+					Status:  smtp.ShuttingDown,
+					Message: "Server is going down.",
+				})
+				reason = EndServerShutdown
+				quit = true
+				break
+			}
 			state.Data = append(state.Data, tmpData...)
 			if err == smtp.ErrLtl {
+				dataErrors++
+				if s.config.MaxDataErrors > 0 && dataErrors > s.config.MaxDataErrors {
+					// Discard the rest of the data, so it isn't read as commands.
+					stopped, err = s.discardLongLines(func() io.Reader {
+						return s.dataReader(proto, &cmd.R)
+					})
+					if stopped {
+						proto.Send(smtp.Answer{
+							Status:  smtp.ShuttingDown,
+							Message: "Server is going down.",
+						})
+						reason = EndServerShutdown
+						quit = true
+						break
+					}
+					if isTimeout(err) {
+						proto.Send(dataTimeoutAnswer)
+						state.Reset()
+						reason = EndTimeout
+						quit = true
+						break
+					}
+					proto.Send(smtp.Answer{
+						Status:  smtp.AbortMail,
+						Message: "Too many data errors",
+					})
+					state.Reset()
+					break
+				}
 				proto.Send(smtp.Answer{
 					// SyntaxError or 552 error? or something else?
 					Status:  smtp.SyntaxError,
@@ -375,7 +1574,7 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				})
 				goto tryAgain
 			} else if err == smtp.ErrIncomplete {
-				// I think this can only happen on a socket if it gets closed before receiving the full data.
+				// The connection was closed before the end of the data.
 				proto.Send(smtp.Answer{
 					Status:  smtp.SyntaxError,
 					Message: "Could not parse mail data",
@@ -383,6 +1582,12 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				state.Reset()
 				break
 
+			} else if isTimeout(err) {
+				proto.Send(dataTimeoutAnswer)
+				state.Reset()
+				reason = EndTimeout
+				quit = true
+				break
 			} else if err != nil {
 				//panic(err)
 				log.WithFields(log.Fields{
@@ -390,18 +1595,17 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				}).Panic(err)
 			}
 
-			s.MailHandler.Handle(state)
-
-			proto.Send(smtp.Answer{
-				Status:  smtp.Ok,
-				Message: "Mail delivered",
-			})
+			s.deliver(proto, state, rc)
 
-			// Reset state after mail was handled so we can start from a clean slate.
-			state.Reset()
+		case smtp.BdatCmd:
+			var bdatReason SessionEndReason
+			if quit, bdatReason = s.handleBdat(proto, state, cmd, &bdat, rc, emptyExpansion); quit {
+				reason = bdatReason
+			}
 
 		case smtp.RsetCmd:
 			state.Reset()
+			bdat.reset()
 			proto.Send(smtp.Answer{
 				Status:  smtp.Ok,
 				Message: "OK",
@@ -435,6 +1639,23 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 					"Ip":        state.Ip.String(),
 					"SessionId": state.SessionId.String(),
 				}).Warningf("Could not enable TLS: %v", err)
+				if s.config.WarnOnSTARTTLSDowngrade {
+					s.tlsClients.add(state.Ip.String())
+				}
+				break
+			}
+
+			// The TlsConfig can be set without MinVersion.
+			if state.TLSState != nil && state.TLSState.Version < s.config.TlsMinVersion {
+				log.WithFields(log.Fields{
+					"Ip":        state.Ip.String(),
+					"SessionId": state.SessionId.String(),
+				}).Warningf("Client negotiated TLS version %x, below the minimum", state.TLSState.Version)
+				proto.Send(smtp.Answer{
+					Status:  smtp.EncryptionTooWeak,
+					Message: "Encryption required",
+				})
+				quit = true
 				break
 			}
 
@@ -442,8 +1663,13 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				"Ip":        state.Ip.String(),
 				"SessionId": state.SessionId.String(),
 			}).Debug("TLS enabled")
+			if state.TLSState != nil {
+				s.LogTLSDetails(state, state.TLSState)
+			}
 			state.Reset()
 			state.Secure = true
+			state.Authenticated = false
+			state.AuthUser = ""
 
 		case smtp.NoopCmd:
 			proto.Send(smtp.Answer{
@@ -451,7 +1677,63 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 				Message: "OK",
 			})
 
-		case smtp.VrfyCmd, smtp.ExpnCmd, smtp.SendCmd, smtp.SomlCmd, smtp.SamlCmd:
+		case smtp.PingCmd:
+			// Use the ip of the connection, state.Ip could be forwarded.
+			if !s.config.EnableInternalHealthPing || !ipInNets(proto.GetIP(), s.config.InternalNetworks) {
+				proto.Send(smtp.Answer{
+					Status:  smtp.SyntaxError,
+					Message: "Command not recognized",
+				})
+				break
+			}
+			proto.Send(smtp.Answer{
+				Status:  smtp.Ok,
+				Message: "PONG",
+			})
+
+		case smtp.AuthCmd:
+			s.handleAuth(proto, state, cmd)
+
+		case smtp.XForwardCmd:
+			s.handleXForward(proto, state, cmd)
+
+		case smtp.AtrnCmd:
+			if s.handleAtrn(proto, state, cmd) {
+				reason = EndReversed
+				quit = true
+			}
+
+		case smtp.HelpCmd:
+			if cmd.Topic == "" {
+				proto.Send(smtp.MultiAnswer{
+					Status: smtp.Help,
+					Messages: []string{
+						"Supported commands:",
+						strings.Join(s.helpTopics(), " "),
+						"Use HELP <command> for more information",
+					},
+				})
+				break
+			}
+
+			text, ok := s.helpText(cmd.Topic)
+			if !ok {
+				proto.Send(smtp.Answer{
+					Status:  smtp.ParamNotImplemented,
+					Message: "No help for " + cmd.Topic,
+				})
+				break
+			}
+
+			proto.Send(smtp.Answer{
+				Status:  smtp.Help,
+				Message: text,
+			})
+
+		case smtp.ExpnCmd:
+			s.handleExpn(proto, state, cmd)
+
+		case smtp.VrfyCmd, smtp.SendCmd, smtp.SomlCmd, smtp.SamlCmd:
 			proto.Send(smtp.Answer{
 				Status:  smtp.NotImplemented,
 				Message: "Command not implemented",
@@ -473,11 +1755,17 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 			})
 
 		default:
-			// TODO: We get here if the switch does not handle all Cmd's defined
-			// in protocol.go. That means we forgot to add it here. This should ideally
-			// be checked at compile time. But if we get here anyway we probably shouldn't
-			// crash...
-			log.Fatalf("Command not implemented: %#v", cmd)
+			// We get here if the switch does not handle all Cmd's defined
+			// in protocol.go. That means we forgot to add it here, but it's
+			// no reason to crash the server.
+			log.WithFields(log.Fields{
+				"Ip":        state.Ip.String(),
+				"SessionId": state.SessionId.String(),
+			}).Errorf("Command not implemented: %#v", cmd)
+			proto.Send(smtp.Answer{
+				Status:  smtp.NotImplemented,
+				Message: "Command not implemented",
+			})
 		}
 
 		if quit {
@@ -492,4 +1780,5 @@ func (s *Mta) HandleClient(proto smtp.Protocol) {
 		"SessionId": state.SessionId.String(),
 		"Ip":        state.Ip.String(),
 	}).Debug("Closed connection")
+	return
 }
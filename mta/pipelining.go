@@ -0,0 +1,159 @@
+package mta
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// flusher is implemented by protocols that buffer answers, the session
+// flushes them before it waits for the client. Protocols that don't
+// implement it, like smtp.MtaProtocol, send every answer right away.
+type flusher interface {
+	Flush() error
+}
+
+// pipelineEnforcer checks that the server sends (and flushes) its answers at
+// the points where RFC 2920 3.2 says a client waits for them: after EHLO,
+// after the 354 for DATA and after the answer to the end of the data.
+// Reading a command before that is a bug: the client and server would wait
+// on each other.
+//
+// The session only uses it for protocols that buffer answers, or with
+// Config.StrictPipelining.
+type pipelineEnforcer struct {
+	smtp.Protocol
+	strict bool
+	// Send can be called while GetCmd waits for a command, e.g. when the
+	// session is killed.
+	mutex sync.Mutex
+	// The answer the client is waiting for, empty if none.
+	pending string
+	// Whether the pending answer was sent, but not flushed.
+	sent bool
+}
+
+func newPipelineEnforcer(proto smtp.Protocol, strict bool) *pipelineEnforcer {
+	return &pipelineEnforcer{Protocol: proto, strict: strict}
+}
+
+// baseProtocol returns the protocol a pipelineEnforcer or a traceRecorder
+// wraps, for the optional interfaces of the protocol.
+func baseProtocol(proto smtp.Protocol) smtp.Protocol {
+	for {
+		switch p := proto.(type) {
+		case *pipelineEnforcer:
+			proto = p.Protocol
+		case *traceRecorder:
+			proto = p.Protocol
+		default:
+			return proto
+		}
+	}
+}
+
+// flushProtocol flushes the first protocol that buffers answers, going
+// through the wrappers like baseProtocol.
+func flushProtocol(proto smtp.Protocol) error {
+	for {
+		if f, ok := proto.(flusher); ok {
+			return f.Flush()
+		}
+		switch p := proto.(type) {
+		case *pipelineEnforcer:
+			proto = p.Protocol
+		case *traceRecorder:
+			proto = p.Protocol
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *pipelineEnforcer) GetCmd() (*smtp.Cmd, error) {
+	p.mutex.Lock()
+	pending := p.pending
+	p.pending = ""
+	p.mutex.Unlock()
+	if pending != "" {
+		p.violation(fmt.Sprintf("command read before the %s was flushed", pending))
+	}
+
+	cmd, err := p.Protocol.GetCmd()
+	if err != nil {
+		return cmd, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch (*cmd).(type) {
+	case smtp.EhloCmd, smtp.HeloCmd:
+		p.expect("EHLO answer")
+	case smtp.DataCmd:
+		p.expect("DATA answer")
+	}
+	return cmd, nil
+}
+
+func (p *pipelineEnforcer) Send(cmd smtp.Cmd) {
+	p.Protocol.Send(cmd)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pending == "" {
+		return
+	}
+
+	// After the 354 the data is read, and the client waits for the answer to it.
+	if answer, ok := cmd.(smtp.Answer); ok && p.pending == "DATA answer" && answer.Status == smtp.StartData {
+		p.expect("end of data answer")
+		return
+	}
+	p.answered()
+}
+
+func (p *pipelineEnforcer) Flush() error {
+	var err error
+	if f, ok := p.Protocol.(flusher); ok {
+		err = f.Flush()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.sent {
+		p.pending = ""
+		p.sent = false
+	}
+	return err
+}
+
+// expect starts waiting for an answer that must be flushed before the next command.
+func (p *pipelineEnforcer) expect(answer string) {
+	p.pending = answer
+	p.sent = false
+}
+
+// answered marks the pending answer as sent. It is flushed right away if the
+// protocol doesn't buffer.
+func (p *pipelineEnforcer) answered() {
+	if _, ok := p.Protocol.(flusher); ok {
+		// Only Flush counts.
+		p.sent = true
+		return
+	}
+	p.pending = ""
+}
+
+// violation reports a pipelining bug of the server.
+func (p *pipelineEnforcer) violation(message string) {
+	if p.strict {
+		panic("pipelining violation: " + message)
+	}
+	state := p.GetState()
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Errorf("Pipelining violation: %s", message)
+}
@@ -0,0 +1,102 @@
+package mta
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// DomainPolicy contains the restrictions for a domain. RequireAuth and
+// RateLimitGroup apply to mail from the domain, the limits to mail for the domain.
+type DomainPolicy struct {
+	// RequireAuth only allows authenticated clients to send mail from the domain.
+	RequireAuth bool
+	// MaxMessageSize is the maximum size of the mail data in bytes, 0 for no limit.
+	MaxMessageSize int64
+	// MaxRecipients is the maximum number of recipients per mail, 0 for no limit.
+	MaxRecipients int
+	// RateLimitGroup is passed to the handler in State.RateLimitGroup.
+	RateLimitGroup string
+}
+
+// domainPolicy looks up the policy for a domain.
+// If there is no policy for the domain, the "*" policy is used.
+func (rc *runtimeConfig) domainPolicy(domain string) DomainPolicy {
+	if policy, ok := rc.domainPolicies[strings.ToLower(domain)]; ok {
+		return policy
+	}
+	return rc.domainPolicies["*"]
+}
+
+// ListExpander expands mailing list addresses.
+type ListExpander interface {
+	// Expand returns the members of the list if to is a mailing list.
+	// expanded is false if to isn't a list.
+	Expand(to smtp.MailAddress) (members []smtp.MailAddress, expanded bool, err error)
+}
+
+// recipientLimits returns the lowest MaxMessageSize and MaxRecipients of the
+// policies of the recipient domains, 0 if there is no limit.
+// Config.MaxRecipients is included in maxRecipients.
+func (rc *runtimeConfig) recipientLimits(to []*smtp.MailAddress) (maxMessageSize int64, maxRecipients int) {
+	maxRecipients = rc.maxRecipients
+	for _, rcpt := range to {
+		policy := rc.domainPolicy(rcpt.GetDomain())
+		if policy.MaxMessageSize > 0 && (maxMessageSize <= 0 || policy.MaxMessageSize < maxMessageSize) {
+			maxMessageSize = policy.MaxMessageSize
+		}
+		if policy.MaxRecipients > 0 && (maxRecipients <= 0 || policy.MaxRecipients < maxRecipients) {
+			maxRecipients = policy.MaxRecipients
+		}
+	}
+	return maxMessageSize, maxRecipients
+}
+
+// RcptValidator checks if we accept mail for a recipient,
+// e.g. by looking up if the mailbox exists.
+type RcptValidator interface {
+	// ValidateRcpt returns an error if the recipient should be rejected.
+	ValidateRcpt(to smtp.MailAddress) error
+}
+
+// canRelay checks if mail for the recipient can be accepted.
+// Mail for the RelayDomains is always accepted, other domains are only accepted
+// for authenticated clients if AllowRelayForAuthenticated is set.
+// If no RelayDomains are configured every recipient is accepted.
+func (rc *runtimeConfig) canRelay(state *smtp.State, to *smtp.MailAddress) bool {
+	if len(rc.relayDomains) == 0 {
+		return true
+	}
+
+	domain := to.GetDomain()
+	for _, relayDomain := range rc.relayDomains {
+		if strings.EqualFold(domain, relayDomain) {
+			return true
+		}
+	}
+
+	return state.Authenticated && rc.allowRelayForAuthenticated
+}
+
+// ipInNets checks if ip is part of one of the networks.
+// ipAllowed checks the ip against the DeniedCIDRs and AllowedCIDRs.
+// Denied CIDRs win from allowed ones.
+func (s *Mta) ipAllowed(ip net.IP) bool {
+	if ipInNets(ip, s.config.DeniedCIDRs) {
+		return false
+	}
+	return len(s.config.AllowedCIDRs) == 0 || ipInNets(ip, s.config.AllowedCIDRs)
+}
+
+func ipInNets(ip net.IP, nets []net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package mta
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// ContentFilter inspects the mails relayed by a TransparentProxy.
+type ContentFilter interface {
+	// FilterContent is called with the mail in state.Data, before it is sent
+	// to the backend. It may change state.Data. When it returns an error the
+	// mail is rejected, see HandlerErrorAnswer.
+	FilterContent(state *smtp.State) error
+}
+
+// ContentFilterFunc is a wrapper to allow normal functions to be used as a ContentFilter.
+type ContentFilterFunc func(*smtp.State) error
+
+func (f ContentFilterFunc) FilterContent(state *smtp.State) error {
+	return f(state)
+}
+
+var _ ContentFilter = ContentFilterFunc(nil)
+
+// proxiedExtensions are the EHLO keywords of the backend that are passed on
+// to the client. The others need commands or parameters the proxy can't relay,
+// like STARTTLS, AUTH and CHUNKING.
+var proxiedExtensions = map[string]bool{
+	"8BITMIME":            true,
+	"ENHANCEDSTATUSCODES": true,
+	"PIPELINING":          true,
+	"SIZE":                true,
+}
+
+// ErrBackendClosed is returned by TransparentProxy.Run when the backend
+// closed the connection.
+var ErrBackendClosed = errors.New("backend closed the connection")
+
+// TransparentProxy relays an SMTP session between a client and a backend MTA,
+// e.g. to filter content in front of it. Commands are passed to the backend
+// and its replies to the client, so the client talks to the backend. Only the
+// mail data is intercepted: it is read from the client, passed to the
+// ContentFilter, and then sent to the backend.
+//
+// Commands are sent to the backend as they were parsed, see smtp.CommandLine.
+// Extensions that can't be relayed are removed from the EHLO reply. Commands
+// that would make the backend trust the proxy, like AUTH and XFORWARD, are
+// answered with a 502.
+type TransparentProxy struct {
+	client  smtp.Protocol
+	backend smtp.Protocol
+	filter  ContentFilter
+}
+
+// NewTransparentProxy creates a proxy between client, usually an
+// smtp.MtaProtocol, and backend, usually an smtp.ClientProtocol. The filter
+// can be nil.
+func NewTransparentProxy(client, backend smtp.Protocol, filter ContentFilter) *TransparentProxy {
+	return &TransparentProxy{
+		client:  client,
+		backend: backend,
+		filter:  filter,
+	}
+}
+
+// Run relays the session until it ends, and closes both connections.
+// It returns nil if the session was ended with QUIT.
+func (p *TransparentProxy) Run() error {
+	defer p.client.Close()
+	defer p.backend.Close()
+
+	state := p.client.GetState()
+	state.Reset()
+	state.SessionId = generateSessionId()
+	state.Ip = p.client.GetIP()
+
+	greeting, err := p.backendReply()
+	if err != nil {
+		return err
+	}
+	p.client.Send(greeting)
+	if status(greeting) != smtp.Ready {
+		return fmt.Errorf("backend did not greet: %s", greeting)
+	}
+
+	for {
+		c, err := p.client.GetCmd()
+		if err == smtp.ErrLtl {
+			p.client.Send(smtp.Answer{
+				Status:  smtp.SyntaxError,
+				Message: "Line too long.",
+			})
+			continue
+		}
+		if err != nil {
+			p.backend.Send(smtp.QuitCmd{})
+			return err
+		}
+
+		var reply smtp.Cmd
+		switch cmd := (*c).(type) {
+		case smtp.DataCmd:
+			reply, err = p.relayData(state, cmd)
+
+		case smtp.BdatCmd:
+			// CHUNKING is not advertised, but the chunk still has to be read.
+			ioutil.ReadAll(cmd.R)
+			reply = smtp.Answer{
+				Status:  smtp.NotImplemented,
+				Message: "Command not implemented",
+			}
+
+		case smtp.StartTlsCmd, smtp.AuthCmd, smtp.XForwardCmd, smtp.AtrnCmd, smtp.SendCmd, smtp.SomlCmd, smtp.SamlCmd:
+			reply = smtp.Answer{
+				Status:  smtp.NotImplemented,
+				Message: "Command not implemented",
+			}
+
+		case smtp.InvalidCmd:
+			reply = smtp.Answer{
+				Status:  smtp.SyntaxErrorParam,
+				Message: cmd.Info,
+			}
+
+		case smtp.UnknownCmd:
+			reply = smtp.Answer{
+				Status:  smtp.SyntaxError,
+				Message: "Command not recognized",
+			}
+
+		default:
+			p.backend.Send(cmd)
+			reply, err = p.backendReply()
+			if err == nil {
+				reply = p.track(state, cmd, reply)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		p.client.Send(reply)
+		if _, ok := (*c).(smtp.QuitCmd); ok {
+			return nil
+		}
+		if status(reply) == smtp.ShuttingDown {
+			return ErrBackendClosed
+		}
+	}
+}
+
+// backendReply reads a reply of the backend. If that fails, the client gets
+// a 421 and the error is returned.
+func (p *TransparentProxy) backendReply() (smtp.Cmd, error) {
+	reply, err := p.backend.GetCmd()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": p.client.GetState().SessionId.String(),
+		}).Warnf("Could not read reply of backend: %v", err)
+		p.client.Send(smtp.Answer{
+			Status:  smtp.ShuttingDown,
+			Message: "Backend not available, closing connection",
+		})
+		return nil, err
+	}
+	return *reply, nil
+}
+
+// track updates the state of the transaction after the backend replied to
+// cmd, and returns the reply that should be sent to the client.
+func (p *TransparentProxy) track(state *smtp.State, cmd smtp.Cmd, reply smtp.Cmd) smtp.Cmd {
+	if status(reply)/100 != 2 {
+		return reply
+	}
+
+	switch cmd := cmd.(type) {
+	case smtp.HeloCmd:
+		state.Reset()
+		state.Hostname = cmd.Domain
+	case smtp.EhloCmd:
+		state.Reset()
+		state.Hostname = cmd.Domain
+		if multi, ok := reply.(smtp.MultiAnswer); ok {
+			reply = filterProxiedExtensions(multi)
+		}
+	case smtp.MailCmd:
+		state.From = cmd.From
+		state.EightBitMIME = cmd.EightBitMIME
+	case smtp.RcptCmd:
+		state.To = append(state.To, cmd.To)
+	case smtp.RsetCmd:
+		state.Reset()
+	}
+	return reply
+}
+
+// filterProxiedExtensions removes the extensions that are not proxied from
+// an EHLO reply.
+func filterProxiedExtensions(reply smtp.MultiAnswer) smtp.MultiAnswer {
+	messages := reply.Messages[:1]
+	for _, message := range reply.Messages[1:] {
+		keyword := strings.ToUpper(strings.SplitN(message, " ", 2)[0])
+		if proxiedExtensions[keyword] {
+			messages = append(messages, message)
+		}
+	}
+	reply.Messages = messages
+	return reply
+}
+
+// relayData reads the mail data from the client, filters it and sends it to
+// the backend. It returns the reply for the client.
+func (p *TransparentProxy) relayData(state *smtp.State, cmd smtp.DataCmd) (smtp.Cmd, error) {
+	if ok, reason := state.CanReceiveData(); !ok {
+		return smtp.Answer{
+			Status:  smtp.BadSequence,
+			Message: reason,
+		}, nil
+	}
+
+	p.client.Send(smtp.Answer{
+		Status:  smtp.StartData,
+		Message: "Start mail input; end with <CRLF>.<CRLF>",
+	})
+	state.DataStart = time.Now()
+
+	for {
+		data, err := ioutil.ReadAll(&cmd.R)
+		state.Data = append(state.Data, data...)
+		if err == smtp.ErrLtl {
+			p.client.Send(smtp.Answer{
+				Status:  smtp.SyntaxError,
+				Message: "Line too long",
+			})
+			continue
+		}
+		if err == smtp.ErrIncomplete {
+			state.Reset()
+			if err := p.resetBackend(); err != nil {
+				return nil, err
+			}
+			return smtp.Answer{
+				Status:  smtp.SyntaxError,
+				Message: "Could not parse mail data",
+			}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	defer state.Reset()
+
+	if p.filter != nil {
+		if err := p.filter.FilterContent(state); err != nil {
+			log.WithFields(log.Fields{
+				"SessionId": state.SessionId.String(),
+			}).Warnf("Content filter did not accept mail: %v", err)
+
+			if err := p.resetBackend(); err != nil {
+				return nil, err
+			}
+			return HandlerErrorAnswer(err), nil
+		}
+	}
+
+	p.backend.Send(smtp.DataCmd{})
+	reply, err := p.backendReply()
+	if err != nil || status(reply) != smtp.StartData {
+		return reply, err
+	}
+	p.backend.Send(smtp.DataCmd{Data: state.Data})
+	return p.backendReply()
+}
+
+// resetBackend clears the transaction on the backend, after the mail was
+// rejected by the proxy.
+func (p *TransparentProxy) resetBackend() error {
+	p.backend.Send(smtp.RsetCmd{})
+	_, err := p.backendReply()
+	return err
+}
+
+// status returns the status code of an Answer or MultiAnswer.
+func status(reply smtp.Cmd) smtp.StatusCode {
+	switch reply := reply.(type) {
+	case smtp.Answer:
+		return reply.Status
+	case smtp.MultiAnswer:
+		return reply.Status
+	}
+	return 0
+}
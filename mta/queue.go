@@ -0,0 +1,167 @@
+package mta
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Queue stores accepted mails untill the MailHandler handled them,
+// so they are not lost when the server crashes.
+// See the persist package for a queue on disk.
+type Queue interface {
+	// Put stores a copy of the mail and returns its id.
+	Put(state *smtp.State) (uint64, error)
+	// Get returns the mail with the id.
+	Get(id uint64) (*smtp.State, error)
+	// Delete removes the mail after it was handled.
+	Delete(id uint64) error
+	// Ids returns the ids of the mails in the queue, oldest first.
+	Ids() ([]uint64, error)
+}
+
+// enqueue stores the mail and wakes up the queue worker.
+func (s *Mta) enqueue(state *smtp.State) error {
+	if _, err := s.config.Queue.Put(state); err != nil {
+		return err
+	}
+	select {
+	case s.queueC <- true:
+	default:
+		// The worker will already look at the queue again.
+	}
+	return nil
+}
+
+// maxQueueRetryInterval is the longest time between two tries of a queued mail.
+const maxQueueRetryInterval = time.Hour
+
+// queueRetry is a queued mail the MailHandler failed for.
+type queueRetry struct {
+	failures int
+	next     time.Time
+}
+
+// queueRetryDelay returns the time before the next try of a mail that failed
+// failures times: QueueRetryInterval, doubled for every failure after the first.
+func (s *Mta) queueRetryDelay(failures int) time.Duration {
+	delay := s.config.QueueRetryInterval
+	if delay <= 0 {
+		delay = time.Minute
+	}
+	for i := 1; i < failures && delay < maxQueueRetryInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxQueueRetryInterval {
+		delay = maxQueueRetryInterval
+	}
+	return delay
+}
+
+// runQueue passes the queued mails to the MailHandler untill the server quits.
+// Mails the handler returns an error for stay in the queue and are tried again
+// with a backoff, see queueRetryDelay, and when the server is started again.
+func (s *Mta) runQueue() {
+	failed := map[uint64]*queueRetry{}
+	// Mails that were handled, but could not be deleted from the queue.
+	handled := map[uint64]bool{}
+	for {
+		ids, err := s.config.Queue.Ids()
+		if err != nil {
+			log.Errorf("Could not read the queue: %v", err)
+		}
+
+		queued := map[uint64]bool{}
+		// When the first failed mail has to be tried again.
+		var retry time.Time
+		for _, id := range ids {
+			queued[id] = true
+			if handled[id] {
+				continue
+			}
+			r := failed[id]
+			if r == nil || !time.Now().Before(r.next) {
+				select {
+				case <-s.quitC:
+					return
+				default:
+				}
+				if s.handleQueued(id) {
+					delete(failed, id)
+					handled[id] = true
+					continue
+				}
+				if r == nil {
+					r = &queueRetry{}
+					failed[id] = r
+				}
+				r.failures++
+				r.next = time.Now().Add(s.queueRetryDelay(r.failures))
+			}
+			if retry.IsZero() || r.next.Before(retry) {
+				retry = r.next
+			}
+		}
+		// Forget the mails that are not in the queue anymore.
+		for id := range failed {
+			if !queued[id] && err == nil {
+				delete(failed, id)
+			}
+		}
+		for id := range handled {
+			if !queued[id] && err == nil {
+				delete(handled, id)
+			}
+		}
+
+		if n := int32(len(failed)); n != atomic.SwapInt32(&s.failingQueued, n) && n > 0 {
+			log.Warnf("%d queued mails could not be handled, they are tried again later", n)
+		}
+
+		var retryC <-chan time.Time
+		var timer *time.Timer
+		if !retry.IsZero() {
+			timer = time.NewTimer(time.Until(retry))
+			retryC = timer.C
+		}
+		select {
+		case <-s.queueC:
+		case <-retryC:
+		case <-s.quitC:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-s.quitC:
+			return
+		default:
+		}
+	}
+}
+
+// handleQueued passes a queued mail to the MailHandler and the smarthost,
+// and removes it from the queue if that succeeded. Returns false if the mail
+// has to be tried again, true if it was handled, even if it could not be
+// removed.
+func (s *Mta) handleQueued(id uint64) bool {
+	state, err := s.config.Queue.Get(id)
+	if err != nil {
+		log.Errorf("Could not read mail %d from the queue: %v", id, err)
+		return false
+	}
+
+	if err := s.handle(state); err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Warnf("Handler did not accept queued mail: %v", err)
+		return false
+	}
+
+	if err := s.config.Queue.Delete(id); err != nil {
+		log.Errorf("Could not delete mail %d from the queue: %v", id, err)
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package mta
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit allows MaxMessages messages per Window.
+type RateLimit struct {
+	MaxMessages int
+	Window      time.Duration
+}
+
+// senderRates counts the messages per sender in a sliding window.
+// The limit is passed in, so it can be changed with ReloadConfig.
+type senderRates struct {
+	// Sender to *sentMessages
+	senders sync.Map
+}
+
+// sentMessages are the times a sender sent a message within the window.
+type sentMessages struct {
+	sync.Mutex
+	times []time.Time
+}
+
+func newSenderRates() *senderRates {
+	return &senderRates{}
+}
+
+// prune removes the times that fell out of the window.
+func (m *sentMessages) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(m.times) && now.Sub(m.times[i]) >= window {
+		i++
+	}
+	m.times = m.times[i:]
+}
+
+// add records that sender sent a message just now.
+func (r *senderRates) add(sender string, window time.Duration) {
+	v, _ := r.senders.LoadOrStore(sender, &sentMessages{})
+	m := v.(*sentMessages)
+
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	m.prune(now, window)
+	m.times = append(m.times, now)
+}
+
+// exceeded checks if sender already sent the maximum number of messages in the window.
+func (r *senderRates) exceeded(sender string, limit RateLimit) bool {
+	v, ok := r.senders.Load(sender)
+	if !ok {
+		return false
+	}
+	m := v.(*sentMessages)
+
+	m.Lock()
+	defer m.Unlock()
+	m.prune(time.Now(), limit.Window)
+	if len(m.times) == 0 {
+		// Don't keep senders that are no longer active.
+		r.senders.Delete(sender)
+		return false
+	}
+	return len(m.times) >= limit.MaxMessages
+}
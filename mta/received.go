@@ -0,0 +1,38 @@
+package mta
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// receivedHeaders returns the Received: headers for the mail, with LF line
+// endings, see prependHeader. The newest one is on top, see RFC 5321 4.4.
+func (s *Mta) receivedHeaders(state *smtp.State, delivered time.Time) string {
+	proto := state.Proto
+	if proto == "" {
+		proto = "SMTP"
+	}
+
+	// Only name the recipient if there is one, see RFC 5321 7.2.
+	forClause := ""
+	if len(state.To) == 1 {
+		forClause = fmt.Sprintf(" for <%s>", state.To[0].GetAddress())
+	}
+
+	return fmt.Sprintf("Received: by %s id %s%s; %s\n", s.config.Hostname, state.SessionId.String(), forClause, delivered.Format(time.RFC1123Z)) +
+		fmt.Sprintf("Received: from %s ([%s]) by %s with %s id %s; %s\n", state.Hostname, state.Ip.String(), s.config.Hostname, proto, state.SessionId.String(), state.DataStart.Format(time.RFC1123Z))
+}
+
+// prependHeader adds header, with LF line endings, at the top of data. The
+// header gets CRLF line endings if data has them, e.g. with AcceptBareLF or
+// NormalizeCRLF.
+func prependHeader(data []byte, header string) []byte {
+	if bytes.Contains(data, []byte("\r\n")) {
+		header = strings.Replace(header, "\n", "\r\n", -1)
+	}
+	return append([]byte(header), data...)
+}
@@ -0,0 +1,75 @@
+package mta
+
+import (
+	"errors"
+	"fmt"
+)
+
+// runtimeConfig contains the Config fields that can be changed with ReloadConfig.
+// A session keeps the runtimeConfig it started with.
+type runtimeConfig struct {
+	maxRecipients              int
+	relayDomains               []string
+	allowRelayForAuthenticated bool
+	domainPolicies             map[string]DomainPolicy
+	// Nil if there is no limit.
+	senderRateLimit *RateLimit
+}
+
+func newRuntimeConfig(c Config) *runtimeConfig {
+	rc := &runtimeConfig{
+		maxRecipients:              c.MaxRecipients,
+		relayDomains:               append([]string{}, c.RelayDomains...),
+		allowRelayForAuthenticated: c.AllowRelayForAuthenticated,
+		domainPolicies:             map[string]DomainPolicy{},
+	}
+	for domain, policy := range c.DomainPolicies {
+		rc.domainPolicies[domain] = policy
+	}
+	if c.AuthenticatedSenderRateLimit != nil {
+		limit := *c.AuthenticatedSenderRateLimit
+		rc.senderRateLimit = &limit
+	}
+	return rc
+}
+
+// loadRuntimeConfig returns the current runtimeConfig, it must not be changed.
+func (s *Mta) loadRuntimeConfig() *runtimeConfig {
+	s.runtimeLock.RLock()
+	defer s.runtimeLock.RUnlock()
+	return s.runtime
+}
+
+// ReloadConfig changes the config without restarting the server.
+// Only MaxRecipients, RelayDomains, AllowRelayForAuthenticated, DomainPolicies
+// and AuthenticatedSenderRateLimit are changed, other fields are ignored.
+// Sessions that already started keep using the old values.
+// An error is returned and nothing is changed if c is invalid, or if
+// Hostname, Ip, Port, TlsCert, TlsKey or TlsMinVersion differ from the
+// current config.
+func (s *Mta) ReloadConfig(c Config) error {
+	if c.Hostname != s.config.Hostname || c.Ip != s.config.Ip || c.Port != s.config.Port {
+		return errors.New("Hostname, Ip and Port can't be changed without a restart")
+	}
+	if c.TlsCert != s.config.TlsCert || c.TlsKey != s.config.TlsKey || c.TlsMinVersion != s.config.TlsMinVersion {
+		return errors.New("TlsCert, TlsKey and TlsMinVersion can't be changed without a restart")
+	}
+
+	if c.MaxRecipients < 0 {
+		return errors.New("MaxRecipients can't be negative")
+	}
+	for domain, policy := range c.DomainPolicies {
+		if policy.MaxMessageSize < 0 || policy.MaxRecipients < 0 {
+			return fmt.Errorf("Limits of domain policy %s can't be negative", domain)
+		}
+	}
+	if limit := c.AuthenticatedSenderRateLimit; limit != nil && (limit.MaxMessages <= 0 || limit.Window <= 0) {
+		return errors.New("AuthenticatedSenderRateLimit needs a positive MaxMessages and Window")
+	}
+
+	rc := newRuntimeConfig(c)
+	s.runtimeLock.Lock()
+	s.runtime = rc
+	s.runtimeLock.Unlock()
+	return nil
+}
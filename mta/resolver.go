@@ -0,0 +1,150 @@
+package mta
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSResolver does all DNS lookups we need. It is implemented by *net.Resolver.
+type DNSResolver interface {
+	Resolver
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// defaultResolver is used by the DNS based features when no resolver is configured.
+var defaultResolver = NewCachingResolver(4096, 5*time.Minute, time.Minute)
+
+// CachingResolver is a DNSResolver that caches the results of another resolver.
+// Found records are cached for TTL, names that don't exist for NegativeTTL.
+// Other errors, like timeouts, are not cached.
+// The least recently used results are dropped when there are more than Size.
+// Callers get copies of the cached results, so they can change them.
+type CachingResolver struct {
+	// Resolver does the lookups, net.DefaultResolver if nil.
+	Resolver    DNSResolver
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	lock sync.Mutex
+	// Least recently used at the back.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+var _ DNSResolver = (*CachingResolver)(nil)
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver creates a CachingResolver that uses net.DefaultResolver.
+func NewCachingResolver(size int, ttl, negativeTTL time.Duration) *CachingResolver {
+	return &CachingResolver{
+		Size:        size,
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+	}
+}
+
+func (r *CachingResolver) resolver() DNSResolver {
+	if r.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return r.Resolver
+}
+
+// lookup returns the cached result for key, or calls f and caches its result.
+func (r *CachingResolver) lookup(key string, f func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+
+	r.lock.Lock()
+	if e, ok := r.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			r.lru.MoveToFront(e)
+			r.lock.Unlock()
+			return entry.value, entry.err
+		}
+		r.lru.Remove(e)
+		delete(r.entries, key)
+	}
+	r.lock.Unlock()
+
+	// Don't hold the lock during the lookup, concurrent lookups for the same
+	// name are rare and harmless.
+	value, err := f()
+
+	ttl := r.TTL
+	if err != nil {
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsNotFound {
+			return value, err
+		}
+		ttl = r.NegativeTTL
+	}
+	if ttl <= 0 || r.Size <= 0 {
+		return value, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.entries == nil {
+		r.entries = map[string]*list.Element{}
+		r.lru = list.New()
+	}
+	if e, ok := r.entries[key]; ok {
+		r.lru.Remove(e)
+	}
+	r.entries[key] = r.lru.PushFront(&cacheEntry{key: key, value: value, err: err, expires: now.Add(ttl)})
+	for r.lru.Len() > r.Size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return value, err
+}
+
+func (r *CachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	v, err := r.lookup("PTR "+addr, func() (interface{}, error) {
+		return r.resolver().LookupAddr(ctx, addr)
+	})
+	names, _ := v.([]string)
+	return append([]string(nil), names...), err
+}
+
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, err := r.lookup("IP "+host, func() (interface{}, error) {
+		return r.resolver().LookupIPAddr(ctx, host)
+	})
+	addrs, _ := v.([]net.IPAddr)
+	return append([]net.IPAddr(nil), addrs...), err
+}
+
+func (r *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := r.lookup("MX "+name, func() (interface{}, error) {
+		return r.resolver().LookupMX(ctx, name)
+	})
+	mxs, _ := v.([]*net.MX)
+	copied := make([]*net.MX, len(mxs))
+	for i, mx := range mxs {
+		mxCopy := *mx
+		copied[i] = &mxCopy
+	}
+	return copied, err
+}
+
+func (r *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, err := r.lookup("TXT "+name, func() (interface{}, error) {
+		return r.resolver().LookupTXT(ctx, name)
+	})
+	txts, _ := v.([]string)
+	return append([]string(nil), txts...), err
+}
@@ -0,0 +1,117 @@
+package mta
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// defaultSessionTokenTTL is how long a session token can be used if
+// Config.SessionTokenTTL is not set.
+const defaultSessionTokenTTL = 10 * time.Minute
+
+var errInvalidSessionToken = errors.New("invalid session token")
+
+// resumableSession is what a session token restores.
+type resumableSession struct {
+	ip       string
+	hostname string
+	// The result of the FCrDNS check.
+	fcrdnsOk   bool
+	clientName string
+	expires    time.Time
+}
+
+// resumableSessions are the sessions that can be resumed, by session id.
+type resumableSessions struct {
+	sync.Mutex
+	secret   []byte
+	ttl      time.Duration
+	sessions map[string]resumableSession
+}
+
+func newResumableSessions(secret []byte, ttl time.Duration) *resumableSessions {
+	if ttl <= 0 {
+		ttl = defaultSessionTokenTTL
+	}
+	return &resumableSessions{
+		secret:   secret,
+		ttl:      ttl,
+		sessions: make(map[string]resumableSession),
+	}
+}
+
+// token returns the signed token of a session: the expiry time, the session
+// id and the HMAC-SHA256 of both.
+func (r *resumableSessions) token(id smtp.Id, expires time.Time) string {
+	payload := make([]byte, 20)
+	binary.BigEndian.PutUint64(payload[0:], uint64(expires.Unix()))
+	binary.BigEndian.PutUint64(payload[8:], uint64(id.Timestamp))
+	binary.BigEndian.PutUint32(payload[16:], id.Counter)
+	return base64.RawURLEncoding.EncodeToString(append(payload, r.mac(payload)...))
+}
+
+func (r *resumableSessions) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// verify returns the session id of a token that is signed by us and not expired.
+func (r *resumableSessions) verify(token string) (smtp.Id, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != 20+sha256.Size {
+		return smtp.Id{}, errInvalidSessionToken
+	}
+	payload := raw[:20]
+	if !hmac.Equal(raw[20:], r.mac(payload)) {
+		return smtp.Id{}, errInvalidSessionToken
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(payload[0:])) {
+		return smtp.Id{}, errors.New("session token expired")
+	}
+	return smtp.Id{
+		Timestamp: int64(binary.BigEndian.Uint64(payload[8:])),
+		Counter:   binary.BigEndian.Uint32(payload[16:]),
+	}, nil
+}
+
+// save makes a session resumable until it expires.
+// Expired sessions are removed at the same time so the map doesn't keep growing.
+func (r *resumableSessions) save(id smtp.Id, session resumableSession) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for k, v := range r.sessions {
+		if now.After(v.expires) {
+			delete(r.sessions, k)
+		}
+	}
+	r.sessions[id.String()] = session
+}
+
+// resume returns the session of a token, if it was issued to a client with the ip.
+func (r *resumableSessions) resume(token string, ip string) (resumableSession, error) {
+	id, err := r.verify(token)
+	if err != nil {
+		return resumableSession{}, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	session, ok := r.sessions[id.String()]
+	if !ok || time.Now().After(session.expires) {
+		return resumableSession{}, errors.New("unknown session")
+	}
+	if session.ip != ip {
+		return resumableSession{}, errors.New("session of another ip")
+	}
+	return session, nil
+}
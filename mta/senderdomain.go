@@ -0,0 +1,45 @@
+package mta
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// newSenderDomainResolver returns the resolver for VerifySenderDomain.
+func newSenderDomainResolver(c Config) *CachingResolver {
+	ttl := c.SenderDomainCacheTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &CachingResolver{
+		Resolver:    c.SenderDomainResolver,
+		Size:        4096,
+		TTL:         ttl,
+		NegativeTTL: ttl,
+	}
+}
+
+// senderDomainExists checks if a domain has an MX, A or AAAA record.
+// An error is returned if that is unknown because the lookups failed.
+func (s *Mta) senderDomainExists(domain string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mxs, mxErr := s.senderDomainResolver.LookupMX(ctx, domain)
+	if mxErr == nil && len(mxs) > 0 {
+		return true, nil
+	}
+	// Without MX records, mail is delivered to the A or AAAA record.
+	addrs, err := s.senderDomainResolver.LookupIPAddr(ctx, domain)
+	if err == nil && len(addrs) > 0 {
+		return true, nil
+	}
+
+	for _, err := range []error{mxErr, err} {
+		if dnsErr, ok := err.(*net.DNSError); err != nil && (!ok || !dnsErr.IsNotFound) {
+			return false, err
+		}
+	}
+	return false, nil
+}
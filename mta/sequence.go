@@ -0,0 +1,213 @@
+package mta
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// SequenceAnalyzer looks for sessions with an unusual order of commands,
+// which are valid one by one but are typical for spam clients.
+// It is experimental, and a hook for other (e.g. machine learning) detectors.
+type SequenceAnalyzer interface {
+	// Analyze is called before a command is handled, with the commands of the
+	// session so far. The last one is the command that is about to be handled.
+	// The reason is sent to the client if the command is rejected.
+	Analyze(history []smtp.Cmd) (suspicious bool, reason string)
+}
+
+// maxCmdHistory is the number of commands that are passed to the SequenceAnalyzer.
+// The first command is always kept, the oldest of the others are dropped.
+const maxCmdHistory = 100
+
+// CommandVerb returns the upper case verb of a command, e.g. "EHLO".
+// Unknown and invalid commands are "UNKNOWN" and "INVALID".
+func CommandVerb(cmd smtp.Cmd) string {
+	switch cmd.(type) {
+	case smtp.HeloCmd:
+		return "HELO"
+	case smtp.EhloCmd:
+		return "EHLO"
+	case smtp.QuitCmd:
+		return "QUIT"
+	case smtp.MailCmd:
+		return "MAIL"
+	case smtp.RcptCmd:
+		return "RCPT"
+	case smtp.DataCmd:
+		return "DATA"
+	case smtp.BdatCmd:
+		return "BDAT"
+	case smtp.RsetCmd:
+		return "RSET"
+	case smtp.StartTlsCmd:
+		return "STARTTLS"
+	case smtp.NoopCmd:
+		return "NOOP"
+	case smtp.PingCmd:
+		return "PING"
+	case smtp.AuthCmd:
+		return "AUTH"
+	case smtp.XForwardCmd:
+		return "XFORWARD"
+	case smtp.AtrnCmd:
+		return "ATRN"
+	case smtp.HelpCmd:
+		return "HELP"
+	case smtp.VrfyCmd:
+		return "VRFY"
+	case smtp.ExpnCmd:
+		return "EXPN"
+	case smtp.SendCmd:
+		return "SEND"
+	case smtp.SomlCmd:
+		return "SOML"
+	case smtp.SamlCmd:
+		return "SAML"
+	case smtp.InvalidCmd:
+		return "INVALID"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// sequenceStart marks the start of a session in the n-grams.
+const sequenceStart = "^"
+
+// NgramAnalyzer is a SequenceAnalyzer that knows the n-grams (runs of N
+// commands) of normal sessions. Sessions with more than MaxUnknown n-grams
+// that it wasn't trained on are suspicious.
+// Train must not be called while the analyzer is used by a server.
+type NgramAnalyzer struct {
+	N          int
+	MaxUnknown int
+	known      map[string]bool
+}
+
+// NewNgramAnalyzer creates an NgramAnalyzer that wasn't trained yet.
+func NewNgramAnalyzer(n, maxUnknown int) *NgramAnalyzer {
+	if n < 1 {
+		n = 1
+	}
+	return &NgramAnalyzer{
+		N:          n,
+		MaxUnknown: maxUnknown,
+		known:      map[string]bool{},
+	}
+}
+
+// defaultTrainingSequences are sessions of well-behaved clients.
+var defaultTrainingSequences = [][]string{
+	{"EHLO", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"EHLO", "MAIL", "RCPT", "RCPT", "RCPT", "DATA", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"HELO", "MAIL", "RCPT", "RCPT", "DATA", "QUIT"},
+	{"EHLO", "STARTTLS", "EHLO", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "RCPT", "RCPT", "DATA", "QUIT"},
+	{"EHLO", "AUTH", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"EHLO", "MAIL", "RCPT", "BDAT", "BDAT", "BDAT", "MAIL", "RCPT", "RCPT", "BDAT", "QUIT"},
+	{"EHLO", "XFORWARD", "MAIL", "RCPT", "DATA", "XFORWARD", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"EHLO", "MAIL", "RCPT", "RSET", "MAIL", "RCPT", "DATA", "RSET", "QUIT"},
+	{"EHLO", "MAIL", "RSET", "QUIT"},
+	{"EHLO", "NOOP", "MAIL", "RCPT", "DATA", "NOOP", "QUIT"},
+	{"EHLO", "RSET", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"HELO", "QUIT"},
+	{"EHLO", "QUIT"},
+	{"EHLO", "STARTTLS", "EHLO", "QUIT"},
+	{"NOOP", "EHLO", "MAIL", "RCPT", "DATA", "QUIT"},
+	{"QUIT"},
+}
+
+// DefaultNgramAnalyzer returns an NgramAnalyzer of 3-grams that is trained on
+// the usual sessions, and allows 2 unknown n-grams per session.
+func DefaultNgramAnalyzer() *NgramAnalyzer {
+	a := NewNgramAnalyzer(3, 2)
+	for _, sequence := range defaultTrainingSequences {
+		a.Train(sequence)
+	}
+	return a
+}
+
+// Train adds the n-grams of a normal session, given as command verbs.
+func (a *NgramAnalyzer) Train(sequence []string) {
+	for _, ngram := range a.ngrams(sequence) {
+		a.known[ngram] = true
+	}
+}
+
+// ngrams returns the n-grams of a session, including the ones at the start.
+func (a *NgramAnalyzer) ngrams(sequence []string) []string {
+	padded := make([]string, 0, a.N-1+len(sequence))
+	for i := 1; i < a.N; i++ {
+		padded = append(padded, sequenceStart)
+	}
+	padded = append(padded, sequence...)
+
+	ngrams := []string{}
+	for i := 0; i+a.N <= len(padded); i++ {
+		ngrams = append(ngrams, strings.Join(padded[i:i+a.N], " "))
+	}
+	return ngrams
+}
+
+func (a *NgramAnalyzer) Analyze(history []smtp.Cmd) (bool, string) {
+	verbs := make([]string, len(history))
+	for i, cmd := range history {
+		verbs[i] = CommandVerb(cmd)
+	}
+
+	unknown := []string{}
+	for _, ngram := range a.ngrams(verbs) {
+		if !a.known[ngram] {
+			unknown = append(unknown, ngram)
+		}
+	}
+	if len(unknown) <= a.MaxUnknown {
+		return false, ""
+	}
+	return true, fmt.Sprintf("Unusual command sequence: %s", strings.Join(unknown, ", "))
+}
+
+// appendHistory adds cmd to the history of a session, and drops the oldest
+// command after the first one if there are more than maxCmdHistory.
+func appendHistory(history []smtp.Cmd, cmd smtp.Cmd) []smtp.Cmd {
+	history = append(history, cmd)
+	if len(history) > maxCmdHistory {
+		history = append(history[:1], history[2:]...)
+	}
+	return history
+}
+
+// rejectSuspiciousSequence analyzes the commands of the session. It returns
+// true if the last command was rejected and should not be handled.
+// QUIT is never rejected.
+func (s *Mta) rejectSuspiciousSequence(proto smtp.Protocol, state *smtp.State, history []smtp.Cmd) bool {
+	suspicious, reason := s.config.SequenceAnalyzer.Analyze(history)
+	if !suspicious {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+	}).Warnf("Suspicious command sequence: %s", reason)
+
+	cmd := history[len(history)-1]
+	if _, ok := cmd.(smtp.QuitCmd); ok || !s.config.RejectSuspiciousSequences {
+		return false
+	}
+	// A BDAT chunk has to be read, otherwise it would be parsed as commands.
+	if bdat, ok := cmd.(smtp.BdatCmd); ok {
+		io.Copy(ioutil.Discard, bdat.R)
+	}
+
+	proto.Send(smtp.Answer{
+		Status:       smtp.MailboxUnavailable,
+		EnhancedCode: "5.7.1",
+		Message:      reason,
+	})
+	return true
+}
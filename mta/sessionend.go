@@ -0,0 +1,56 @@
+package mta
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// SessionEndReason tells Config.OnSessionEnd why a session ended.
+type SessionEndReason int
+
+const (
+	// EndQuit means the client sent QUIT.
+	EndQuit SessionEndReason = iota
+	// EndClientDisconnect means the client closed the connection.
+	EndClientDisconnect
+	// EndServerShutdown means the server was stopped.
+	EndServerShutdown
+	// EndTimeout means the client didn't send a command or data in time.
+	EndTimeout
+	// EndError means we closed the connection because of an error or a
+	// policy, e.g. too many invalid recipients.
+	EndError
+	// EndReversed means the client sent ATRN and we delivered its mail over
+	// the connection.
+	EndReversed
+)
+
+func (r SessionEndReason) String() string {
+	switch r {
+	case EndQuit:
+		return "quit"
+	case EndClientDisconnect:
+		return "client disconnect"
+	case EndServerShutdown:
+		return "server shutdown"
+	case EndTimeout:
+		return "timeout"
+	case EndReversed:
+		return "reversed"
+	}
+	return "error"
+}
+
+// endReason returns why a session ends because of the error reading from the
+// client.
+func endReason(err error) SessionEndReason {
+	switch {
+	case isTimeout(err):
+		return EndTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrClosedPipe),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return EndClientDisconnect
+	}
+	return EndError
+}
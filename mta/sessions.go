@@ -0,0 +1,143 @@
+package mta
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// maxEndedCaptures is the number of ended sessions whose capture is kept.
+const maxEndedCaptures = 100
+
+// capturer is implemented by protocols that record the bytes of the
+// session, like smtp.CapturingProtocol.
+type capturer interface {
+	Entries() []smtp.CapturingEntry
+}
+
+// SessionSummary describes an active session, see Mta.Sessions.
+type SessionSummary struct {
+	Id string
+	Ip string
+	// Hostname is the name the client gave in HELO or EHLO, empty before.
+	Hostname string
+	Started  time.Time
+}
+
+// activeSession is a session in the registry.
+type activeSession struct {
+	summary SessionSummary
+	// cancel ends the session, see Mta.KillSession.
+	cancel context.CancelFunc
+	// Nil if the session isn't captured.
+	capture capturer
+}
+
+// endedCapture is the capture of a session that ended.
+type endedCapture struct {
+	id      string
+	entries []smtp.CapturingEntry
+}
+
+// sessionRegistry keeps track of the active sessions.
+type sessionRegistry struct {
+	sync.Mutex
+	sessions map[string]*activeSession
+	// The captures of the last sessions that ended, the oldest first.
+	endedCaptures []endedCapture
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*activeSession),
+	}
+}
+
+// add registers a session, it is killed by calling cancel.
+func (r *sessionRegistry) add(id, ip string, cancel context.CancelFunc) {
+	r.Lock()
+	defer r.Unlock()
+	r.sessions[id] = &activeSession{
+		summary: SessionSummary{Id: id, Ip: ip, Started: time.Now()},
+		cancel:  cancel,
+	}
+}
+
+// remove unregisters a session, its capture is kept for a while.
+func (r *sessionRegistry) remove(id string) {
+	r.Lock()
+	defer r.Unlock()
+	if session, ok := r.sessions[id]; ok && session.capture != nil {
+		if len(r.endedCaptures) == maxEndedCaptures {
+			r.endedCaptures = r.endedCaptures[1:]
+		}
+		r.endedCaptures = append(r.endedCaptures, endedCapture{id: id, entries: session.capture.Entries()})
+	}
+	delete(r.sessions, id)
+}
+
+func (r *sessionRegistry) setCapture(id string, c capturer) {
+	r.Lock()
+	defer r.Unlock()
+	if session, ok := r.sessions[id]; ok {
+		session.capture = c
+	}
+}
+
+func (r *sessionRegistry) setHostname(id, hostname string) {
+	r.Lock()
+	defer r.Unlock()
+	if session, ok := r.sessions[id]; ok {
+		session.summary.Hostname = hostname
+	}
+}
+
+// Sessions returns the active sessions, the oldest first.
+func (s *Mta) Sessions() []SessionSummary {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	summaries := make([]SessionSummary, 0, len(s.sessions.sessions))
+	for _, session := range s.sessions.sessions {
+		summaries = append(summaries, session.summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Started.Before(summaries[j].Started)
+	})
+	return summaries
+}
+
+// KillSession ends the session with the given id: the client gets a 421 and
+// is disconnected when we wait for its next command. It returns false if
+// there is no such session.
+func (s *Mta) KillSession(id string) bool {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	session, ok := s.sessions.sessions[id]
+	if ok {
+		session.cancel()
+	}
+	return ok
+}
+
+// CaptureSession returns the bytes received and sent in a session, if it
+// was captured (see Config.EnableCapture). The captures of the last 100
+// sessions that ended are kept. It returns nil if there is no capture.
+func (s *Mta) CaptureSession(id string) []smtp.CapturingEntry {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	if session, ok := s.sessions.sessions[id]; ok {
+		if session.capture == nil {
+			return nil
+		}
+		return session.capture.Entries()
+	}
+	for _, ended := range s.sessions.endedCaptures {
+		if ended.id == id {
+			return append([]smtp.CapturingEntry{}, ended.entries...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package mta
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// SPFChecker checks whether a client may send mail for a sender (RFC 7208).
+// The result is one of "none", "neutral", "pass", "fail", "softfail",
+// "temperror" or "permerror".
+type SPFChecker interface {
+	CheckSPF(ip net.IP, helo string, sender string) (result string, err error)
+}
+
+// spfIdentity returns the identity that is checked with SPF: the sender, or
+// postmaster@helo for the null sender (RFC 7208 2.4).
+func spfIdentity(state *smtp.State) (identity, scope string) {
+	if state.From != nil && state.From.GetAddress() != "" {
+		return state.From.GetAddress(), "mailfrom"
+	}
+	return "postmaster@" + state.Hostname, "helo"
+}
+
+// checkSPF runs the SPF checker for the sender of the mail.
+func (s *Mta) checkSPF(state *smtp.State) string {
+	identity, _ := spfIdentity(state)
+	result, err := s.config.SPFChecker.CheckSPF(state.Ip, state.Hostname, identity)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": state.SessionId.String(),
+		}).Warnf("Could not check SPF: %v", err)
+		return "temperror"
+	}
+
+	log.WithFields(log.Fields{
+		"SessionId": state.SessionId.String(),
+		"Result":    result,
+	}).Debug("Checked SPF")
+	return result
+}
+
+// receivedSPFHeader returns the Received-SPF: header (RFC 7208 9.1) for an
+// SPF result, with LF line endings, see prependHeader.
+func (s *Mta) receivedSPFHeader(state *smtp.State, result string) string {
+	identity, scope := spfIdentity(state)
+	ip := state.Ip.String()
+
+	var comment string
+	switch result {
+	case "pass":
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", identity, ip)
+	case "fail":
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", identity, ip)
+	case "softfail":
+		comment = fmt.Sprintf("transitioning domain of %s does not designate %s as permitted sender", identity, ip)
+	case "neutral":
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, identity)
+	case "none":
+		comment = fmt.Sprintf("domain of %s does not designate permitted sender hosts", identity)
+	case "temperror", "permerror":
+		comment = fmt.Sprintf("error in processing during lookup of %s", identity)
+	default:
+		result = "permerror"
+		comment = fmt.Sprintf("unknown SPF result for %s", identity)
+	}
+
+	envelopeFrom := ""
+	if state.From != nil {
+		envelopeFrom = state.From.GetAddress()
+	}
+
+	return fmt.Sprintf("Received-SPF: %s (%s: %s)\n", result, s.config.Hostname, comment) +
+		fmt.Sprintf("\tclient-ip=%s; envelope-from=%s; helo=%s;\n", spfValue(ip), spfValue(envelopeFrom), spfValue(state.Hostname)) +
+		fmt.Sprintf("\treceiver=%s; identity=%s;\n", spfValue(s.config.Hostname), scope)
+}
+
+// spfValue returns v as a dot-atom if it is one, otherwise as a quoted-string
+// (RFC 5322 3.2.3 and 3.2.4).
+func spfValue(v string) string {
+	if isDotAtom(v) {
+		return v
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range v {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isDotAtom(v string) bool {
+	if v == "" || strings.HasPrefix(v, ".") || strings.HasSuffix(v, ".") || strings.Contains(v, "..") {
+		return false
+	}
+	for _, r := range v {
+		if r != '.' && !isAtext(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAtext(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') ||
+		strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
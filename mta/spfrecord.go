@@ -0,0 +1,188 @@
+package mta
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxSPFLookups is the maximum number of terms that cause DNS lookups in an
+// SPF record (RFC 7208 4.6.4).
+const maxSPFLookups = 10
+
+// GenerateSPFRecord returns the SPF record that allows the server with ip
+// and hostname to send mail for a domain, e.g.
+//
+//	v=spf1 ip4:192.0.2.1 mx a include:mail.example.com ~all
+//
+// mechanism is the final "all" mechanism, e.g. "-all". It defaults to
+// "~all". The include is left out if hostname is empty.
+func GenerateSPFRecord(ip net.IP, hostname string, mechanism string) string {
+	terms := []string{"v=spf1"}
+	if ip4 := ip.To4(); ip4 != nil {
+		terms = append(terms, "ip4:"+ip4.String())
+	} else if ip != nil {
+		terms = append(terms, "ip6:"+ip.String())
+	}
+	terms = append(terms, "mx", "a")
+	if hostname = strings.TrimSuffix(hostname, "."); hostname != "" {
+		terms = append(terms, "include:"+hostname)
+	}
+	if mechanism == "" {
+		mechanism = "~all"
+	}
+	return strings.Join(append(terms, mechanism), " ")
+}
+
+// ValidateSPFRecord checks the syntax of an SPF record (RFC 7208 4.6), and
+// that it doesn't need more than 10 DNS lookups.
+func ValidateSPFRecord(record string) error {
+	terms := strings.Fields(record)
+	if len(terms) == 0 || !strings.EqualFold(terms[0], "v=spf1") {
+		return errors.New("SPF record doesn't start with v=spf1")
+	}
+
+	lookups := 0
+	modifiers := map[string]bool{}
+	for _, term := range terms[1:] {
+		// A modifier is name=value, a mechanism can't contain "=" before ":" or "/".
+		if i := strings.IndexAny(term, "=:/"); i > 0 && term[i] == '=' {
+			name := strings.ToLower(term[:i])
+			if !validSPFName(name) {
+				return fmt.Errorf("invalid SPF modifier %q", term)
+			}
+			if name == "redirect" || name == "exp" {
+				if modifiers[name] {
+					return fmt.Errorf("SPF modifier %s is used more than once", name)
+				}
+				if term[i+1:] == "" {
+					return fmt.Errorf("SPF modifier %s needs a domain", name)
+				}
+			}
+			if name == "redirect" {
+				lookups++
+			}
+			modifiers[name] = true
+			continue
+		}
+
+		mechanism := strings.TrimLeft(term, "+-~?")
+		if len(term)-len(mechanism) > 1 {
+			return fmt.Errorf("invalid SPF qualifier in %q", term)
+		}
+		name, arg := mechanism, ""
+		if i := strings.IndexAny(mechanism, ":/"); i >= 0 {
+			name, arg = mechanism[:i], mechanism[i:]
+		}
+
+		var err error
+		switch strings.ToLower(name) {
+		case "all":
+			if arg != "" {
+				err = errors.New("all has no arguments")
+			}
+		case "include", "exists":
+			lookups++
+			if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+				err = fmt.Errorf("%s needs a domain", name)
+			}
+		case "a", "mx":
+			lookups++
+			err = validateSPFDomainCIDR(arg)
+		case "ptr":
+			lookups++
+			if arg != "" && (!strings.HasPrefix(arg, ":") || len(arg) == 1) {
+				err = errors.New("invalid ptr domain")
+			}
+		case "ip4", "ip6":
+			err = validateSPFIP(strings.ToLower(name), arg)
+		default:
+			err = errors.New("unknown mechanism")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid SPF mechanism %q: %v", term, err)
+		}
+	}
+
+	if lookups > maxSPFLookups {
+		return fmt.Errorf("SPF record needs %d DNS lookups, at most %d are allowed", lookups, maxSPFLookups)
+	}
+	return nil
+}
+
+// validSPFName checks the name of a modifier: ALPHA *( ALPHA / DIGIT / "-" / "_" / "." ).
+func validSPFName(name string) bool {
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// validateSPFDomainCIDR checks the [ ":" domain-spec ] [ dual-cidr-length ]
+// argument of a and mx.
+func validateSPFDomainCIDR(arg string) error {
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		i := strings.Index(arg, "/")
+		if i < 0 {
+			i = len(arg)
+		}
+		if i == 0 {
+			return errors.New("empty domain")
+		}
+		arg = arg[i:]
+	}
+	if arg == "" {
+		return nil
+	}
+
+	// "/24", "//64" or "/24//64"
+	parts := strings.SplitN(arg[1:], "//", 2)
+	if strings.HasPrefix(arg, "//") {
+		parts = []string{"", arg[2:]}
+	} else if !validPrefixLength(parts[0], 32) {
+		return errors.New("invalid ip4 prefix length")
+	}
+	if len(parts) == 2 && !validPrefixLength(parts[1], 128) {
+		return errors.New("invalid ip6 prefix length")
+	}
+	return nil
+}
+
+// validateSPFIP checks the ":" address [ cidr-length ] argument of ip4 or ip6.
+func validateSPFIP(name, arg string) error {
+	if !strings.HasPrefix(arg, ":") {
+		return errors.New("missing address")
+	}
+	address, prefix, hasPrefix := arg[1:], "", false
+	if i := strings.Index(address, "/"); i >= 0 {
+		address, prefix, hasPrefix = address[:i], address[i+1:], true
+	}
+	ip := net.ParseIP(address)
+	maxPrefix := 32
+	if name == "ip4" && (ip == nil || ip.To4() == nil || strings.Contains(address, ":")) {
+		return errors.New("invalid IPv4 address")
+	}
+	if name == "ip6" {
+		if ip == nil || !strings.Contains(address, ":") {
+			return errors.New("invalid IPv6 address")
+		}
+		maxPrefix = 128
+	}
+	if hasPrefix && !validPrefixLength(prefix, maxPrefix) {
+		return errors.New("invalid prefix length")
+	}
+	return nil
+}
+
+func validPrefixLength(s string, max int) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 0 && n <= max && s == strconv.Itoa(n)
+}
@@ -0,0 +1,87 @@
+package mta
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/gopistolet/gopistolet/log"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+// See sd_listen_fds(3).
+var listenFdsStart = 3
+
+// ListenAndServeSystemd is like ListenAndServe, but uses the socket passed by
+// systemd socket activation if there is one. systemd is notified when we are
+// ready to accept connections.
+func (s *DefaultMta) ListenAndServeSystemd() error {
+	ln, err := systemdListener()
+	if err != nil {
+		log.Errorf("Could not use socket passed by systemd: %v", err)
+		return err
+	}
+
+	if ln == nil {
+		ln, err = net.Listen("tcp", s.mta.addr())
+		if err != nil {
+			log.Errorf("Could not start listening: %v", err)
+			return err
+		}
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warnf("Could not notify systemd: %v", err)
+	}
+
+	return s.Serve(ln)
+}
+
+// systemdListener returns the listener passed by systemd socket activation,
+// or nil if we weren't socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// The sockets are for us, not for our child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds > 1 {
+		log.Warnf("systemd passed %d sockets, only the first one is used", fds)
+	}
+
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_"+strconv.Itoa(listenFdsStart))
+	// FileListener makes its own copy of the file descriptor.
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends state to systemd. It does nothing if we weren't
+// started by systemd. See sd_notify(3).
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,105 @@
+package mta
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// DefaultCommandTimeouts returns the timeouts of RFC 5321 4.5.3.2.
+// The DATA initiation and termination timeouts are for clients waiting on
+// our answers, the server only has to wait for the data blocks.
+func DefaultCommandTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		"EHLO": 5 * time.Minute,
+		"MAIL": 5 * time.Minute,
+		"RCPT": 5 * time.Minute,
+		"DATA": 3 * time.Minute,
+	}
+}
+
+// readDeadliner is implemented by protocols that can time out reads.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// commandTimeout returns the timeout for a key of CommandTimeouts.
+func (s *Mta) commandTimeout(key string) time.Duration {
+	if timeout, ok := s.config.CommandTimeouts[key]; ok {
+		return timeout
+	}
+	return DefaultCommandTimeouts()[key]
+}
+
+// expectedCommand returns the CommandTimeouts key for the next command.
+func expectedCommand(state *smtp.State) string {
+	if state.Hostname == "" {
+		return "EHLO"
+	}
+	if state.From == nil {
+		return "MAIL"
+	}
+	return "RCPT"
+}
+
+// setCommandDeadline sets the deadline for reading the next command.
+func (s *Mta) setCommandDeadline(proto smtp.Protocol, state *smtp.State) {
+	d, ok := baseProtocol(proto).(readDeadliner)
+	if !ok {
+		return
+	}
+	deadline := time.Time{}
+	if timeout := s.commandTimeout(expectedCommand(state)); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	d.SetReadDeadline(deadline)
+}
+
+// dataReader returns a reader for the mail data that times out when no data
+// arrives for the DataChunkTimeout or the DATA timeout.
+func (s *Mta) dataReader(proto smtp.Protocol, r io.Reader) io.Reader {
+	dr := &deadlineReader{r: r}
+	if d, ok := baseProtocol(proto).(readDeadliner); ok {
+		dr.d = d
+		dr.timeout = s.commandTimeout("DATA")
+		if s.config.DataChunkTimeout > 0 {
+			dr.timeout = s.config.DataChunkTimeout
+		}
+	}
+	return dr
+}
+
+// deadlineReader moves the read deadline before every read.
+type deadlineReader struct {
+	r       io.Reader
+	d       readDeadliner
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	if r.d != nil && r.timeout > 0 {
+		r.d.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.r.Read(b)
+}
+
+// timeoutAnswer is sent when the client was too slow.
+var timeoutAnswer = smtp.Answer{
+	Status:       smtp.ShuttingDown,
+	EnhancedCode: "4.4.2",
+	Message:      "Timeout exceeded, closing connection",
+}
+
+// dataTimeoutAnswer is sent when the mail data stopped coming.
+var dataTimeoutAnswer = smtp.Answer{
+	Status:       smtp.ShuttingDown,
+	EnhancedCode: "4.4.2",
+	Message:      "Data timeout",
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,44 @@
+package mta
+
+import (
+	"sync"
+	"time"
+)
+
+// tlsClients keeps track of client ips that recently failed a TLS handshake.
+type tlsClients struct {
+	sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func newTlsClients(ttl time.Duration) *tlsClients {
+	return &tlsClients{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// add records that ip failed a TLS handshake just now.
+// Expired records are removed at the same time so the map doesn't keep growing.
+func (t *tlsClients) add(ip string) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	for k, v := range t.seen {
+		if now.Sub(v) > t.ttl {
+			delete(t.seen, k)
+		}
+	}
+	t.seen[ip] = now
+}
+
+// recent checks if ip failed a TLS handshake within the ttl.
+func (t *tlsClients) recent(ip string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	v, ok := t.seen[ip]
+	return ok && time.Since(v) <= t.ttl
+}
@@ -0,0 +1,67 @@
+package mta
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// LogTLSDetails logs what was negotiated in the TLS handshake with the client.
+func (s *Mta) LogTLSDetails(state *smtp.State, tlsState *tls.ConnectionState) {
+	serial := ""
+	if cert := s.serverCert(tlsState.ServerName); cert != nil && cert.SerialNumber != nil {
+		serial = cert.SerialNumber.Text(16)
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":                 state.Ip.String(),
+		"SessionId":          state.SessionId.String(),
+		"tls_version":        tlsVersionName(tlsState.Version),
+		"cipher_suite":       tls.CipherSuiteName(tlsState.CipherSuite),
+		"server_cert_serial": serial,
+		"peer_cert_count":    len(tlsState.PeerCertificates),
+	}).Info("TLS handshake completed")
+}
+
+// serverCert returns the certificate of our TlsConfig that was used for the
+// server name the client asked for, nil if we don't know.
+func (s *Mta) serverCert(serverName string) *x509.Certificate {
+	var first *x509.Certificate
+	for _, cert := range s.TlsConfig.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				continue
+			}
+		}
+		if leaf == nil {
+			continue
+		}
+		if first == nil {
+			first = leaf
+		}
+		if serverName != "" && leaf.VerifyHostname(serverName) == nil {
+			return leaf
+		}
+	}
+	// Like crypto/tls, use the first certificate if none matches.
+	return first
+}
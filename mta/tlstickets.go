@@ -0,0 +1,45 @@
+package mta
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// setupSessionTickets configures TLS session resumption for STARTTLS.
+func (s *Mta) setupSessionTickets(config *tls.Config) {
+	if !s.config.TLSSessionTicketsEnabled {
+		config.SessionTicketsDisabled = true
+		return
+	}
+	config.SessionTicketsDisabled = false
+	// Without a key crypto/tls uses random keys, rotated by itself.
+	if s.config.TLSSessionTicketKey != ([32]byte{}) {
+		s.ticketKeys = [][32]byte{s.config.TLSSessionTicketKey}
+		config.SetSessionTicketKeys(s.ticketKeys)
+	}
+}
+
+// RotateSessionTicketKey makes key the key for new TLS session tickets.
+// Tickets made with the previous key can still be used to resume sessions,
+// older ones can't. It should be called periodically, with the same keys on
+// all servers that share clients.
+func (s *Mta) RotateSessionTicketKey(key [32]byte) error {
+	if s.TlsConfig == nil || s.TlsConfig.SessionTicketsDisabled {
+		return errors.New("TLS session tickets are not enabled")
+	}
+
+	s.ticketLock.Lock()
+	defer s.ticketLock.Unlock()
+	keys := [][32]byte{key}
+	if len(s.ticketKeys) > 0 {
+		keys = append(keys, s.ticketKeys[0])
+	}
+	s.ticketKeys = keys
+	s.TlsConfig.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// RotateSessionTicketKey calls Mta.RotateSessionTicketKey.
+func (s *DefaultMta) RotateSessionTicketKey(key [32]byte) error {
+	return s.mta.RotateSessionTicketKey(key)
+}
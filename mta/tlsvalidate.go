@@ -0,0 +1,143 @@
+package mta
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WarningCode identifies a problem found by ValidateTLSConfig.
+type WarningCode string
+
+const (
+	// CertExpired is an error: clients that verify certificates will fail.
+	CertExpired WarningCode = "cert-expired"
+	// CertExpiresSoon means the certificate expires within 30 days.
+	CertExpiresSoon WarningCode = "cert-expires-soon"
+	// CertNoServerAuth means the certificate has extended key usages,
+	// but not ServerAuth.
+	CertNoServerAuth WarningCode = "cert-no-server-auth"
+	// CertHostnameMismatch means the hostname isn't in the CN or SANs.
+	CertHostnameMismatch WarningCode = "cert-hostname-mismatch"
+	// KeyTooSmall means the RSA key has less than 2048 bits.
+	KeyTooSmall WarningCode = "key-too-small"
+	// CertInvalid means the certificate could not be parsed.
+	CertInvalid WarningCode = "cert-invalid"
+)
+
+// Warning is a problem with the TLS configuration.
+type Warning struct {
+	Code    WarningCode
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Code, w.Message)
+}
+
+// IsError reports whether TLS can't work with the problem, instead of
+// working for some clients.
+func (w Warning) IsError() bool {
+	return w.Code == CertExpired || w.Code == CertInvalid
+}
+
+// TLSWarnings is the error returned by ValidateTLS.
+type TLSWarnings []Warning
+
+func (w TLSWarnings) Error() string {
+	messages := make([]string, len(w))
+	for i, warning := range w {
+		messages[i] = warning.String()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// certExpiryWarning is how long before the expiry of a certificate we warn.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// ValidateTLSConfig checks the certificates of a server TLS config.
+// The hostname is only checked if cfg.ServerName is set, New sets it to
+// Config.Hostname.
+func ValidateTLSConfig(cfg *tls.Config) []Warning {
+	return validateTLSConfig(cfg, time.Now())
+}
+
+func validateTLSConfig(cfg *tls.Config, now time.Time) []Warning {
+	warnings := []Warning{}
+	for _, cert := range cfg.Certificates {
+		warnings = append(warnings, validateCertificate(cert, cfg.ServerName, now)...)
+	}
+	return warnings
+}
+
+func validateCertificate(cert tls.Certificate, hostname string, now time.Time) []Warning {
+	if len(cert.Certificate) == 0 {
+		return []Warning{{CertInvalid, "no certificate"}}
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return []Warning{{CertInvalid, err.Error()}}
+		}
+	}
+
+	name := leaf.Subject.CommonName
+	if name == "" && len(leaf.DNSNames) > 0 {
+		name = leaf.DNSNames[0]
+	}
+	warnings := []Warning{}
+	add := func(code WarningCode, format string, a ...interface{}) {
+		warnings = append(warnings, Warning{code, fmt.Sprintf("certificate %q: ", name) + fmt.Sprintf(format, a...)})
+	}
+
+	if now.After(leaf.NotAfter) {
+		add(CertExpired, "expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	} else if leaf.NotAfter.Sub(now) < certExpiryWarning {
+		add(CertExpiresSoon, "expires on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	// Without extended key usages the certificate can be used for anything.
+	if len(leaf.ExtKeyUsage) > 0 && !hasServerAuth(leaf) {
+		add(CertNoServerAuth, "extended key usage doesn't include ServerAuth")
+	}
+
+	if hostname != "" && leaf.VerifyHostname(hostname) != nil && !strings.EqualFold(leaf.Subject.CommonName, hostname) {
+		add(CertHostnameMismatch, "not valid for %s", hostname)
+	}
+
+	if key, ok := leaf.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < 2048 {
+		add(KeyTooSmall, "RSA key has %d bits, use at least 2048", key.N.BitLen())
+	}
+
+	return warnings
+}
+
+func hasServerAuth(leaf *x509.Certificate) bool {
+	for _, usage := range leaf.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTLS loads a certificate and key like New does, and checks them
+// with ValidateTLSConfig. The error is a TLSWarnings if there were warnings.
+func ValidateTLS(certFile, keyFile, hostname string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	warnings := ValidateTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   hostname,
+	})
+	if len(warnings) > 0 {
+		return TLSWarnings(warnings)
+	}
+	return nil
+}
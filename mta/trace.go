@@ -0,0 +1,104 @@
+package mta
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// ProcessedCommand is a command of the client and our answer to it.
+type ProcessedCommand struct {
+	// Cmd is the command without secrets and data: the initial response of
+	// AUTH is replaced with redactedAuth, DATA and BDAT don't have a reader.
+	Cmd smtp.Cmd
+	// Response is the last answer to the command, e.g. the answer to the
+	// data for DATA. The lines of a multiline answer are joined with "\n".
+	// The zero Answer if the command wasn't answered.
+	Response smtp.Answer
+	// Timestamp is the time the command was read.
+	Timestamp time.Time
+}
+
+// SessionTrace holds the commands of a session, in the order they were read.
+type SessionTrace struct {
+	Commands []ProcessedCommand
+}
+
+// redactedAuth replaces the initial response of AUTH commands in a trace.
+const redactedAuth = "<redacted>"
+
+// traceRecorder records the commands read from a protocol and the answers
+// sent to them.
+type traceRecorder struct {
+	smtp.Protocol
+
+	// GetCmd runs in its own goroutine.
+	mutex sync.Mutex
+	trace SessionTrace
+}
+
+func newTraceRecorder(proto smtp.Protocol) *traceRecorder {
+	return &traceRecorder{Protocol: proto}
+}
+
+func (r *traceRecorder) GetCmd() (*smtp.Cmd, error) {
+	cmd, err := r.Protocol.GetCmd()
+	if err == nil && cmd != nil {
+		r.mutex.Lock()
+		r.trace.Commands = append(r.trace.Commands, ProcessedCommand{Cmd: traced(*cmd), Timestamp: time.Now()})
+		r.mutex.Unlock()
+	}
+	return cmd, err
+}
+
+// traced returns cmd as it is kept in a trace. The trace shouldn't contain
+// credentials, or keep the connection and mail data through the readers.
+func traced(cmd smtp.Cmd) smtp.Cmd {
+	switch c := cmd.(type) {
+	case smtp.AuthCmd:
+		if c.InitialResponse != "" {
+			c.InitialResponse = redactedAuth
+		}
+		return c
+	case smtp.DataCmd:
+		return smtp.DataCmd{}
+	case smtp.BdatCmd:
+		c.R = nil
+		return c
+	}
+	return cmd
+}
+
+func (r *traceRecorder) Send(cmd smtp.Cmd) {
+	r.Protocol.Send(cmd)
+
+	var answer smtp.Answer
+	switch a := cmd.(type) {
+	case smtp.Answer:
+		answer = a
+	case smtp.MultiAnswer:
+		answer = smtp.Answer{
+			Status:       a.Status,
+			EnhancedCode: a.EnhancedCode,
+			Message:      strings.Join(a.Messages, "\n"),
+		}
+	default:
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// The greeting doesn't answer a command.
+	if n := len(r.trace.Commands); n > 0 {
+		r.trace.Commands[n-1].Response = answer
+	}
+}
+
+// Trace returns the commands recorded so far.
+func (r *traceRecorder) Trace() SessionTrace {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return SessionTrace{Commands: append([]ProcessedCommand{}, r.trace.Commands...)}
+}
@@ -0,0 +1,87 @@
+package mta
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// canXForward checks if the client is allowed to use XFORWARD.
+func (s *Mta) canXForward(proto smtp.Protocol) bool {
+	return s.config.AcceptXFORWARD && ipInNets(proto.GetIP(), s.config.TrustedXFORWARDSources)
+}
+
+// handleXForward updates the state with the attributes of the original client.
+func (s *Mta) handleXForward(proto smtp.Protocol, state *smtp.State, cmd smtp.XForwardCmd) {
+	if !s.config.AcceptXFORWARD {
+		proto.Send(smtp.Answer{
+			Status:  smtp.SyntaxError,
+			Message: "Command not recognized",
+		})
+		return
+	}
+
+	// Use the ip of the connection, state.Ip could already be forwarded.
+	if !s.canXForward(proto) {
+		proto.Send(smtp.Answer{
+			Status:       smtp.MailboxUnavailable,
+			EnhancedCode: "5.7.1",
+			Message:      "XFORWARD not allowed",
+		})
+		return
+	}
+
+	if state.From != nil {
+		proto.Send(smtp.Answer{
+			Status:  smtp.BadSequence,
+			Message: "XFORWARD not permitted during a mail transaction",
+		})
+		return
+	}
+
+	for name, value := range cmd.Attributes {
+		switch name {
+		case "NAME", "ADDR", "PROTO", "HELO":
+		default:
+			proto.Send(smtp.Answer{
+				Status:  smtp.SyntaxErrorParam,
+				Message: "Bad XFORWARD attribute name: " + name,
+			})
+			return
+		}
+
+		if name == "ADDR" && value != "[UNAVAILABLE]" && value != "[TEMPUNAVAIL]" {
+			if net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:")) == nil {
+				proto.Send(smtp.Answer{
+					Status:  smtp.SyntaxErrorParam,
+					Message: "Bad XFORWARD address: " + value,
+				})
+				return
+			}
+		}
+	}
+
+	for name, value := range cmd.Attributes {
+		// The original client information is not available.
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			continue
+		}
+
+		switch name {
+		case "NAME":
+			state.ClientName = value
+		case "ADDR":
+			state.Ip = net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:"))
+		case "PROTO":
+			state.Proto = strings.ToUpper(value)
+		case "HELO":
+			state.Hostname = value
+		}
+	}
+
+	proto.Send(smtp.Answer{
+		Status:  smtp.Ok,
+		Message: "OK",
+	})
+}
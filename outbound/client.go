@@ -0,0 +1,466 @@
+// Package outbound sends mail to other SMTP servers.
+package outbound
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Client delivers mails to an SMTP server.
+type Client struct {
+	// Hostname is sent in EHLO, "localhost" if empty.
+	Hostname string
+	// Timeout is the maximum time for connecting and for the whole
+	// transaction. With a Pool it is the maximum time for every read and
+	// write instead. 0 for no timeout.
+	Timeout time.Duration
+	// RequireTLS fails the delivery if the server doesn't offer STARTTLS,
+	// or if the TLS handshake fails.
+	RequireTLS bool
+	// DisableOpportunisticTLS doesn't use STARTTLS unless TLS is required.
+	// By default STARTTLS is used when the server offers it, without
+	// verifying the certificate, and the mail is sent in plaintext if the
+	// TLS handshake fails.
+	DisableOpportunisticTLS bool
+	// ImplicitTLS starts TLS right after connecting (SMTPS, e.g. port 465),
+	// instead of with STARTTLS.
+	ImplicitTLS bool
+	// HonorTLSRequired requires TLS for every mail, unless the mail has a
+	// "TLS-Required: No" header field (RFC 8689). Those mails are sent even
+	// if TLS fails, RequireTLS and MTA-STS policies are ignored for them.
+	// Mails with State.RequireTLS ignore the header field.
+	HonorTLSRequired bool
+	// TLSConfig is used for TLS. The ServerName defaults to the
+	// host we connect to.
+	TLSConfig *tls.Config
+	// Auth authenticates us to the server. Nil to not authenticate.
+	// net/smtp only sends PLAIN credentials over TLS or to localhost.
+	Auth netsmtp.Auth
+	// MTASTS fetches the MTA-STS policy (RFC 8461) of the domain of the
+	// recipients. Nil to not check policies, e.g. for a smarthost.
+	MTASTS MTASTSFetcher
+	// MXResolver looks up the MX records for MXDelivery, net.DefaultResolver
+	// if nil.
+	MXResolver MXResolver
+	// MaxMXAttempts is the maximum number of MX hosts MXDelivery tries.
+	// 0 tries all of them.
+	MaxMXAttempts int
+	// MXPort is the port MXDelivery connects to, 25 if 0.
+	MXPort int
+	// MaxRetries is the number of times Deliver sends the mail again over a
+	// new connection, with the same envelope, when the server answers 421
+	// (service not available) and closes the connection. 0 for no retries.
+	MaxRetries int
+	// Pool keeps the connections open after a mail was sent, for the next
+	// mail to the same address. Connections from the pool are only used if
+	// they have the TLS the mail needs. Nil to close every connection.
+	Pool *ConnectionPool
+}
+
+// PermanentError is returned when the server rejected the mail with a 5xx
+// answer, the mail should not be retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Deliver sends the mail in state to the server at addr ("host:port").
+// The mail data is sent with CRLF line endings.
+//
+// Mails with State.RequireTLS (RFC 8689) are only sent over TLS with a
+// verified certificate, to a server that supports REQUIRETLS. Otherwise
+// a PermanentError is returned, so the mail bounces instead of being sent
+// in the clear.
+//
+// If the domain of the recipients has an MTA-STS policy in enforce mode,
+// the mail is only sent to an MX of the policy, over STARTTLS with a
+// verified certificate. Otherwise an error is returned, so the mail can be
+// retried later.
+//
+// With HonorTLSRequired, mails without a "TLS-Required: No" header field
+// are only sent over TLS, like with RequireTLS.
+//
+// Other mails use STARTTLS if the server offers it, unless
+// DisableOpportunisticTLS is set. The certificate isn't verified then, and
+// if the handshake fails the mail is sent again over a new plaintext
+// connection.
+func (c *Client) Deliver(addr string, state *smtp.State) error {
+	if state.From == nil {
+		return errors.New("outbound: mail has no sender")
+	}
+	if len(state.To) == 0 {
+		return errors.New("outbound: mail has no recipients")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	policy, err := c.tlsPolicy(host, state)
+	if err != nil {
+		return err
+	}
+
+	err = c.deliver(addr, host, state, policy, true)
+	for retries := 0; ; retries++ {
+		var tlsErr opportunisticTLSError
+		if errors.As(err, &tlsErr) {
+			log.WithFields(log.Fields{
+				"Host": host,
+			}).Warnf("STARTTLS failed, sending in plaintext: %v", tlsErr.Err)
+			policy.opportunistic = false
+			err = c.deliver(addr, host, state, policy, false)
+		}
+		if !isServiceNotAvailable(err) || retries >= c.MaxRetries {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"Host": host,
+		}).Warnf("Server closed the connection, sending again (retry %d of %d): %v", retries+1, c.MaxRetries, err)
+		err = c.deliver(addr, host, state, policy, false)
+	}
+}
+
+// isServiceNotAvailable tells if err is a 421 answer of the server, which
+// closes the connection after it (RFC 5321 3.8).
+func isServiceNotAvailable(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == 421
+}
+
+// tlsPolicy is how TLS is used to deliver a mail.
+type tlsPolicy struct {
+	// require fails the delivery without TLS.
+	require bool
+	// verify always verifies the certificate of the server.
+	verify bool
+	// opportunistic uses STARTTLS if the server offers it, without verifying
+	// the certificate, and falls back to plaintext if the handshake fails.
+	opportunistic bool
+}
+
+// tlsPolicy returns the tlsPolicy for delivering the mail in state to host.
+// It returns an error if the MTA-STS policy of the recipients doesn't allow
+// host.
+func (c *Client) tlsPolicy(host string, state *smtp.State) (tlsPolicy, error) {
+	policy := tlsPolicy{
+		require:       c.RequireTLS || state.RequireTLS,
+		verify:        state.RequireTLS,
+		opportunistic: !c.DisableOpportunisticTLS,
+	}
+	if c.HonorTLSRequired && !state.RequireTLS {
+		if tlsRequiredNo(state.Data) {
+			// RFC 8689 5: the sender prefers delivery over TLS policies.
+			policy.require = false
+			return policy, nil
+		}
+		policy.require = true
+	}
+
+	enforce, err := c.enforceMTASTS(host, state)
+	if err != nil {
+		return policy, err
+	}
+	if enforce {
+		policy.require = true
+		policy.verify = true
+	}
+	return policy, nil
+}
+
+// tlsRequiredNo tells if the header of data has a "TLS-Required: No" field
+// (RFC 8689 5).
+func tlsRequiredNo(data []byte) bool {
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			// The end of the header.
+			return false
+		}
+
+		name := []byte("TLS-Required:")
+		if len(line) >= len(name) && bytes.EqualFold(line[:len(name)], name) {
+			return strings.EqualFold(strings.TrimSpace(string(line[len(name):])), "No")
+		}
+	}
+	return false
+}
+
+// opportunisticTLSError is returned by send when the handshake of an
+// opportunistic STARTTLS failed. The connection can't be used anymore.
+type opportunisticTLSError struct {
+	Err error
+}
+
+func (e opportunisticTLSError) Error() string {
+	return e.Err.Error()
+}
+
+// deliver sends the mail over a connection to addr, using TLS like policy
+// says. With pooled the connection can come from the Pool, otherwise it is a
+// new one.
+func (c *Client) deliver(addr, host string, state *smtp.State, policy tlsPolicy, pooled bool) error {
+	if c.Pool != nil && pooled {
+		if client, err := c.Pool.Get(addr); err == nil {
+			if policy.allows(client) {
+				return c.finish(addr, client, c.transaction(client, host, state))
+			}
+			c.Pool.Put(addr, client)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if c.Timeout > 0 {
+		if c.Pool != nil {
+			conn = &deadlineConn{Conn: conn, timeout: c.Timeout}
+		} else {
+			conn.SetDeadline(time.Now().Add(c.Timeout))
+		}
+	}
+	if c.ImplicitTLS {
+		tlsConn := tls.Client(conn, c.tlsConfig(host, policy.verify))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return requireTLSError(state, err)
+		}
+		conn = tlsConn
+	}
+
+	client, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return wrapError(err)
+	}
+	if err := c.setup(client, host, state, policy); err != nil {
+		client.Close()
+		return wrapError(err)
+	}
+	return c.finish(addr, client, c.transaction(client, host, state))
+}
+
+// DeliverReversed sends the mails in states over conn, a connection on
+// which the roles were reversed with ATRN (RFC 2645): the other side is the
+// server now and starts with its greeting. The TLS settings, MTA-STS and the
+// Pool are not used, conn keeps the TLS it has. Mails with State.RequireTLS
+// should only be passed if it has TLS.
+//
+// It returns the error for every mail, nil if it was delivered. The
+// connection is closed when done, after a QUIT if it still works.
+func (c *Client) DeliverReversed(conn net.Conn, host string, states []*smtp.State) []error {
+	errs := make([]error, len(states))
+	fail := func(from int, err error) []error {
+		for i := from; i < len(errs); i++ {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	if c.Timeout > 0 {
+		conn = &deadlineConn{Conn: conn, timeout: c.Timeout}
+	}
+	client, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fail(0, wrapError(err))
+	}
+	defer client.Close()
+	if err := c.setup(client, host, &smtp.State{}, tlsPolicy{}); err != nil {
+		return fail(0, wrapError(err))
+	}
+
+	for i, state := range states {
+		if err := c.transaction(client, host, state); err != nil {
+			errs[i] = wrapError(err)
+			// The other mails can still be sent, unless the connection broke.
+			if err := client.Reset(); err != nil {
+				return fail(i+1, err)
+			}
+		}
+	}
+	client.Quit()
+	return errs
+}
+
+// finish is called when the transaction on client ended with err. The
+// connection is put in the Pool if the transaction succeeded, otherwise it is
+// closed.
+func (c *Client) finish(addr string, client *netsmtp.Client, err error) error {
+	if err != nil {
+		client.Close()
+		return wrapError(err)
+	}
+	if c.Pool != nil {
+		c.Pool.Put(addr, client)
+		return nil
+	}
+	err = client.Quit()
+	client.Close()
+	return wrapError(err)
+}
+
+// allows tells if a connection from the pool has the TLS the policy needs.
+func (p tlsPolicy) allows(client *netsmtp.Client) bool {
+	state, ok := client.TLSConnectionState()
+	if p.require && !ok {
+		return false
+	}
+	return !p.verify || len(state.VerifiedChains) > 0
+}
+
+// setup greets the server on a new connection, starts TLS like policy says
+// and authenticates.
+func (c *Client) setup(client *netsmtp.Client, host string, state *smtp.State, policy tlsPolicy) error {
+	hostname := c.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if err := client.Hello(hostname); err != nil {
+		return err
+	}
+
+	if policy.require && !c.ImplicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return requireTLSError(state, fmt.Errorf("outbound: %s doesn't support STARTTLS, TLS is required", host))
+		}
+		if err := client.StartTLS(c.tlsConfig(host, policy.verify)); err != nil {
+			return requireTLSError(state, fmt.Errorf("outbound: STARTTLS with %s failed, TLS is required: %w", host, err))
+		}
+	} else if policy.opportunistic && !c.ImplicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			// Encrypting without verifying still beats plaintext (RFC 7435).
+			config := c.tlsConfig(host, false)
+			config.InsecureSkipVerify = true
+			if err := client.StartTLS(config); err != nil {
+				return opportunisticTLSError{Err: err}
+			}
+		}
+	}
+
+	if c.Auth != nil {
+		if err := client.Auth(c.Auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transaction sends the mail in state over a connection that was set up.
+func (c *Client) transaction(client *netsmtp.Client, host string, state *smtp.State) error {
+	if state.RequireTLS {
+		if ok, _ := client.Extension("REQUIRETLS"); !ok {
+			return PermanentError{Err: fmt.Errorf("outbound: %s doesn't support REQUIRETLS", host)}
+		}
+		// net/smtp can't add parameters to MAIL.
+		id, err := client.Text.Cmd("MAIL FROM:<%s> REQUIRETLS", state.From.GetAddress())
+		if err != nil {
+			return err
+		}
+		client.Text.StartResponse(id)
+		_, _, err = client.Text.ReadResponse(250)
+		client.Text.EndResponse(id)
+		if err != nil {
+			return err
+		}
+	} else if err := client.Mail(state.From.GetAddress()); err != nil {
+		return err
+	}
+	for _, to := range state.To {
+		if err := client.Rcpt(to.GetAddress()); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(state.Data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// tlsConfig returns the TLSConfig for a connection to host. With verify the
+// certificate is always verified.
+func (c *Client) tlsConfig(host string, verify bool) *tls.Config {
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if verify {
+		config.InsecureSkipVerify = false
+	}
+	return config
+}
+
+// enforceMTASTS tells if the MTA-STS policy of the domain of the recipients
+// has to be enforced, and returns an error if host is not an MX of the
+// policy. Policies that can't be fetched are ignored.
+func (c *Client) enforceMTASTS(host string, state *smtp.State) (bool, error) {
+	if c.MTASTS == nil {
+		return false, nil
+	}
+	domain := state.To[0].GetDomain()
+	for _, to := range state.To[1:] {
+		if !strings.EqualFold(to.GetDomain(), domain) {
+			return false, fmt.Errorf("outbound: recipients in more than one domain: %s and %s", domain, to.GetDomain())
+		}
+	}
+
+	policy, err := c.MTASTS.Fetch(domain)
+	if err != nil || policy == nil || policy.Mode != MTASTSEnforce {
+		return false, nil
+	}
+	if !policy.Match(host) {
+		return false, fmt.Errorf("outbound: %s is not an MX in the MTA-STS policy of %s", host, domain)
+	}
+	return true, nil
+}
+
+// requireTLSError makes TLS failures permanent for mails with RequireTLS.
+func requireTLSError(state *smtp.State, err error) error {
+	if state.RequireTLS {
+		return PermanentError{Err: err}
+	}
+	return err
+}
+
+// wrapError makes 5xx answers of the server a PermanentError.
+func wrapError(err error) error {
+	if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code >= 500 {
+		return PermanentError{Err: err}
+	}
+	return err
+}
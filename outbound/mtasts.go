@@ -0,0 +1,264 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTA-STS policy modes (RFC 8461).
+const (
+	MTASTSEnforce = "enforce"
+	MTASTSTesting = "testing"
+	MTASTSNone    = "none"
+)
+
+// maxPolicySize is the maximum size of a policy file.
+const maxPolicySize = 64 << 10
+
+// maxPolicyAge is the maximum max_age of a policy, about a year.
+const maxPolicyAge = 31557600 * time.Second
+
+// MTASTSPolicy is the MTA-STS policy of a domain.
+type MTASTSPolicy struct {
+	Mode string
+	// MX are the patterns of the mail servers of the domain,
+	// e.g. "mx.example.com" or "*.example.com".
+	MX     []string
+	MaxAge time.Duration
+}
+
+// Match tells if the mail server host is one of the MX of the policy.
+// A wildcard only matches the leftmost label.
+func (p *MTASTSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.MX {
+		mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+		if strings.HasPrefix(mx, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && host[i+1:] == mx[2:] {
+				return true
+			}
+		} else if host == mx {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMTASTSPolicy parses a policy file.
+func ParseMTASTSPolicy(r io.Reader) (*MTASTSPolicy, error) {
+	policy := &MTASTSPolicy{}
+	version := ""
+	maxAge := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("outbound: invalid MTA-STS policy line %q", line)
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch line[:i] {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			maxAge = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("outbound: unsupported MTA-STS policy version %q", version)
+	}
+	switch policy.Mode {
+	case MTASTSEnforce, MTASTSTesting:
+		if len(policy.MX) == 0 {
+			return nil, errors.New("outbound: MTA-STS policy has no mx")
+		}
+	case MTASTSNone:
+	default:
+		return nil, fmt.Errorf("outbound: invalid MTA-STS policy mode %q", policy.Mode)
+	}
+	seconds, err := strconv.ParseUint(maxAge, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("outbound: invalid MTA-STS policy max_age %q", maxAge)
+	}
+	policy.MaxAge = time.Duration(seconds) * time.Second
+	if policy.MaxAge > maxPolicyAge {
+		policy.MaxAge = maxPolicyAge
+	}
+	return policy, nil
+}
+
+// MTASTSFetcher fetches the MTA-STS policy of a domain.
+// Domains without a policy have a nil policy and no error.
+type MTASTSFetcher interface {
+	Fetch(domain string) (*MTASTSPolicy, error)
+}
+
+// TXTResolver looks up TXT records, e.g. a net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type cachedPolicy struct {
+	id      string
+	policy  *MTASTSPolicy
+	expires time.Time
+}
+
+// mtastsFetcher looks up the "_mta-sts" TXT record of a domain and fetches
+// the policy from "https://mta-sts.<domain>/.well-known/mta-sts.txt".
+// Policies are cached for their max_age, and only fetched again when the id
+// in the TXT record changes.
+type mtastsFetcher struct {
+	resolver TXTResolver
+	client   *http.Client
+	timeout  time.Duration
+	now      func() time.Time
+
+	lock  sync.Mutex
+	cache map[string]cachedPolicy
+}
+
+// NewMTASTSFetcher creates an MTASTSFetcher. If resolver is nil
+// net.DefaultResolver is used, if client is nil a new http.Client.
+func NewMTASTSFetcher(resolver TXTResolver, client *http.Client) MTASTSFetcher {
+	return newMTASTSFetcher(resolver, client)
+}
+
+func newMTASTSFetcher(resolver TXTResolver, client *http.Client) *mtastsFetcher {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if client == nil {
+		client = &http.Client{}
+	} else {
+		copied := *client
+		client = &copied
+	}
+	// Redirects are not allowed (RFC 8461, section 3.3).
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &mtastsFetcher{
+		resolver: resolver,
+		client:   client,
+		timeout:  time.Minute,
+		now:      time.Now,
+		cache:    map[string]cachedPolicy{},
+	}
+}
+
+func (f *mtastsFetcher) Fetch(domain string) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	f.lock.Lock()
+	cached, ok := f.cache[domain]
+	f.lock.Unlock()
+	if ok && f.now().After(cached.expires) {
+		ok = false
+	}
+
+	id, err := f.lookupID(ctx, domain)
+	if err != nil || id == "" {
+		// Without a record a cached policy is still used until it expires.
+		if ok {
+			return cached.policy, nil
+		}
+		return nil, err
+	}
+	if ok && id == cached.id {
+		return cached.policy, nil
+	}
+
+	policy, err := f.fetchPolicy(ctx, domain)
+	if err != nil {
+		if ok {
+			return cached.policy, nil
+		}
+		return nil, err
+	}
+
+	f.lock.Lock()
+	f.cache[domain] = cachedPolicy{
+		id:      id,
+		policy:  policy,
+		expires: f.now().Add(policy.MaxAge),
+	}
+	f.lock.Unlock()
+	return policy, nil
+}
+
+// lookupID returns the id of the TXT record of the domain, "" if the domain
+// has no valid record.
+func (f *mtastsFetcher) lookupID(ctx context.Context, domain string) (string, error) {
+	records, err := f.resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+
+	id := ""
+	found := 0
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1;") && record != "v=STSv1" {
+			continue
+		}
+		found++
+		for _, field := range strings.Split(record, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = field[len("id="):]
+			}
+		}
+	}
+	// Several records are an invalid policy (RFC 8461, section 3.1).
+	if found != 1 {
+		return "", nil
+	}
+	return id, nil
+}
+
+func (f *mtastsFetcher) fetchPolicy(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("outbound: could not fetch %s: %s", url, resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		return nil, fmt.Errorf("outbound: %s is not text/plain", url)
+	}
+	return ParseMTASTSPolicy(io.LimitReader(resp.Body, maxPolicySize))
+}
@@ -0,0 +1,138 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+type stubTXTResolver struct {
+	records map[string][]string
+}
+
+func (r *stubTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	c.Convey("Testing MTA-STS policy parsing", t, func() {
+		policy, err := ParseMTASTSPolicy(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 604800\r\n"))
+		c.So(err, c.ShouldBeNil)
+		c.So(policy, c.ShouldResemble, &MTASTSPolicy{
+			Mode:   MTASTSEnforce,
+			MX:     []string{"mail.example.com", "*.example.net"},
+			MaxAge: 7 * 24 * time.Hour,
+		})
+
+		c.So(policy.Match("mail.example.com"), c.ShouldBeTrue)
+		c.So(policy.Match("MAIL.example.com."), c.ShouldBeTrue)
+		c.So(policy.Match("mx1.example.net"), c.ShouldBeTrue)
+		c.So(policy.Match("example.net"), c.ShouldBeFalse)
+		c.So(policy.Match("a.mx1.example.net"), c.ShouldBeFalse)
+		c.So(policy.Match("mail.example.org"), c.ShouldBeFalse)
+
+		invalid := []string{
+			"mode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+			"version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 86400\n",
+			"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+			"version: STSv1\nmode: enforce\nmx: mail.example.com\n",
+			"version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\ngarbage\n",
+		}
+		for _, policy := range invalid {
+			_, err := ParseMTASTSPolicy(strings.NewReader(policy))
+			c.So(err, c.ShouldNotBeNil)
+		}
+	})
+}
+
+func TestMTASTSFetcher(t *testing.T) {
+	c.Convey("Testing MTA-STS policy fetching", t, func() {
+		fetches := 0
+		body := "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 3600\n"
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches++
+			if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(body))
+		}))
+		defer srv.Close()
+
+		// All hosts are served by the test server.
+		client := srv.Client()
+		client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, srv.Listener.Addr().String())
+		}
+
+		resolver := &stubTXTResolver{records: map[string][]string{
+			"_mta-sts.example.com": {"v=STSv1; id=1"},
+			"_mta-sts.example.org": {"v=STSv1; id=1"},
+		}}
+		now := time.Now()
+		f := newMTASTSFetcher(resolver, client)
+		f.now = func() time.Time { return now }
+
+		c.Convey("Policies are fetched", func() {
+			policy, err := f.Fetch("example.com")
+			c.So(err, c.ShouldBeNil)
+			c.So(policy.Mode, c.ShouldEqual, MTASTSEnforce)
+			c.So(policy.MX, c.ShouldResemble, []string{"mail.example.com"})
+			c.So(fetches, c.ShouldEqual, 1)
+		})
+
+		c.Convey("Domains without a record have no policy", func() {
+			policy, err := f.Fetch("example.net")
+			c.So(err, c.ShouldBeNil)
+			c.So(policy, c.ShouldBeNil)
+			c.So(fetches, c.ShouldEqual, 0)
+		})
+
+		c.Convey("Policies that can't be fetched are errors", func() {
+			_, err := f.Fetch("example.org")
+			c.So(err, c.ShouldNotBeNil)
+		})
+
+		c.Convey("Policies are cached for max_age", func() {
+			f.Fetch("example.com")
+			body = "version: STSv1\nmode: none\nmax_age: 3600\n"
+
+			policy, err := f.Fetch("example.com")
+			c.So(err, c.ShouldBeNil)
+			c.So(policy.Mode, c.ShouldEqual, MTASTSEnforce)
+			c.So(fetches, c.ShouldEqual, 1)
+
+			// A cached policy is kept when the record is gone.
+			delete(resolver.records, "_mta-sts.example.com")
+			policy, _ = f.Fetch("example.com")
+			c.So(policy.Mode, c.ShouldEqual, MTASTSEnforce)
+
+			now = now.Add(2 * time.Hour)
+			policy, err = f.Fetch("example.com")
+			c.So(err, c.ShouldBeNil)
+			c.So(policy, c.ShouldBeNil)
+		})
+
+		c.Convey("Policies are fetched again when the id changes", func() {
+			f.Fetch("example.com")
+			body = "version: STSv1\nmode: none\nmax_age: 3600\n"
+			resolver.records["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+
+			policy, err := f.Fetch("example.com")
+			c.So(err, c.ShouldBeNil)
+			c.So(policy.Mode, c.ShouldEqual, MTASTSNone)
+			c.So(fetches, c.ShouldEqual, 2)
+		})
+	})
+}
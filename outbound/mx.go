@@ -0,0 +1,96 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// MXResolver looks up MX records, e.g. a net.Resolver.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// MXDelivery delivers the mail in state to the mail servers of domain
+// (RFC 5321, section 5.1). The MX hosts are tried from the lowest
+// preference, hosts with the same preference in random order. The next host
+// is tried when a host can't be reached or fails temporarily, at most
+// MaxMXAttempts hosts. A domain without MX records is its own mail server.
+//
+// A PermanentError is returned when a server rejected the mail, or the
+// domain doesn't accept mail (a null MX, RFC 7505).
+func (c *Client) MXDelivery(ctx context.Context, domain string, state *smtp.State) error {
+	resolver := c.MXResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	port := c.MXPort
+	if port == 0 {
+		port = 25
+	}
+
+	hosts, err := lookupMX(ctx, resolver, domain)
+	if err != nil {
+		return err
+	}
+	if c.MaxMXAttempts > 0 && len(hosts) > c.MaxMXAttempts {
+		hosts = hosts[:c.MaxMXAttempts]
+	}
+
+	for _, host := range hosts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err = c.Deliver(net.JoinHostPort(host, strconv.Itoa(port)), state)
+		var permErr PermanentError
+		if err == nil || errors.As(err, &permErr) {
+			return err
+		}
+	}
+	return err
+}
+
+// lookupMX returns the MX hosts of domain in the order to try them.
+func lookupMX(ctx context.Context, resolver MXResolver, domain string) ([]string, error) {
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	if len(mxs) == 0 {
+		// The implicit MX.
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, PermanentError{Err: fmt.Errorf("outbound: %s doesn't accept mail", domain)}
+	}
+
+	mxs = sortMX(mxs)
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// sortMX sorts MX records by preference, and shuffles the ones with the
+// same preference to spread the load.
+func sortMX(mxs []*net.MX) []*net.MX {
+	sorted := make([]*net.MX, len(mxs))
+	copy(sorted, mxs)
+	rand.Shuffle(len(sorted), func(i, j int) {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	})
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Pref < sorted[j].Pref
+	})
+	return sorted
+}
@@ -0,0 +1,61 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+type stubMXResolver struct {
+	mxs []*net.MX
+	err error
+}
+
+func (r stubMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.mxs, r.err
+}
+
+func TestLookupMX(t *testing.T) {
+	c.Convey("Testing MX selection", t, func() {
+		c.Convey("MX hosts are sorted by preference", func() {
+			resolver := stubMXResolver{mxs: []*net.MX{
+				{Host: "backup.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 10},
+			}}
+			seen := map[string]bool{}
+			for i := 0; i < 100; i++ {
+				hosts, err := lookupMX(context.Background(), resolver, "example.com")
+				c.So(err, c.ShouldBeNil)
+				c.So(hosts, c.ShouldHaveLength, 3)
+				c.So(hosts[:2], c.ShouldContain, "mx1.example.com")
+				c.So(hosts[:2], c.ShouldContain, "mx2.example.com")
+				c.So(hosts[2], c.ShouldEqual, "backup.example.com")
+				seen[hosts[0]] = true
+			}
+			// Hosts with the same preference are shuffled.
+			c.So(seen, c.ShouldHaveLength, 2)
+		})
+
+		c.Convey("Domains without MX records are their own MX", func() {
+			resolver := stubMXResolver{err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}
+			hosts, err := lookupMX(context.Background(), resolver, "example.com")
+			c.So(err, c.ShouldBeNil)
+			c.So(hosts, c.ShouldResemble, []string{"example.com"})
+		})
+
+		c.Convey("Domains with a null MX don't accept mail", func() {
+			resolver := stubMXResolver{mxs: []*net.MX{{Host: ".", Pref: 0}}}
+			_, err := lookupMX(context.Background(), resolver, "example.com")
+			c.So(err, c.ShouldHaveSameTypeAs, PermanentError{})
+		})
+
+		c.Convey("Lookup errors are returned", func() {
+			resolver := stubMXResolver{err: &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}}
+			_, err := lookupMX(context.Background(), resolver, "example.com")
+			c.So(err, c.ShouldNotBeNil)
+		})
+	})
+}
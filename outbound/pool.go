@@ -0,0 +1,169 @@
+package outbound
+
+import (
+	"errors"
+	"net"
+	netsmtp "net/smtp"
+	"sync"
+	"time"
+)
+
+// ErrNoIdleConnection is returned by ConnectionPool.Get when there is no
+// usable idle connection to the host.
+var ErrNoIdleConnection = errors.New("outbound: no idle connection")
+
+// ConnectionPool keeps connections to SMTP servers open after a mail was
+// sent, so the next mail to the same server doesn't need a new connection.
+// A pool should only be shared by Clients with the same settings, the
+// connections are already greeted, encrypted and authenticated.
+// It is safe for concurrent use.
+type ConnectionPool struct {
+	// MaxConnectionsPerHost is the maximum number of idle connections that
+	// are kept per host, the others are closed. Defaults to 1.
+	MaxConnectionsPerHost int
+	// ConnectionIdleTimeout is how long a connection is kept when it isn't
+	// used. Defaults to 30 seconds, servers close idle connections after a
+	// few minutes (RFC 5321 4.5.3.2.7).
+	ConnectionIdleTimeout time.Duration
+
+	mutex sync.Mutex
+	idle  map[string][]*idleConnection
+}
+
+// idleConnection is a connection in the pool, it is closed when timer fires.
+type idleConnection struct {
+	client *netsmtp.Client
+	timer  *time.Timer
+}
+
+// Get returns an idle connection to host, the address it was put with.
+// The connection is checked with NOOP first. Returns ErrNoIdleConnection if
+// there is none, a new connection has to be made then.
+func (p *ConnectionPool) Get(host string) (*netsmtp.Client, error) {
+	for {
+		conn := p.take(host)
+		if conn == nil {
+			return nil, ErrNoIdleConnection
+		}
+		if err := conn.client.Noop(); err != nil {
+			conn.client.Close()
+			continue
+		}
+		return conn.client, nil
+	}
+}
+
+// take removes the newest idle connection to host from the pool, nil if
+// there is none.
+func (p *ConnectionPool) take(host string) *idleConnection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for conns := p.idle[host]; len(conns) > 0; conns = p.idle[host] {
+		conn := conns[len(conns)-1]
+		p.remove(host, conn)
+		// Otherwise it is being closed.
+		if conn.timer.Stop() {
+			return conn
+		}
+	}
+	return nil
+}
+
+// Put adds a connection to host that can be used for a new mail to the pool.
+// It is closed if the pool already has MaxConnectionsPerHost connections to
+// host.
+func (p *ConnectionPool) Put(host string, client *netsmtp.Client) {
+	if !p.add(host, client) {
+		client.Quit()
+		client.Close()
+	}
+}
+
+// add adds client to the idle connections to host, false if there are too many.
+func (p *ConnectionPool) add(host string, client *netsmtp.Client) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.idle[host]) >= p.maxConnectionsPerHost() {
+		return false
+	}
+	if p.idle == nil {
+		p.idle = map[string][]*idleConnection{}
+	}
+	conn := &idleConnection{client: client}
+	conn.timer = time.AfterFunc(p.connectionIdleTimeout(), func() {
+		p.mutex.Lock()
+		p.remove(host, conn)
+		p.mutex.Unlock()
+		client.Quit()
+		client.Close()
+	})
+	p.idle[host] = append(p.idle[host], conn)
+	return true
+}
+
+// Close closes the idle connections. The pool can still be used afterwards.
+func (p *ConnectionPool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+
+	for _, conns := range idle {
+		for _, conn := range conns {
+			if conn.timer.Stop() {
+				conn.client.Quit()
+				conn.client.Close()
+			}
+		}
+	}
+}
+
+// remove removes conn from the idle connections to host, if it is there.
+// The mutex has to be locked.
+func (p *ConnectionPool) remove(host string, conn *idleConnection) {
+	conns := p.idle[host]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.idle, host)
+		return
+	}
+	p.idle[host] = conns
+}
+
+func (p *ConnectionPool) maxConnectionsPerHost() int {
+	if p.MaxConnectionsPerHost <= 0 {
+		return 1
+	}
+	return p.MaxConnectionsPerHost
+}
+
+func (p *ConnectionPool) connectionIdleTimeout() time.Duration {
+	if p.ConnectionIdleTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return p.ConnectionIdleTimeout
+}
+
+// deadlineConn moves the deadline before every read and write, for
+// connections that are used for more than one mail.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,214 @@
+// Package persist stores the mail queue on disk, so accepted mails survive
+// a crash of the server.
+package persist
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+	bolt "go.etcd.io/bbolt"
+)
+
+var queueBucket = []byte("queue")
+
+// ErrNotFound is returned by Get for a mail that is not in the queue.
+var ErrNotFound = errors.New("Mail not found in queue")
+
+// BoltQueue is an mta.Queue in a BoltDB file.
+type BoltQueue struct {
+	db *bolt.DB
+}
+
+var _ mta.Queue = (*BoltQueue)(nil)
+
+// record is how a mail is stored, smtp.State has fields that can't be serialised.
+// Only the Address of the MailAddresses is stored, the Name is dropped:
+// envelope addresses don't have a display name, smtp.ParseAddress never sets it.
+type record struct {
+	From            string
+	OriginalFrom    string
+	To              []string
+	OriginalTo      []string
+	Data            []byte
+	EightBitMIME    bool
+	Secure          bool
+	SessionId       smtp.Id
+	Ip              net.IP
+	Hostname        string
+	Proto           string
+	ClientName      string
+	FCrDNSOk        bool
+	Authenticated   bool
+	AuthUser        string
+	DMARCResult     string
+	RateLimitGroup  string
+	PipelinedBefore bool
+	DataStart       time.Time
+	RequireTLS      bool
+	DKIMResults     []smtp.DKIMResult
+}
+
+// NewBoltQueue opens the queue in the file at path, it is created if it doesn't exist.
+// Mails that are still in the queue are handled again when the Mta starts.
+func NewBoltQueue(path string) (*BoltQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(queueBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltQueue{db: db}, nil
+}
+
+// Close closes the file, the queue can't be used anymore.
+func (q *BoltQueue) Close() error {
+	return q.db.Close()
+}
+
+func (q *BoltQueue) Put(state *smtp.State) (uint64, error) {
+	value, err := json.Marshal(newRecord(state))
+	if err != nil {
+		return 0, err
+	}
+
+	var id uint64
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queueBucket)
+		id, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(key(id), value)
+	})
+	return id, err
+}
+
+func (q *BoltQueue) Get(id uint64) (*smtp.State, error) {
+	var value []byte
+	err := q.db.View(func(tx *bolt.Tx) error {
+		// The value is only valid during the transaction.
+		if v := tx.Bucket(queueBucket).Get(key(id)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, ErrNotFound
+	}
+
+	r := record{}
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, err
+	}
+	return r.state(), nil
+}
+
+func (q *BoltQueue) Delete(id uint64) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).Delete(key(id))
+	})
+}
+
+func (q *BoltQueue) Ids() ([]uint64, error) {
+	ids := []uint64{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+			ids = append(ids, binary.BigEndian.Uint64(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// key returns the key for an id, big endian so the keys are sorted by id.
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func newRecord(state *smtp.State) record {
+	r := record{
+		To:              make([]string, len(state.To)),
+		Data:            state.Data,
+		EightBitMIME:    state.EightBitMIME,
+		Secure:          state.Secure,
+		SessionId:       state.SessionId,
+		Ip:              state.Ip,
+		Hostname:        state.Hostname,
+		Proto:           state.Proto,
+		ClientName:      state.ClientName,
+		FCrDNSOk:        state.FCrDNSOk,
+		Authenticated:   state.Authenticated,
+		AuthUser:        state.AuthUser,
+		DMARCResult:     state.DMARCResult,
+		RateLimitGroup:  state.RateLimitGroup,
+		PipelinedBefore: state.PipelinedBefore,
+		DataStart:       state.DataStart,
+		RequireTLS:      state.RequireTLS,
+		DKIMResults:     state.DKIMResults,
+	}
+	if state.From != nil {
+		r.From = state.From.GetAddress()
+	}
+	if state.OriginalFrom != nil {
+		r.OriginalFrom = state.OriginalFrom.GetAddress()
+	}
+	for i, to := range state.To {
+		r.To[i] = to.GetAddress()
+	}
+	for _, to := range state.OriginalTo {
+		r.OriginalTo = append(r.OriginalTo, to.GetAddress())
+	}
+	return r
+}
+
+func (r record) state() *smtp.State {
+	state := &smtp.State{
+		From:            &smtp.MailAddress{Address: r.From},
+		To:              make([]*smtp.MailAddress, len(r.To)),
+		Data:            r.Data,
+		EightBitMIME:    r.EightBitMIME,
+		Secure:          r.Secure,
+		SessionId:       r.SessionId,
+		Ip:              r.Ip,
+		Hostname:        r.Hostname,
+		Proto:           r.Proto,
+		ClientName:      r.ClientName,
+		FCrDNSOk:        r.FCrDNSOk,
+		Authenticated:   r.Authenticated,
+		AuthUser:        r.AuthUser,
+		DMARCResult:     r.DMARCResult,
+		RateLimitGroup:  r.RateLimitGroup,
+		PipelinedBefore: r.PipelinedBefore,
+		DataStart:       r.DataStart,
+		RequireTLS:      r.RequireTLS,
+		DKIMResults:     r.DKIMResults,
+	}
+	if r.OriginalFrom != "" {
+		state.OriginalFrom = &smtp.MailAddress{Address: r.OriginalFrom}
+	}
+	for i, to := range r.To {
+		state.To[i] = &smtp.MailAddress{Address: to}
+	}
+	for _, to := range r.OriginalTo {
+		state.OriginalTo = append(state.OriginalTo, &smtp.MailAddress{Address: to})
+	}
+	return state
+}
@@ -0,0 +1,99 @@
+package persist
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBoltQueue(t *testing.T) {
+	c.Convey("Testing BoltDB queue", t, func() {
+		dir, err := ioutil.TempDir("", "persist")
+		c.So(err, c.ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "queue.db")
+
+		q, err := NewBoltQueue(path)
+		c.So(err, c.ShouldBeNil)
+
+		from, _ := smtp.ParseAddress("someone@somewhere.test")
+		to, _ := smtp.ParseAddress("guy1@somewhere.test")
+		for i := 0; i < 100; i++ {
+			_, err := q.Put(&smtp.State{
+				From:          &from,
+				To:            []*smtp.MailAddress{&to},
+				Data:          []byte("Mail " + strconv.Itoa(i) + "\n"),
+				SessionId:     smtp.Id{Timestamp: 1, Counter: uint32(i)},
+				Ip:            net.ParseIP("1.2.3.4"),
+				Authenticated: true,
+				AuthUser:      "someone",
+				DKIMResults:   []smtp.DKIMResult{{Domain: "somewhere.test", Selector: "s1", Verdict: "pass", Algorithm: "rsa-sha256"}},
+			})
+			c.So(err, c.ShouldBeNil)
+		}
+
+		ids, err := q.Ids()
+		c.So(err, c.ShouldBeNil)
+		c.So(ids, c.ShouldHaveLength, 100)
+
+		state, err := q.Get(ids[0])
+		c.So(err, c.ShouldBeNil)
+		c.So(state.From.GetAddress(), c.ShouldEqual, "someone@somewhere.test")
+		c.So(state.To, c.ShouldHaveLength, 1)
+		c.So(state.To[0].GetAddress(), c.ShouldEqual, "guy1@somewhere.test")
+		c.So(string(state.Data), c.ShouldEqual, "Mail 0\n")
+		c.So(state.SessionId, c.ShouldResemble, smtp.Id{Timestamp: 1, Counter: 0})
+		c.So(state.Ip.String(), c.ShouldEqual, "1.2.3.4")
+		c.So(state.AuthUser, c.ShouldEqual, "someone")
+		c.So(state.DKIMResults, c.ShouldResemble, []smtp.DKIMResult{{Domain: "somewhere.test", Selector: "s1", Verdict: "pass", Algorithm: "rsa-sha256"}})
+
+		c.So(q.Delete(ids[0]), c.ShouldBeNil)
+		_, err = q.Get(ids[0])
+		c.So(err, c.ShouldEqual, ErrNotFound)
+
+		// Crash before the worker handled the mails.
+		c.So(q.Close(), c.ShouldBeNil)
+
+		q, err = NewBoltQueue(path)
+		c.So(err, c.ShouldBeNil)
+		defer q.Close()
+
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		wg.Add(99)
+		handled := map[string]bool{}
+		m := mta.New(mta.Config{Queue: q, GracePeriod: time.Millisecond}, mta.HandlerFunc(func(state *smtp.State) error {
+			lock.Lock()
+			handled[string(state.Data)] = true
+			lock.Unlock()
+			wg.Done()
+			return nil
+		}))
+		wg.Wait()
+
+		c.So(handled, c.ShouldHaveLength, 99)
+		c.So(handled["Mail 0\n"], c.ShouldBeFalse)
+		c.So(handled["Mail 99\n"], c.ShouldBeTrue)
+
+		// Handled mails are removed from the queue.
+		for i := 0; i < 100; i++ {
+			ids, err = q.Ids()
+			if len(ids) == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.So(err, c.ShouldBeNil)
+		c.So(ids, c.ShouldBeEmpty)
+		m.Stop()
+	})
+}
@@ -0,0 +1,188 @@
+// Package rpcplugin passes received mail to a plugin in a separate process,
+// e.g. a spam filter written in another language.
+//
+// The plugin listens on a unix socket and serves JSON-RPC 1.0 (net/rpc/jsonrpc)
+// with the method
+//
+//	Plugin.HandleMail(state RPCState) error
+//
+// The plugin process has to be started before mail is received.
+package rpcplugin
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Name of the RPC method the plugin has to serve.
+const handleMailMethod = "Plugin.HandleMail"
+
+type Config struct {
+	// PluginSocket is the path of the unix socket the plugin listens on.
+	PluginSocket string
+}
+
+// RPCState is the JSON version of smtp.State that is sent to the plugin.
+type RPCState struct {
+	SessionId       string   `json:"session_id"`
+	Ip              string   `json:"ip"`
+	Hostname        string   `json:"hostname"`
+	Proto           string   `json:"proto"`
+	ClientName      string   `json:"client_name"`
+	From            string   `json:"from"`
+	OriginalFrom    string   `json:"original_from,omitempty"`
+	To              []string `json:"to"`
+	OriginalTo      []string `json:"original_to,omitempty"`
+	Data            []byte   `json:"data"`
+	EightBitMIME    bool     `json:"eight_bit_mime"`
+	Secure          bool     `json:"secure"`
+	Authenticated   bool     `json:"authenticated"`
+	AuthUser        string   `json:"auth_user,omitempty"`
+	FCrDNSOk        bool     `json:"fcrdns_ok"`
+	DMARCResult     string   `json:"dmarc_result,omitempty"`
+	RateLimitGroup  string   `json:"rate_limit_group,omitempty"`
+	PipelinedBefore bool     `json:"pipelined_before"`
+}
+
+// NewRPCState converts the state to an RPCState.
+func NewRPCState(state *smtp.State) RPCState {
+	rpcState := RPCState{
+		SessionId:       state.SessionId.String(),
+		Hostname:        state.Hostname,
+		Proto:           state.Proto,
+		ClientName:      state.ClientName,
+		To:              make([]string, len(state.To)),
+		Data:            state.Data,
+		EightBitMIME:    state.EightBitMIME,
+		Secure:          state.Secure,
+		Authenticated:   state.Authenticated,
+		AuthUser:        state.AuthUser,
+		FCrDNSOk:        state.FCrDNSOk,
+		DMARCResult:     state.DMARCResult,
+		RateLimitGroup:  state.RateLimitGroup,
+		PipelinedBefore: state.PipelinedBefore,
+	}
+	if state.Ip != nil {
+		rpcState.Ip = state.Ip.String()
+	}
+	if state.From != nil {
+		rpcState.From = state.From.GetAddress()
+	}
+	if state.OriginalFrom != nil {
+		rpcState.OriginalFrom = state.OriginalFrom.GetAddress()
+	}
+	for i, to := range state.To {
+		rpcState.To[i] = to.GetAddress()
+	}
+	for _, to := range state.OriginalTo {
+		rpcState.OriginalTo = append(rpcState.OriginalTo, to.GetAddress())
+	}
+	return rpcState
+}
+
+// PluginHandler is an mta.Handler that calls the plugin for every mail.
+type PluginHandler struct {
+	config Config
+
+	lock   sync.Mutex
+	client *rpc.Client
+}
+
+var _ mta.Handler = (*PluginHandler)(nil)
+
+// NewPluginHandler creates a handler for the plugin in the config.
+// The connection is made when the first mail is handled.
+func NewPluginHandler(c Config) *PluginHandler {
+	return &PluginHandler{
+		config: c,
+	}
+}
+
+// Handle calls the plugin and returns the error of the plugin or the connection.
+// A broken connection is made again once.
+func (h *PluginHandler) Handle(state *smtp.State) error {
+	rpcState := NewRPCState(state)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for retry := true; ; retry = false {
+		if h.client == nil {
+			conn, err := net.Dial("unix", h.config.PluginSocket)
+			if err != nil {
+				return err
+			}
+			h.client = jsonrpc.NewClient(conn)
+		}
+
+		var reply bool
+		err := h.client.Call(handleMailMethod, rpcState, &reply)
+		if _, ok := err.(rpc.ServerError); ok || err == nil {
+			return err
+		}
+
+		// The connection is broken.
+		h.client.Close()
+		h.client = nil
+		if !retry {
+			return err
+		}
+	}
+}
+
+// Close closes the connection to the plugin.
+func (h *PluginHandler) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.client == nil {
+		return nil
+	}
+	err := h.client.Close()
+	h.client = nil
+	return err
+}
+
+// Plugin is the interface of plugins written in Go.
+type Plugin interface {
+	HandleMail(state RPCState) error
+}
+
+// pluginService wraps a Plugin in a type net/rpc can register.
+type pluginService struct {
+	plugin Plugin
+}
+
+func (s *pluginService) HandleMail(state RPCState, reply *bool) error {
+	if err := s.plugin.HandleMail(state); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Serve serves the plugin on the listener until it is closed.
+func Serve(ln net.Listener, plugin Plugin) error {
+	if plugin == nil {
+		return errors.New("No plugin given")
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &pluginService{plugin: plugin}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
@@ -0,0 +1,96 @@
+package rpcplugin
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+type pluginFunc func(state RPCState) error
+
+func (f pluginFunc) HandleMail(state RPCState) error {
+	return f(state)
+}
+
+func TestPluginHandler(t *testing.T) {
+	c.Convey("Testing plugin handler", t, func() {
+		dir, err := ioutil.TempDir("", "rpcplugin")
+		c.So(err, c.ShouldBeNil)
+		defer os.RemoveAll(dir)
+		socket := filepath.Join(dir, "plugin.sock")
+
+		var received *RPCState
+		reject := false
+		serve := func() net.Listener {
+			ln, err := net.Listen("unix", socket)
+			c.So(err, c.ShouldBeNil)
+			go Serve(ln, pluginFunc(func(state RPCState) error {
+				if reject {
+					return errors.New("Looks like spam")
+				}
+				received = &state
+				return nil
+			}))
+			return ln
+		}
+		ln := serve()
+
+		from, _ := smtp.ParseAddress("someone@somewhere.test")
+		to1, _ := smtp.ParseAddress("guy1@somewhere.test")
+		to2, _ := smtp.ParseAddress("guy2@somewhere.test")
+		state := &smtp.State{
+			From:          &from,
+			To:            []*smtp.MailAddress{&to1, &to2},
+			Data:          []byte("Subject: test\n\nSome test email\n"),
+			EightBitMIME:  true,
+			SessionId:     smtp.Id{Timestamp: 1, Counter: 2},
+			Ip:            net.ParseIP("1.2.3.4"),
+			Hostname:      "home.sweet.home",
+			Proto:         "ESMTP",
+			Authenticated: true,
+			AuthUser:      "someone",
+		}
+
+		h := NewPluginHandler(Config{PluginSocket: socket})
+		defer h.Close()
+
+		c.So(h.Handle(state), c.ShouldBeNil)
+		c.So(received, c.ShouldNotBeNil)
+		c.So(received.SessionId, c.ShouldEqual, state.SessionId.String())
+		c.So(received.Ip, c.ShouldEqual, "1.2.3.4")
+		c.So(received.Hostname, c.ShouldEqual, "home.sweet.home")
+		c.So(received.Proto, c.ShouldEqual, "ESMTP")
+		c.So(received.From, c.ShouldEqual, "someone@somewhere.test")
+		c.So(received.To, c.ShouldResemble, []string{"guy1@somewhere.test", "guy2@somewhere.test"})
+		c.So(string(received.Data), c.ShouldEqual, "Subject: test\n\nSome test email\n")
+		c.So(received.EightBitMIME, c.ShouldBeTrue)
+		c.So(received.Authenticated, c.ShouldBeTrue)
+		c.So(received.AuthUser, c.ShouldEqual, "someone")
+
+		// Errors of the plugin are returned.
+		reject = true
+		err = h.Handle(state)
+		c.So(err, c.ShouldNotBeNil)
+		c.So(err.Error(), c.ShouldEqual, "Looks like spam")
+
+		// The connection is made again when the plugin is restarted.
+		reject = false
+		received = nil
+		ln.Close()
+		h.client.Close()
+		ln = serve()
+		defer ln.Close()
+		c.So(h.Handle(state), c.ShouldBeNil)
+		c.So(received, c.ShouldNotBeNil)
+
+		// No plugin listening.
+		h = NewPluginHandler(Config{PluginSocket: filepath.Join(dir, "missing.sock")})
+		c.So(h.Handle(state), c.ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter limits the number of bytes that can be read in a time window.
+// The same limiter can be shared between all sessions.
+type BandwidthLimiter interface {
+	// Allow is called after bytes were read. It returns how many of them
+	// fit in the current budget and how long the reader should wait
+	// before reading more.
+	Allow(bytes int) (allowed int, delay time.Duration)
+}
+
+// TokenBucketBandwidthLimiter is a BandwidthLimiter that uses a token bucket.
+// The bucket holds at most one second worth of bytes.
+type TokenBucketBandwidthLimiter struct {
+	lock           sync.Mutex
+	bytesPerSecond float64
+	tokens         float64
+	last           time.Time
+}
+
+// NewTokenBucketBandwidthLimiter creates a limiter that allows bytesPerSecond on average.
+// A bytesPerSecond of 0 or less means there is no limit.
+func NewTokenBucketBandwidthLimiter(bytesPerSecond float64) *TokenBucketBandwidthLimiter {
+	return &TokenBucketBandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+		tokens:         bytesPerSecond,
+		last:           time.Now(),
+	}
+}
+
+func (l *TokenBucketBandwidthLimiter) Allow(bytes int) (int, time.Duration) {
+	if l.bytesPerSecond <= 0 {
+		return bytes, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	if l.tokens > l.bytesPerSecond {
+		l.tokens = l.bytesPerSecond
+	}
+	l.last = now
+
+	allowed := bytes
+	if l.tokens < float64(bytes) {
+		allowed = int(l.tokens)
+		if allowed < 0 {
+			allowed = 0
+		}
+	}
+
+	// The bytes are already read, so the bucket can go below zero.
+	// The reader has to wait untill it is filled up again.
+	l.tokens -= float64(bytes)
+	if l.tokens >= 0 {
+		return allowed, 0
+	}
+
+	return allowed, time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second))
+}
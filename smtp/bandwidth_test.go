@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBandwidthLimiter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping slow bandwidth test in short mode")
+	}
+
+	// About 1 MB of data
+	line := strings.Repeat("a", 99) + "\n"
+	data := []byte(strings.Repeat(line, 1024*1024/len(line)) + ".\n")
+
+	dataReader := NewDataReader(bufio.NewReader(bytes.NewReader(data)))
+	dataReader.Limiter = NewTokenBucketBandwidthLimiter(100 * 1024)
+
+	start := time.Now()
+	output, err := ioutil.ReadAll(dataReader)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Errorf("Did not expect error: %v", err)
+	}
+	if len(output) != len(data)-2 {
+		t.Errorf("Expected %d bytes, got %d", len(data)-2, len(output))
+	}
+	if elapsed < 8*time.Second || elapsed > 12*time.Second {
+		t.Errorf("Expected reading to take about 10 seconds, took %v", elapsed)
+	}
+}
+
+func TestTokenBucketBandwidthLimiterNoLimit(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		l := NewTokenBucketBandwidthLimiter(rate)
+		allowed, delay := l.Allow(1024 * 1024)
+		if allowed != 1024*1024 || delay != 0 {
+			t.Errorf("Expected no limit for %v bytes per second, got %d bytes and a delay of %v", rate, allowed, delay)
+		}
+	}
+}
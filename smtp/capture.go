@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// CaptureDirection tells if captured bytes were received or sent.
+type CaptureDirection int
+
+const (
+	// CaptureReceived are bytes from the client.
+	CaptureReceived CaptureDirection = iota
+	// CaptureSent are bytes to the client.
+	CaptureSent
+)
+
+func (d CaptureDirection) String() string {
+	if d == CaptureSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// CapturingEntry is the data of one read or write on the connection.
+type CapturingEntry struct {
+	Direction CaptureDirection
+	Timestamp time.Time
+	Data      []byte
+}
+
+// CapturingProtocol is an MtaProtocol that records all bytes it receives and
+// sends, like a packet capture. After STARTTLS the TLS records are captured.
+type CapturingProtocol struct {
+	*MtaProtocol
+	conn *capturingConn
+}
+
+// NewCapturingProtocol creates a protocol over c that keeps the last
+// maxEntries reads and writes, 1000 if maxEntries is 0.
+func NewCapturingProtocol(c net.Conn, maxEntries int) *CapturingProtocol {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	conn := &capturingConn{Conn: c, max: maxEntries}
+	return &CapturingProtocol{
+		MtaProtocol: NewMtaProtocol(conn),
+		conn:        conn,
+	}
+}
+
+// Entries returns a copy of what was captured so far, the oldest first.
+func (p *CapturingProtocol) Entries() []CapturingEntry {
+	return p.conn.snapshot()
+}
+
+// capturingConn records the reads and writes of a net.Conn.
+type capturingConn struct {
+	net.Conn
+	sync.Mutex
+	max     int
+	entries []CapturingEntry
+}
+
+func (c *capturingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(CaptureReceived, b[:n])
+	return n, err
+}
+
+func (c *capturingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record(CaptureSent, b[:n])
+	return n, err
+}
+
+// record adds an entry, the oldest one is dropped when there are max entries.
+func (c *capturingConn) record(direction CaptureDirection, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) == c.max {
+		copy(c.entries, c.entries[1:])
+		c.entries = c.entries[:len(c.entries)-1]
+	}
+	c.entries = append(c.entries, CapturingEntry{
+		Direction: direction,
+		Timestamp: time.Now(),
+		Data:      append([]byte{}, data...),
+	})
+}
+
+func (c *capturingConn) snapshot() []CapturingEntry {
+	c.Lock()
+	defer c.Unlock()
+	return append([]CapturingEntry{}, c.entries...)
+}
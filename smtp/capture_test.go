@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCapturingProtocol(t *testing.T) {
+	Convey("Testing CapturingProtocol", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		proto := NewCapturingProtocol(server, 3)
+
+		go client.Write([]byte("NOOP\r\n"))
+		cmd, err := proto.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldHaveSameTypeAs, NoopCmd{})
+
+		answer := make(chan string, 1)
+		go func() {
+			b := make([]byte, 100)
+			n, _ := client.Read(b)
+			answer <- string(b[:n])
+		}()
+		proto.Send(Answer{Status: Ok, Message: "OK"})
+
+		entries := proto.Entries()
+		So(entries, ShouldHaveLength, 2)
+		So(entries[0].Direction, ShouldEqual, CaptureReceived)
+		So(string(entries[0].Data), ShouldEqual, "NOOP\r\n")
+		So(entries[1].Direction, ShouldEqual, CaptureSent)
+		So(string(entries[1].Data), ShouldEqual, <-answer)
+		So(entries[1].Timestamp.Before(entries[0].Timestamp), ShouldBeFalse)
+
+		Convey("Only the last entries are kept", func() {
+			for _, line := range []string{"NOOP 1\r\n", "NOOP 2\r\n"} {
+				go client.Write([]byte(line))
+				_, err := proto.GetCmd()
+				So(err, ShouldBeNil)
+			}
+
+			entries := proto.Entries()
+			So(entries, ShouldHaveLength, 3)
+			So(entries[0].Direction, ShouldEqual, CaptureSent)
+			So(string(entries[1].Data), ShouldEqual, "NOOP 1\r\n")
+			So(string(entries[2].Data), ShouldEqual, "NOOP 2\r\n")
+		})
+	})
+}
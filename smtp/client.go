@@ -0,0 +1,295 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopistolet/gopistolet/log"
+)
+
+// MAX_REPLY_LINE is the maximum length of a reply line (RFC 5321 4.5.3.1.5).
+const MAX_REPLY_LINE = 512
+
+// ErrInvalidReply is returned by ClientProtocol.GetCmd for a reply that is
+// not valid SMTP.
+var ErrInvalidReply = errors.New("Invalid reply")
+
+// ClientProtocol is the client side of an SMTP connection, e.g. to a backend
+// MTA. Send sends commands and GetCmd returns the replies of the server, as
+// an Answer or, for multiline replies, a MultiAnswer.
+type ClientProtocol struct {
+	c     net.Conn
+	br    *bufio.Reader
+	state *State
+	// WriteTimeout is the maximum time a Send can take, 0 for no timeout.
+	// If it expires the connection is closed.
+	WriteTimeout time.Duration
+	// Set when a Send failed, no more commands will be sent then.
+	writeErr error
+}
+
+// NewClientProtocol creates a protocol that works over a socket to a server.
+// The net.Conn parameter will be closed when done.
+func NewClientProtocol(c net.Conn) *ClientProtocol {
+	return &ClientProtocol{
+		c:     c,
+		br:    bufio.NewReader(c),
+		state: &State{},
+	}
+}
+
+// Send sends a command to the server. A DataCmd without Data sends the DATA
+// command, a DataCmd with Data (after the 354 reply) sends the mail data.
+// Commands that can't be sent are logged and dropped, check Err.
+func (p *ClientProtocol) Send(c Cmd) {
+	if p.writeErr != nil {
+		return
+	}
+
+	var out []byte
+	if data, ok := c.(DataCmd); ok && data.Data != nil {
+		out = encodeData(data.Data)
+	} else {
+		line, err := CommandLine(c)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Cmd": fmt.Sprintf("%#v", c),
+			}).Warnf("Could not send cmd: %v", err)
+			return
+		}
+		out = []byte(line + "\r\n")
+	}
+
+	log.WithFields(log.Fields{
+		"Cmd": fmt.Sprintf("%#v", c),
+	}).Debug("Sending cmd to server")
+
+	if p.WriteTimeout > 0 {
+		p.c.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+	}
+	if _, err := p.c.Write(out); err != nil {
+		log.Warnf("Could not send cmd to server, closing connection: %v", err)
+		p.writeErr = err
+		p.c.Close()
+	}
+}
+
+// Err returns the error of the last Send that failed, nil if none did.
+func (p *ClientProtocol) Err() error {
+	return p.writeErr
+}
+
+// enhancedCodeRe matches an RFC 3463 status code at the start of a reply text.
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3}) `)
+
+// GetCmd reads a reply of the server.
+func (p *ClientProtocol) GetCmd() (*Cmd, error) {
+	if p.writeErr != nil {
+		return nil, p.writeErr
+	}
+
+	var status StatusCode
+	lines := []string{}
+	for {
+		buffer, err := ReadUntill('\n', MAX_REPLY_LINE, p.br)
+		if err != nil {
+			if err == ErrLtl {
+				SkipTillNewline(p.br)
+			}
+			return nil, err
+		}
+		line := strings.TrimSuffix(strings.TrimSuffix(string(buffer), "\n"), "\r")
+
+		if len(line) < 3 || (len(line) > 3 && line[3] != ' ' && line[3] != '-') {
+			return nil, ErrInvalidReply
+		}
+		code, err := strconv.ParseUint(line[:3], 10, 32)
+		if err != nil || code < 200 || code > 599 {
+			return nil, ErrInvalidReply
+		}
+		if len(lines) > 0 && StatusCode(code) != status {
+			return nil, ErrInvalidReply
+		}
+		status = StatusCode(code)
+
+		text := ""
+		if len(line) > 4 {
+			text = line[4:]
+		}
+		lines = append(lines, text)
+		if len(line) == 3 || line[3] == ' ' {
+			break
+		}
+	}
+
+	// The enhanced code is only split off if every line has the same one.
+	enhancedCode := ""
+	if m := enhancedCodeRe.FindStringSubmatch(lines[0]); m != nil && m[1][0] == byte('0'+status/100) {
+		enhancedCode = m[1]
+		for _, line := range lines {
+			if !strings.HasPrefix(line, enhancedCode+" ") {
+				enhancedCode = ""
+				break
+			}
+		}
+	}
+	if enhancedCode != "" {
+		for i := range lines {
+			lines[i] = strings.TrimPrefix(lines[i], enhancedCode+" ")
+		}
+	}
+
+	var cmd Cmd
+	if len(lines) == 1 {
+		cmd = Answer{Status: status, EnhancedCode: enhancedCode, Message: lines[0]}
+	} else {
+		cmd = MultiAnswer{Status: status, EnhancedCode: enhancedCode, Messages: lines}
+	}
+
+	log.WithFields(log.Fields{
+		"Cmd": fmt.Sprintf("%#v", cmd),
+	}).Debug("Received reply from server")
+	return &cmd, nil
+}
+
+func (p *ClientProtocol) Close() {
+	if p.writeErr != nil {
+		// Already closed
+		return
+	}
+	if err := p.c.Close(); err != nil {
+		log.Printf("Error while closing protocol: %v", err)
+	}
+}
+
+// StartTls starts the tls handshake as a client.
+func (p *ClientProtocol) StartTls(c *tls.Config) error {
+	tlsCon := tls.Client(p.c, c)
+	if err := tlsCon.Handshake(); err != nil {
+		return err
+	}
+
+	p.c = tlsCon
+	p.br.Reset(p.c)
+	tlsState := tlsCon.ConnectionState()
+	p.state.TLSState = &tlsState
+	return nil
+}
+
+// GetIP gets the ip of the server.
+func (p *ClientProtocol) GetIP() net.IP {
+	ip, _, err := net.SplitHostPort(p.c.RemoteAddr().String())
+	if err != nil {
+		log.Printf("Could not get ip: %v", p.c.RemoteAddr().String())
+		return nil
+	}
+
+	return net.ParseIP(ip)
+}
+
+func (p *ClientProtocol) GetState() *State {
+	return p.state
+}
+
+// CommandLine returns a command as it is sent over the wire, without the
+// CRLF. Parameters that aren't kept by the parser, like SIZE, are lost.
+// It returns an error for commands that can't be sent, like a BdatCmd
+// (whose chunk follows the command) or an UnknownCmd.
+func CommandLine(c Cmd) (string, error) {
+	switch cmd := c.(type) {
+	case HeloCmd:
+		return "HELO " + cmd.Domain, nil
+	case EhloCmd:
+		return "EHLO " + cmd.Domain, nil
+	case QuitCmd:
+		return "QUIT", nil
+	case MailCmd:
+		line := "MAIL FROM:<" + pathAddress(cmd.From) + ">"
+		if cmd.EightBitMIME {
+			line += " BODY=8BITMIME"
+		}
+		return line, nil
+	case RcptCmd:
+		return "RCPT TO:<" + pathAddress(cmd.To) + ">", nil
+	case DataCmd:
+		return "DATA", nil
+	case RsetCmd:
+		return "RSET", nil
+	case StartTlsCmd:
+		return "STARTTLS", nil
+	case NoopCmd:
+		return "NOOP", nil
+	case PingCmd:
+		return "PING", nil
+	case AuthCmd:
+		if cmd.InitialResponse != "" {
+			return "AUTH " + cmd.Mechanism + " " + cmd.InitialResponse, nil
+		}
+		return "AUTH " + cmd.Mechanism, nil
+	case XForwardCmd:
+		names := make([]string, 0, len(cmd.Attributes))
+		for name := range cmd.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		line := "XFORWARD"
+		for _, name := range names {
+			line += " " + name + "=" + cmd.Attributes[name]
+		}
+		return line, nil
+	case AtrnCmd:
+		if len(cmd.Domains) > 0 {
+			return "ATRN " + strings.Join(cmd.Domains, ","), nil
+		}
+		return "ATRN", nil
+	case HelpCmd:
+		if cmd.Topic != "" {
+			return "HELP " + cmd.Topic, nil
+		}
+		return "HELP", nil
+	case VrfyCmd:
+		return "VRFY " + cmd.Param, nil
+	case ExpnCmd:
+		return "EXPN " + cmd.ListName, nil
+	default:
+		return "", fmt.Errorf("can't send %T", c)
+	}
+}
+
+func pathAddress(address *MailAddress) string {
+	if address == nil {
+		return ""
+	}
+	return address.GetAddress()
+}
+
+// encodeData returns mail data with LF or CRLF line endings as it is sent
+// after DATA: with CRLF line endings, dot-stuffed and terminated by <CRLF>.<CRLF>.
+func encodeData(data []byte) []byte {
+	var b bytes.Buffer
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '.' {
+			b.WriteByte('.')
+		}
+		b.Write(bytes.TrimSuffix(line, []byte("\n")))
+		b.WriteString("\r\n")
+	}
+	b.WriteString(".\r\n")
+	return b.Bytes()
+}
@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClientProtocolReplies(t *testing.T) {
+	Convey("Testing ClientProtocol.GetCmd", t, func() {
+		client, server := net.Pipe()
+		defer server.Close()
+		p := NewClientProtocol(client)
+		defer p.Close()
+
+		go server.Write([]byte("220 mx.test ESMTP\r\n" +
+			"250-mx.test\r\n250-PIPELINING\r\n250 8BITMIME\r\n" +
+			"250 2.1.0 Ok\r\n" +
+			"550-5.1.1 No such\r\n550 5.1.1 user\r\n" +
+			"451 4.3.0\r\n" +
+			"354 Go ahead\r\n" +
+			"250-2.0.0 Ok\r\n250 Not the same code\r\n" +
+			"25O Oops\r\n"))
+
+		expected := []Cmd{
+			Answer{Status: Ready, Message: "mx.test ESMTP"},
+			MultiAnswer{Status: Ok, Messages: []string{"mx.test", "PIPELINING", "8BITMIME"}},
+			Answer{Status: Ok, EnhancedCode: "2.1.0", Message: "Ok"},
+			MultiAnswer{Status: MailboxUnavailable, EnhancedCode: "5.1.1", Messages: []string{"No such", "user"}},
+			Answer{Status: LocalError, Message: "4.3.0"},
+			Answer{Status: StartData, Message: "Go ahead"},
+			MultiAnswer{Status: Ok, Messages: []string{"2.0.0 Ok", "Not the same code"}},
+		}
+		for _, e := range expected {
+			cmd, err := p.GetCmd()
+			So(err, ShouldBeNil)
+			So(*cmd, ShouldResemble, e)
+		}
+
+		_, err := p.GetCmd()
+		So(err, ShouldEqual, ErrInvalidReply)
+	})
+}
+
+func TestClientProtocolSend(t *testing.T) {
+	Convey("Testing ClientProtocol.Send", t, func() {
+		client, server := net.Pipe()
+		p := NewClientProtocol(client)
+
+		sent := make(chan string)
+		go func() {
+			b, _ := ioutil.ReadAll(bufio.NewReader(server))
+			sent <- string(b)
+		}()
+
+		from, _ := ParseAddress("someone@somewhere.test")
+		to, _ := ParseAddress("guy1@somewhere.test")
+		p.Send(EhloCmd{Domain: "client.test"})
+		p.Send(MailCmd{From: &MailAddress{}})
+		p.Send(MailCmd{From: &from, EightBitMIME: true})
+		p.Send(RcptCmd{To: &to})
+		p.Send(DataCmd{})
+		p.Send(DataCmd{Data: []byte("Subject: test\n\n.dot\r\nno newline")})
+		p.Send(DataCmd{Data: []byte{}})
+		p.Send(BdatCmd{Size: 1})
+		p.Send(XForwardCmd{Attributes: map[string]string{"NAME": "spike.test", "ADDR": "1.2.3.4"}})
+		p.Send(QuitCmd{})
+		p.Close()
+
+		So(<-sent, ShouldEqual, "EHLO client.test\r\n"+
+			"MAIL FROM:<>\r\n"+
+			"MAIL FROM:<someone@somewhere.test> BODY=8BITMIME\r\n"+
+			"RCPT TO:<guy1@somewhere.test>\r\n"+
+			"DATA\r\n"+
+			"Subject: test\r\n\r\n..dot\r\nno newline\r\n.\r\n"+
+			".\r\n"+
+			"XFORWARD ADDR=1.2.3.4 NAME=spike.test\r\n"+
+			"QUIT\r\n")
+		So(p.Err(), ShouldBeNil)
+	})
+}
@@ -84,3 +84,43 @@ func TestDataReaderTooLong(t *testing.T) {
 	data = []byte("Some text :)\naafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddddddddfsdaafsddddddd321\n")
 	expectError(t, data, ErrLtl)
 }
+
+func TestDataReaderCRLF(t *testing.T) {
+	read := func(data string) string {
+		dataReader := NewDataReader(bufio.NewReader(bytes.NewReader([]byte(data))))
+		dataReader.CRLF = true
+		output, err := ioutil.ReadAll(dataReader)
+		if err != nil {
+			t.Errorf("Did not expect error: %v", err)
+		}
+		return string(output)
+	}
+
+	// CRLF, bare LF and bare CR.
+	if output := read("crlf\r\nlf\ncr\rend\r\n.\r\n"); output != "crlf\r\nlf\r\ncr\r\nend\r\n" {
+		t.Errorf("Expected CRLF line endings, got %q", output)
+	}
+	if output := read("..dot\n.\n"); output != ".dot\r\n" {
+		t.Errorf("Expected the dot to be removed, got %q", output)
+	}
+	// A bare CR doesn't start a line, so it can't end the data.
+	if output := read("a\r.\r\nb\r\n.\r\n"); output != "a\r\n.\r\nb\r\n" {
+		t.Errorf("Expected the data to continue after a bare CR, got %q", output)
+	}
+
+	// CRLFs that are split over reads.
+	dataReader := NewDataReader(bufio.NewReader(bytes.NewReader([]byte("a\nb\n.\n"))))
+	dataReader.CRLF = true
+	output := []byte{}
+	b := make([]byte, 1)
+	for {
+		n, err := dataReader.Read(b)
+		output = append(output, b[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	if string(output) != "a\r\nb\r\n" {
+		t.Errorf("Expected CRLF line endings, got %q", output)
+	}
+}
@@ -2,6 +2,8 @@ package smtp
 
 import "bufio"
 
+import "io"
+import "strconv"
 import "strings"
 import "errors"
 
@@ -22,10 +24,11 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 	*/
 
 	var address *MailAddress
-	verb, args, err := parseLine(br)
+	line, err := readLine(br)
 	if err != nil {
 		return nil, err
 	}
+	verb, args := splitLine(line)
 	//conn.write(500, err.Error())
 	//conn.c.Close()
 
@@ -46,7 +49,12 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 
 	case "EHLO":
 		{
-			if len(args) != 1 {
+			// A session token of a previous session can follow the domain.
+			token, hasToken := args["SESSION-TOKEN"]
+			if hasToken {
+				delete(args, "SESSION-TOKEN")
+			}
+			if len(args) != 1 || (hasToken && (token.Operator != "=" || token.Value == "")) {
 				command = InvalidCmd{Cmd: "EHLO", Info: "EHLO requires exactly one valid address"}
 				break
 			}
@@ -54,7 +62,7 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			for _, arg := range args {
 				domain = arg.Key
 			}
-			command = EhloCmd{Domain: domain}
+			command = EhloCmd{Domain: domain, SessionToken: token.Value}
 		}
 
 	case "MAIL":
@@ -81,7 +89,14 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 				}
 			}
 
-			command = MailCmd{From: address, EightBitMIME: eightBitMIME}
+			requireTLS := false
+			for key := range args {
+				// Keywords without a value aren't upper cased by splitLine.
+				if strings.EqualFold(key, "REQUIRETLS") {
+					requireTLS = true
+				}
+			}
+			command = MailCmd{From: address, EightBitMIME: eightBitMIME, RequireTLS: requireTLS}
 		}
 
 	case "RCPT":
@@ -104,6 +119,25 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			}
 		}
 
+	case "BDAT":
+		{
+			params := strings.Fields(line)[1:]
+			if len(params) < 1 || len(params) > 2 || (len(params) == 2 && strings.ToUpper(params[1]) != "LAST") {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is BDAT <chunk-size> [LAST]"}
+				break
+			}
+			size, err := strconv.ParseInt(params[0], 10, 64)
+			if err != nil || size < 0 {
+				command = InvalidCmd{Cmd: verb, Info: "Invalid chunk size"}
+				break
+			}
+			command = BdatCmd{
+				Size: size,
+				Last: len(params) == 2,
+				R:    io.LimitReader(br, size),
+			}
+		}
+
 	case "RSET":
 		{
 			command = RsetCmd{}
@@ -168,6 +202,11 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			command = NoopCmd{}
 		}
 
+	case "PING":
+		{
+			command = PingCmd{}
+		}
+
 	case "QUIT":
 		{
 			command = QuitCmd{}
@@ -178,6 +217,73 @@ func (p *parser) ParseCommand(br *bufio.Reader) (command Cmd, err error) {
 			command = StartTlsCmd{}
 		}
 
+	case "AUTH":
+		{
+			// The initial response is base64 and can contain '=', so don't use the parsed args.
+			params := strings.Fields(line)[1:]
+			if len(params) < 1 || len(params) > 2 {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is AUTH <mechanism> [initial-response]"}
+				break
+			}
+
+			auth := AuthCmd{Mechanism: strings.ToUpper(params[0])}
+			if len(params) == 2 {
+				auth.InitialResponse = params[1]
+			}
+			command = auth
+		}
+
+	case "XFORWARD":
+		{
+			if len(args) == 0 {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is XFORWARD attribute=value..."}
+				break
+			}
+			attributes := map[string]string{}
+			for _, arg := range args {
+				if arg.Operator != "=" {
+					command = InvalidCmd{Cmd: verb, Info: "Syntax is XFORWARD attribute=value..."}
+					break
+				}
+				attributes[arg.Key] = arg.Value
+			}
+			if command == nil {
+				command = XForwardCmd{Attributes: attributes}
+			}
+		}
+
+	case "ATRN":
+		{
+			params := strings.Fields(line)[1:]
+			if len(params) > 1 {
+				command = InvalidCmd{Cmd: verb, Info: "Syntax is ATRN [domain[,domain]...]"}
+				break
+			}
+
+			atrn := AtrnCmd{}
+			if len(params) == 1 {
+				for _, domain := range strings.Split(params[0], ",") {
+					if domain == "" {
+						command = InvalidCmd{Cmd: verb, Info: "Syntax is ATRN [domain[,domain]...]"}
+						break
+					}
+					atrn.Domains = append(atrn.Domains, strings.ToLower(domain))
+				}
+			}
+			if command == nil {
+				command = atrn
+			}
+		}
+
+	case "HELP":
+		{
+			topic := ""
+			for _, arg := range args {
+				topic = arg.Key
+			}
+			command = HelpCmd{Topic: topic}
+		}
+
 	default:
 		{
 			// TODO: CLEAN THIS UP
@@ -197,6 +303,17 @@ type Argument struct {
 
 // parseLine returns the verb of the line and a list of all comma separated arguments
 func parseLine(br *bufio.Reader) (string, map[string]Argument, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return line, map[string]Argument{}, err
+	}
+
+	verb, args := splitLine(line)
+	return verb, args, nil
+}
+
+// readLine reads a command line without the trailing <CRLF>.
+func readLine(br *bufio.Reader) (string, error) {
 	/*
 		RFC 5321
 		4.5.3.1.4.  Command Line
@@ -209,23 +326,34 @@ func parseLine(br *bufio.Reader) (string, map[string]Argument, error) {
 	if err != nil {
 		if err == ErrLtl {
 			SkipTillNewline(br)
-			return string(buffer), map[string]Argument{}, err
+			return string(buffer), err
 		}
 
-		return string(buffer), map[string]Argument{}, err
+		return string(buffer), err
 	}
 	line := string(buffer)
-	verb := ""
-	argMap := map[string]Argument{}
 
 	// Strip \n and \r
 	line = strings.TrimSuffix(line, "\n")
 	line = strings.TrimSuffix(line, "\r")
 
+	return line, nil
+}
+
+// splitLine returns the verb of the line and a list of all comma separated arguments
+//
+// Verbs and extension keywords are case-insensitive (RFC 5321 2.4): the verb
+// and the keys of "key=value" and "key:value" arguments are upper cased.
+// Arguments without an operator, like domains and addresses, are kept as they
+// are, because the local part of an address is case-sensitive.
+func splitLine(line string) (string, map[string]Argument) {
+	verb := ""
+	argMap := map[string]Argument{}
+
 	i := strings.Index(line, " ")
 	if i == -1 {
 		verb = strings.ToUpper(line)
-		return verb, map[string]Argument{}, nil
+		return verb, map[string]Argument{}
 	}
 
 	verb = strings.ToUpper(line[:i])
@@ -250,7 +378,7 @@ func parseLine(br *bufio.Reader) (string, map[string]Argument, error) {
 		argMap[argument.Key] = argument
 	}
 
-	return verb, argMap, nil
+	return verb, argMap
 }
 
 func parseFROM(from string) (*MailAddress, error) {
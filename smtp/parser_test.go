@@ -3,6 +3,7 @@ package smtp
 import (
 	"bufio"
 	_ "fmt"
+	"io/ioutil"
 	"strings"
 	"testing"
 
@@ -18,12 +19,16 @@ func TestParser(t *testing.T) {
 		commands += "helo relay.example.org\r\n"
 		commands += "helO relay.example.org\r\n"
 		commands += "EHLO other.example.org\r\n"
+		commands += "EHLO other.example.org session-token=dGVzdA\r\n"
+		commands += "EHLO session-token=dGVzdA other.example.org\r\n"
+		commands += "EHLO other.example.org session-token=\r\n"
 		commands += "MAIL FROM:<bob@example.org>\r\n"
 		commands += "MAIL FROM:<BOB@example.org>\r\n"
 		commands += "mail FROM:<bob@example.org>\r\n"
 		commands += "MAIL FROM:<bob@example.org> body=8BITMIME\r\n"
 		commands += "MAIL FROM:<bob@example.org> BODY=8bitmime\r\n"
 		commands += "MAIL FROM:<bob@example.org> BODY=7bit\r\n"
+		commands += "MAIL FROM:<bob@example.org> REQUIRETLS\r\n"
 		commands += "RCPT TO:<alice@example.com>\r\n"
 		commands += "RCPT TO:<theboss@example.com>\r\n"
 		commands += "RCPT to:<theboss@example.com>\r\n"
@@ -35,6 +40,13 @@ func TestParser(t *testing.T) {
 		commands += "VRFY jones\r\n"
 		commands += "EXPN staff\r\n"
 		commands += "NOOP\r\n"
+		commands += "HELP\r\n"
+		commands += "help mail\r\n"
+		commands += "AUTH external\r\n"
+		commands += "AUTH EXTERNAL dGVzdA==\r\n"
+		commands += "XFORWARD name=client.example.org ADDR=10.0.0.1\r\n"
+		commands += "ATRN\r\n"
+		commands += "ATRN Example.org,example.com\r\n"
 		commands += "QUIT\r\n"
 
 		br := bufio.NewReader(strings.NewReader(commands))
@@ -47,12 +59,16 @@ func TestParser(t *testing.T) {
 			HeloCmd{Domain: "relay.example.org"},
 			HeloCmd{Domain: "relay.example.org"},
 			EhloCmd{Domain: "other.example.org"},
+			EhloCmd{Domain: "other.example.org", SessionToken: "dGVzdA"},
+			EhloCmd{Domain: "other.example.org", SessionToken: "dGVzdA"},
+			InvalidCmd{Cmd: "EHLO", Info: "EHLO requires exactly one valid address"},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}},
 			MailCmd{From: &MailAddress{Address: "BOB@example.org"}},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true},
 			MailCmd{From: &MailAddress{Address: "bob@example.org"}},
+			MailCmd{From: &MailAddress{Address: "bob@example.org"}, RequireTLS: true},
 			RcptCmd{To: &MailAddress{Address: "alice@example.com"}},
 			RcptCmd{To: &MailAddress{Address: "theboss@example.com"}},
 			RcptCmd{To: &MailAddress{Address: "theboss@example.com"}},
@@ -64,6 +80,13 @@ func TestParser(t *testing.T) {
 			VrfyCmd{Param: "jones"},
 			ExpnCmd{ListName: "staff"},
 			NoopCmd{},
+			HelpCmd{},
+			HelpCmd{Topic: "mail"},
+			AuthCmd{Mechanism: "EXTERNAL"},
+			AuthCmd{Mechanism: "EXTERNAL", InitialResponse: "dGVzdA=="},
+			XForwardCmd{Attributes: map[string]string{"NAME": "client.example.org", "ADDR": "10.0.0.1"}},
+			AtrnCmd{},
+			AtrnCmd{Domains: []string{"example.org", "example.com"}},
 			QuitCmd{},
 		}
 
@@ -93,6 +116,36 @@ func TestParser(t *testing.T) {
 
 	})
 
+	Convey("Testing parser BDAT cmd", t, func() {
+		commands := ""
+		commands += "BDAT 5\r\n"
+		commands += "Hello"
+		commands += "BDAT 0 last\r\n"
+		commands += "quit\r\n"
+
+		br := bufio.NewReader(strings.NewReader(commands))
+		p := parser{}
+
+		command, err := p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command, ShouldHaveSameTypeAs, BdatCmd{})
+		So(command.(BdatCmd).Size, ShouldEqual, 5)
+		So(command.(BdatCmd).Last, ShouldBeFalse)
+		chunk, err := ioutil.ReadAll(command.(BdatCmd).R)
+		So(err, ShouldEqual, nil)
+		So(string(chunk), ShouldEqual, "Hello")
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command.(BdatCmd).Size, ShouldEqual, 0)
+		So(command.(BdatCmd).Last, ShouldBeTrue)
+
+		command, err = p.ParseCommand(br)
+		So(err, ShouldEqual, nil)
+		So(command, ShouldHaveSameTypeAs, QuitCmd{})
+
+	})
+
 	Convey("Testing parser with invalid commands", t, func() {
 
 		commands := ""
@@ -112,6 +165,15 @@ func TestParser(t *testing.T) {
 		commands += "MAIL To some@invalid\r\n"
 		commands += "MAIL FROM:some@valid.be BODY:8bitmime\r\n"
 		commands += "UNKN some unknown command\r\n"
+		commands += "AUTH\r\n"
+		commands += "AUTH PLAIN a b\r\n"
+		commands += "XFORWARD\r\n"
+		commands += "XFORWARD NAME\r\n"
+		commands += "ATRN example.org example.com\r\n"
+		commands += "ATRN example.org,,example.com\r\n"
+		commands += "BDAT\r\n"
+		commands += "BDAT -1\r\n"
+		commands += "BDAT 10 NOTLAST\r\n"
 
 		br := bufio.NewReader(strings.NewReader(commands))
 
@@ -134,6 +196,15 @@ func TestParser(t *testing.T) {
 			InvalidCmd{},
 			InvalidCmd{},
 			UnknownCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
+			InvalidCmd{},
 		}
 
 		for _, expectedCommand := range expectedCommands {
@@ -248,3 +319,91 @@ func TestParser(t *testing.T) {
 
 	})
 }
+
+func TestParserCase(t *testing.T) {
+
+	Convey("Testing verbs are case-insensitive", t, func() {
+		lines := []string{
+			"HELO relay.example.org",
+			"EHLO relay.example.org",
+			"MAIL FROM:<bob@example.org>",
+			"RCPT TO:<alice@example.com>",
+			"DATA",
+			"BDAT 0 LAST",
+			"RSET",
+			"SEND",
+			"SOML",
+			"SAML",
+			"VRFY jones",
+			"EXPN staff",
+			"NOOP",
+			"PING",
+			"QUIT",
+			"STARTTLS",
+			"AUTH PLAIN",
+			"XFORWARD NAME=client.example.org",
+			"ATRN example.org",
+			"HELP",
+		}
+
+		variants := func(verb string) []string {
+			lower := strings.ToLower(verb)
+			mixed := ""
+			for i, c := range lower {
+				if i%2 == 0 {
+					mixed += strings.ToUpper(string(c))
+				} else {
+					mixed += string(c)
+				}
+			}
+			return []string{verb, lower, strings.ToUpper(lower[:1]) + lower[1:], mixed}
+		}
+
+		p := parser{}
+		for _, line := range lines {
+			verb := strings.Fields(line)[0]
+			rest := strings.TrimPrefix(line, verb)
+
+			expected, err := p.ParseCommand(bufio.NewReader(strings.NewReader(line + "\r\n")))
+			So(err, ShouldBeNil)
+			So(expected, ShouldNotHaveSameTypeAs, UnknownCmd{})
+			So(expected, ShouldNotHaveSameTypeAs, InvalidCmd{})
+
+			for _, variant := range variants(verb) {
+				command, err := p.ParseCommand(bufio.NewReader(strings.NewReader(variant + rest + "\r\n")))
+				So(err, ShouldBeNil)
+				if _, ok := expected.(DataCmd); ok {
+					So(command, ShouldHaveSameTypeAs, expected)
+				} else if _, ok := expected.(BdatCmd); ok {
+					So(command, ShouldHaveSameTypeAs, expected)
+				} else {
+					So(command, ShouldResemble, expected)
+				}
+			}
+		}
+	})
+
+	Convey("Testing parameters are case-insensitive", t, func() {
+		p := parser{}
+		tests := []struct {
+			line     string
+			expected Cmd
+		}{
+			{"MAIL from:<bob@example.org> body=8bitmime", MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true}},
+			{"MAIL From:<bob@example.org> Body=8BitMime", MailCmd{From: &MailAddress{Address: "bob@example.org"}, EightBitMIME: true}},
+			{"MAIL FROM:<bob@example.org> requiretls", MailCmd{From: &MailAddress{Address: "bob@example.org"}, RequireTLS: true}},
+			{"MAIL FROM:<bob@example.org> RequireTLS", MailCmd{From: &MailAddress{Address: "bob@example.org"}, RequireTLS: true}},
+			{"RCPT to:<alice@example.com>", RcptCmd{To: &MailAddress{Address: "alice@example.com"}}},
+			{"AUTH plain", AuthCmd{Mechanism: "PLAIN"}},
+			{"XFORWARD name=client.example.org", XForwardCmd{Attributes: map[string]string{"NAME": "client.example.org"}}},
+			// The local part of an address is case-sensitive.
+			{"MAIL FROM:<Bob@example.org>", MailCmd{From: &MailAddress{Address: "Bob@example.org"}}},
+			{"RCPT TO:<Alice@example.com>", RcptCmd{To: &MailAddress{Address: "Alice@example.com"}}},
+		}
+		for _, test := range tests {
+			command, err := p.ParseCommand(bufio.NewReader(strings.NewReader(test.line + "\r\n")))
+			So(err, ShouldBeNil)
+			So(command, ShouldResemble, test.expected)
+		}
+	})
+}
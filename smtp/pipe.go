@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// NewPipeProtocol creates a protocol that reads the commands from r and
+// writes the answers to w, e.g. stdin and stdout, to run a session from a
+// script. The client has ip 127.0.0.1. Deadlines are not supported, so a
+// WriteTimeout or read timeouts have no effect.
+// r and w are closed when done if they are io.Closers.
+func NewPipeProtocol(r io.Reader, w io.Writer) Protocol {
+	return NewMtaProtocol(&pipeConn{r: r, w: w})
+}
+
+// pipeConn is a net.Conn over a reader and a writer.
+type pipeConn struct {
+	r io.Reader
+	w io.Writer
+}
+
+// pipeAddr is the address of both ends of a pipeConn.
+var pipeAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+var errPipeDeadline = errors.New("deadlines are not supported on pipes")
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *pipeConn) Close() error {
+	var err error
+	if closer, ok := c.r.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if closer, ok := c.w.(io.Closer); ok {
+		if werr := closer.Close(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return errPipeDeadline
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return errPipeDeadline
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return errPipeDeadline
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gopistolet/gopistolet/log"
 )
@@ -16,17 +18,32 @@ type StatusCode uint32
 
 // SMTP status codes
 const (
-	Ready             StatusCode = 220
-	Closing           StatusCode = 221
-	Ok                StatusCode = 250
-	StartData         StatusCode = 354
-	ShuttingDown      StatusCode = 421
-	SyntaxError       StatusCode = 500
-	SyntaxErrorParam  StatusCode = 501
-	NotImplemented    StatusCode = 502
-	BadSequence       StatusCode = 503
-	AbortMail         StatusCode = 552
-	NoValidRecipients StatusCode = 554
+	Help                StatusCode = 214
+	Ready               StatusCode = 220
+	Closing             StatusCode = 221
+	AuthSucceeded       StatusCode = 235
+	Ok                  StatusCode = 250
+	AuthContinue        StatusCode = 334
+	StartData           StatusCode = 354
+	ShuttingDown        StatusCode = 421
+	MailboxBusy         StatusCode = 450
+	LocalError          StatusCode = 451
+	InsufficientStorage StatusCode = 452
+	NoMail              StatusCode = 453
+	TempAuthFailure     StatusCode = 454
+	SyntaxError         StatusCode = 500
+	SyntaxErrorParam    StatusCode = 501
+	NotImplemented      StatusCode = 502
+	BadSequence         StatusCode = 503
+	ParamNotImplemented StatusCode = 504
+	AuthRequired        StatusCode = 530
+	EncryptionRequired  StatusCode = 530
+	AuthFailed          StatusCode = 535
+	EncryptionTooWeak   StatusCode = 538
+	MailboxUnavailable  StatusCode = 550
+	AbortMail           StatusCode = 552
+	NoValidRecipients   StatusCode = 554
+	TransactionFailed   StatusCode = 554
 )
 
 // ErrLtl Line too long error
@@ -38,6 +55,8 @@ var ErrIncomplete = errors.New("Incomplete data")
 const (
 	MAX_DATA_LINE = 1000
 	MAX_CMD_LINE  = 512
+	// RFC 4954 4: the maximum length of an AUTH response line.
+	MAX_AUTH_LINE = 12288
 )
 
 // ReadUntill reads untill delim is found or max bytes are read.
@@ -92,6 +111,14 @@ type DataReader struct {
 	br          *bufio.Reader
 	state       int
 	bytesInLine int
+	// Limiter is used to throttle the reader. Nil if there is no limit.
+	Limiter BandwidthLimiter
+	// CRLF makes the reader return CRLF line endings instead of LF.
+	// Bare LFs and bare CRs become CRLF too (RFC 5321 4.1.1.5), but a bare
+	// CR doesn't start a line that can end the data.
+	CRLF bool
+	// The LF of a CRLF that didn't fit in the buffer of the previous Read.
+	pendingLF bool
 }
 
 func NewDataReader(br *bufio.Reader) *DataReader {
@@ -118,10 +145,24 @@ func (r *DataReader) Read(b []byte) (n int, err error) {
 
 	br := r.br
 	for n < len(b) && r.state != stateEOF {
+		if r.pendingLF {
+			b[n] = '\n'
+			n++
+			r.pendingLF = false
+			continue
+		}
+		// Return what we have instead of waiting for more, so the caller
+		// can see the data is still coming.
+		if n > 0 && br.Buffered() == 0 {
+			break
+		}
 		var c byte
 		c, err = br.ReadByte()
 		if err != nil {
-			err = ErrIncomplete
+			// Timeouts are passed on, so the server can tell the client.
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				err = ErrIncomplete
+			}
 			break
 		}
 		r.bytesInLine++
@@ -187,6 +228,12 @@ func (r *DataReader) Read(b []byte) (n int, err error) {
 				r.bytesInLine = 0
 			}
 		}
+		if r.CRLF && (c == '\n' || c == '\r') {
+			b[n] = '\r'
+			n++
+			r.pendingLF = true
+			continue
+		}
 		b[n] = c
 		n++
 	}
@@ -195,6 +242,12 @@ func (r *DataReader) Read(b []byte) (n int, err error) {
 		err = io.EOF
 	}
 
+	if r.Limiter != nil && n > 0 {
+		if _, delay := r.Limiter.Allow(n); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+
 	return
 }
 
@@ -205,18 +258,27 @@ type Cmd interface {
 
 // Answer A raw SMTP answer. Used to send a status code + message.
 type Answer struct {
-	Status  StatusCode
-	Message string
+	Status StatusCode
+	// EnhancedCode is the RFC 3463 status code, e.g. "2.0.0".
+	// If empty, MtaProtocol uses the default one for Status.
+	EnhancedCode string
+	Message      string
 }
 
 func (c Answer) String() string {
+	if c.EnhancedCode != "" {
+		return fmt.Sprintf("%d %s %s", c.Status, c.EnhancedCode, c.Message)
+	}
 	return fmt.Sprintf("%d %s", c.Status, c.Message)
 }
 
 // MultiAnswer A multiline answer.
 type MultiAnswer struct {
-	Status   StatusCode
-	Messages []string
+	Status StatusCode
+	// EnhancedCode is the RFC 3463 status code, it is added to every line.
+	// If empty, MtaProtocol uses the default one for Status.
+	EnhancedCode string
+	Messages     []string
 }
 
 func (c MultiAnswer) String() string {
@@ -224,17 +286,48 @@ func (c MultiAnswer) String() string {
 		return fmt.Sprintf("%d", c.Status)
 	}
 
+	code := ""
+	if c.EnhancedCode != "" {
+		code = c.EnhancedCode + " "
+	}
+
 	result := ""
 	for i := 0; i < len(c.Messages)-1; i++ {
-		result += fmt.Sprintf("%d-%s", c.Status, c.Messages[i])
+		result += fmt.Sprintf("%d-%s%s", c.Status, code, c.Messages[i])
 		result += "\r\n"
 	}
 
-	result += fmt.Sprintf("%d %s", c.Status, c.Messages[len(c.Messages)-1])
+	result += fmt.Sprintf("%d %s%s", c.Status, code, c.Messages[len(c.Messages)-1])
 
 	return result
 }
 
+// enhancedCodes are the default RFC 3463 codes for the status codes.
+// There are none for intermediate replies.
+var enhancedCodes = map[StatusCode]string{
+	Help:                "2.0.0",
+	Closing:             "2.0.0",
+	AuthSucceeded:       "2.7.0",
+	Ok:                  "2.0.0",
+	ShuttingDown:        "4.3.2",
+	MailboxBusy:         "4.2.1",
+	LocalError:          "4.3.0",
+	InsufficientStorage: "4.5.3",
+	NoMail:              "4.2.0",
+	TempAuthFailure:     "4.7.0",
+	SyntaxError:         "5.5.2",
+	SyntaxErrorParam:    "5.5.4",
+	NotImplemented:      "5.5.1",
+	BadSequence:         "5.5.1",
+	ParamNotImplemented: "5.5.4",
+	AuthRequired:        "5.7.0",
+	AuthFailed:          "5.7.8",
+	EncryptionTooWeak:   "5.7.10",
+	MailboxUnavailable:  "5.1.1",
+	AbortMail:           "5.3.4",
+	NoValidRecipients:   "5.0.0",
+}
+
 // InvalidCmd is a known command with invalid arguments or syntax
 type InvalidCmd struct {
 	// The command
@@ -267,6 +360,9 @@ func (c HeloCmd) String() string {
 
 type EhloCmd struct {
 	Domain string
+	// SessionToken is the token of a previous session the client wants to
+	// resume, empty if none. It is not standard.
+	SessionToken string
 }
 
 func (c EhloCmd) String() string {
@@ -283,6 +379,8 @@ func (c QuitCmd) String() string {
 type MailCmd struct {
 	From         *MailAddress
 	EightBitMIME bool
+	// RequireTLS is set by the REQUIRETLS parameter (RFC 8689).
+	RequireTLS bool
 }
 
 func (c MailCmd) String() string {
@@ -326,6 +424,67 @@ func (c NoopCmd) String() string {
 	return ""
 }
 
+// PingCmd is the non-standard PING command, a health check for load balancers.
+type PingCmd struct{}
+
+func (c PingCmd) String() string {
+	return ""
+}
+
+// BdatCmd is the BDAT command of the CHUNKING extension (RFC 3030).
+type BdatCmd struct {
+	Size int64
+	Last bool
+	// R reads the chunk. It has to be read completely before the next command can be parsed.
+	R io.Reader
+}
+
+func (c BdatCmd) String() string {
+	return ""
+}
+
+type AuthCmd struct {
+	Mechanism string
+	// Base64 encoded initial response, empty if none was given.
+	InitialResponse string
+}
+
+func (c AuthCmd) String() string {
+	return ""
+}
+
+// XForwardCmd is the Postfix XFORWARD command.
+// See http://www.postfix.org/XFORWARD_README.html
+type XForwardCmd struct {
+	// Upper case attribute names with their value.
+	Attributes map[string]string
+}
+
+func (c XForwardCmd) String() string {
+	return ""
+}
+
+// AtrnCmd is the ATRN command of On-Demand Mail Relay (RFC 2645). The
+// client asks for the mail queued for its domains, the roles of client and
+// server are reversed to deliver it.
+type AtrnCmd struct {
+	// Lower case domains, empty for all domains of the authenticated client.
+	Domains []string
+}
+
+func (c AtrnCmd) String() string {
+	return ""
+}
+
+type HelpCmd struct {
+	// The command to get help for, empty for a list of all commands.
+	Topic string
+}
+
+func (c HelpCmd) String() string {
+	return ""
+}
+
 // Not implemented because of security concerns
 type VrfyCmd struct {
 	Param string
@@ -372,22 +531,83 @@ func (id *Id) String() string {
 
 // State contains all the state for a single client
 type State struct {
-	From         *MailAddress
+	From *MailAddress
+	// OriginalFrom is the sender given by the client when From was rewritten,
+	// nil otherwise.
+	OriginalFrom *MailAddress
 	To           []*MailAddress
+	// OriginalTo are the recipients given by the client when To was replaced
+	// by a catch-all address, nil otherwise.
+	OriginalTo   []*MailAddress
 	Data         []byte
 	EightBitMIME bool
 	Secure       bool
 	SessionId    Id
 	Ip           net.IP
 	Hostname     string
-}
-
-// reset the state
+	// Proto is the protocol the client uses: SMTP or ESMTP.
+	Proto string
+	// ClientName is the hostname of the client, if known.
+	ClientName string
+	// FCrDNSOk is true when the ip of the client passed the
+	// forward-confirmed reverse DNS check.
+	FCrDNSOk bool
+	// TLSState is the state of the TLS connection, nil if the connection isn't secure.
+	TLSState *tls.ConnectionState
+	// Authenticated is true when the client has successfully authenticated.
+	Authenticated bool
+	// AuthUser is the identity the client authenticated as.
+	AuthUser string
+	// DMARCResult is the DMARC disposition for the current message
+	// if a DMARC check was done.
+	DMARCResult string
+	// RateLimitGroup of the sender domain policy.
+	RateLimitGroup string
+	// PipelinedBefore is true when the client sent data before our greeting.
+	// Well-behaved clients wait for it, spambots often don't.
+	PipelinedBefore bool
+	// DataStart is the time the client started sending the mail data.
+	DataStart time.Time
+	// RequireTLS means the mail may only be relayed over TLS with a valid
+	// certificate (RFC 8689).
+	RequireTLS bool
+	// DKIMResults are the results of the DKIM signatures of the current
+	// message, if they were verified.
+	DKIMResults []DKIMResult
+}
+
+// DKIMResult is the result of verifying one DKIM signature (RFC 6376).
+type DKIMResult struct {
+	// Domain and Selector are the d= and s= tags of the signature.
+	Domain   string
+	Selector string
+	// Verdict is "pass", "fail", "none" (the message isn't signed),
+	// "permerror" or "temperror".
+	Verdict string
+	// Algorithm is the a= tag, e.g. "rsa-sha256".
+	Algorithm string
+}
+
+// Reset clears the state of the mail transaction: From, OriginalFrom, To,
+// OriginalTo, Data, EightBitMIME, RequireTLS, DKIMResults, DMARCResult,
+// RateLimitGroup and DataStart. The state of the session, like the
+// connection, TLS and authentication, is kept, so clients stay
+// authenticated after RSET and after a mail.
+// The backing array of To is reused, so it doesn't have to grow again after
+// RSET. The mta package doesn't reuse it after a mail was passed to a
+// handler, which may have kept it.
 func (s *State) Reset() {
 	s.From = nil
-	s.To = []*MailAddress{}
+	s.OriginalFrom = nil
+	s.To = s.To[:0]
+	s.OriginalTo = nil
 	s.Data = []byte{}
 	s.EightBitMIME = false
+	s.RequireTLS = false
+	s.DKIMResults = nil
+	s.DMARCResult = ""
+	s.RateLimitGroup = ""
+	s.DataStart = time.Time{}
 }
 
 // Checks the state if the client can send a MAIL command.
@@ -444,6 +664,13 @@ type MtaProtocol struct {
 	br     *bufio.Reader
 	parser parser
 	state  *State
+	// WriteTimeout is the maximum time a Send can take, 0 for no timeout.
+	// If it expires the connection is closed.
+	WriteTimeout time.Duration
+	// Set when a Send failed, no more commands will be sent then.
+	writeErr error
+	// Add enhanced status codes to answers, false for the greeting and HELO/EHLO.
+	enhancedCodes bool
 }
 
 // NewMtaProtocol Creates a protocol that works over a socket.
@@ -460,12 +687,52 @@ func NewMtaProtocol(c net.Conn) *MtaProtocol {
 }
 
 func (p *MtaProtocol) Send(c Cmd) {
+	if p.writeErr != nil {
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"Cmd":       fmt.Sprintf("%#v", c),
 		"SessionId": p.state.SessionId.String(),
 		"Ip":        p.state.Ip.String(),
 	}).Debug("Sending cmd")
-	fmt.Fprintf(p.c, "%s\r\n", c)
+
+	/*
+		RFC 2034 3
+
+		... the enhanced status code ... is placed on all 2xx, 4xx, and 5xx
+		replies ... except the initial greeting and any response to HELO or
+		EHLO.
+	*/
+	switch a := c.(type) {
+	case Answer:
+		if !p.enhancedCodes {
+			a.EnhancedCode = ""
+		} else if a.EnhancedCode == "" {
+			a.EnhancedCode = enhancedCodes[a.Status]
+		}
+		c = a
+	case MultiAnswer:
+		if !p.enhancedCodes {
+			a.EnhancedCode = ""
+		} else if a.EnhancedCode == "" {
+			a.EnhancedCode = enhancedCodes[a.Status]
+		}
+		c = a
+	}
+
+	if p.WriteTimeout > 0 {
+		p.c.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+	}
+	_, err := fmt.Fprintf(p.c, "%s\r\n", c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"SessionId": p.state.SessionId.String(),
+			"Ip":        p.state.Ip.String(),
+		}).Warnf("Could not send cmd, closing connection: %v", err)
+		p.writeErr = err
+		p.c.Close()
+	}
 }
 
 func (p *MtaProtocol) GetCmd() (*Cmd, error) {
@@ -482,16 +749,79 @@ func (p *MtaProtocol) GetCmd() (*Cmd, error) {
 		"SessionId": p.state.SessionId.String(),
 		"Ip":        p.state.Ip.String(),
 	}).Debug("Received cmd")
+
+	switch cmd.(type) {
+	case HeloCmd, EhloCmd:
+		p.enhancedCodes = false
+	default:
+		p.enhancedCodes = true
+	}
 	return &cmd, nil
 }
 
 func (p *MtaProtocol) Close() {
+	if p.writeErr != nil {
+		// Already closed
+		return
+	}
 	err := p.c.Close()
 	if err != nil {
 		log.Printf("Error while closing protocol: %v", err)
 	}
 }
 
+// ReadLine reads a line that is not a command, like the responses to AUTH
+// challenges. The line ending is removed.
+func (p *MtaProtocol) ReadLine() (string, error) {
+	buffer, err := ReadUntill('\n', MAX_AUTH_LINE, p.br)
+	if err != nil {
+		if err == ErrLtl {
+			SkipTillNewline(p.br)
+		}
+		return "", err
+	}
+	line := strings.TrimSuffix(string(buffer), "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// SetReadDeadline sets the deadline for reading commands and mail data.
+// A zero t means no deadline.
+func (p *MtaProtocol) SetReadDeadline(t time.Time) error {
+	return p.c.SetReadDeadline(t)
+}
+
+// WaitForInput waits at most d for the client to send something.
+// It returns true if there is input, which is left for GetCmd.
+func (p *MtaProtocol) WaitForInput(d time.Duration) bool {
+	p.c.SetReadDeadline(time.Now().Add(d))
+	defer p.c.SetReadDeadline(time.Time{})
+
+	_, err := p.br.Peek(1)
+	return err == nil
+}
+
+// Reverse hands over the connection to deliver mail to the client after
+// ATRN (RFC 2645), the protocol can't be used anymore afterwards. Input that
+// was already buffered is read first. Closing the returned connection does
+// nothing, it is still closed by Close.
+func (p *MtaProtocol) Reverse() net.Conn {
+	return &reversedConn{Conn: p.c, br: p.br}
+}
+
+// reversedConn is the connection of an MtaProtocol after Reverse.
+type reversedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *reversedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+func (c *reversedConn) Close() error {
+	return nil
+}
+
 func (p *MtaProtocol) StartTls(c *tls.Config) error {
 	tlsCon := tls.Server(p.c, c)
 	err := tlsCon.Handshake()
@@ -501,6 +831,8 @@ func (p *MtaProtocol) StartTls(c *tls.Config) error {
 
 	p.c = tlsCon
 	p.br.Reset(p.c)
+	tlsState := tlsCon.ConnectionState()
+	p.state.TLSState = &tlsState
 	return nil
 }
 
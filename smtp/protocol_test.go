@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWaitForInput(t *testing.T) {
+	Convey("Testing WaitForInput", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		p := NewMtaProtocol(server)
+		defer p.Close()
+
+		So(p.WaitForInput(10*time.Millisecond), ShouldBeFalse)
+
+		go client.Write([]byte("QUIT\r\n"))
+		So(p.WaitForInput(time.Second), ShouldBeTrue)
+
+		// The input is still there for GetCmd.
+		cmd, err := p.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldHaveSameTypeAs, QuitCmd{})
+	})
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	Convey("Testing enhanced status codes", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		p := NewMtaProtocol(server)
+
+		lines := make(chan string, 10)
+		go func() {
+			br := bufio.NewReader(client)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					close(lines)
+					return
+				}
+				lines <- line
+			}
+		}()
+
+		// No enhanced code in the greeting.
+		p.Send(Answer{Status: Ready, Message: "home.sweet.home Service Ready"})
+		So(<-lines, ShouldEqual, "220 home.sweet.home Service Ready\r\n")
+
+		// Nor in the answer to EHLO.
+		go client.Write([]byte("EHLO some.sender\r\n"))
+		_, err := p.GetCmd()
+		So(err, ShouldBeNil)
+		p.Send(MultiAnswer{Status: Ok, Messages: []string{"home.sweet.home", "OK"}})
+		So(<-lines, ShouldEqual, "250-home.sweet.home\r\n")
+		So(<-lines, ShouldEqual, "250 OK\r\n")
+		// Not even an explicit one.
+		p.Send(Answer{Status: MailboxUnavailable, EnhancedCode: "5.7.25", Message: "Reverse DNS check failed"})
+		So(<-lines, ShouldEqual, "550 Reverse DNS check failed\r\n")
+
+		go client.Write([]byte("MAIL FROM:<someone@somewhere.test>\r\n"))
+		_, err = p.GetCmd()
+		So(err, ShouldBeNil)
+		p.Send(Answer{Status: Ok, Message: "Sender ok"})
+		So(<-lines, ShouldEqual, "250 2.0.0 Sender ok\r\n")
+		p.Send(Answer{Status: NoValidRecipients, EnhancedCode: "5.7.1", Message: "Relay access denied"})
+		So(<-lines, ShouldEqual, "554 5.7.1 Relay access denied\r\n")
+		p.Send(MultiAnswer{Status: Help, Messages: []string{"Commands:", "HELO"}})
+		So(<-lines, ShouldEqual, "214-2.0.0 Commands:\r\n")
+		So(<-lines, ShouldEqual, "214 2.0.0 HELO\r\n")
+		p.Send(Answer{Status: StartData, Message: "Start mail input"})
+		So(<-lines, ShouldEqual, "354 Start mail input\r\n")
+	})
+}
+
+func TestStateReset(t *testing.T) {
+	Convey("Testing State.Reset", t, func() {
+		state := State{}
+		for i := 0; i < 100; i++ {
+			state.To = append(state.To, &MailAddress{Address: "guy@somewhere.test"})
+		}
+		capacity := cap(state.To)
+
+		state.Reset()
+		So(state.To, ShouldBeEmpty)
+		So(cap(state.To), ShouldEqual, capacity)
+
+		Convey("The authentication is kept", func() {
+			state.Authenticated = true
+			state.AuthUser = "user"
+			state.From = &MailAddress{Address: "someone@somewhere.test"}
+
+			state.Reset()
+			So(state.From, ShouldBeNil)
+			So(state.Authenticated, ShouldBeTrue)
+			So(state.AuthUser, ShouldEqual, "user")
+		})
+	})
+}
+
+func TestReadLine(t *testing.T) {
+	Convey("Testing ReadLine", t, func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		p := NewMtaProtocol(server)
+		defer p.Close()
+
+		go client.Write([]byte("dXNlcg==\r\nQUIT\r\n"))
+		line, err := p.ReadLine()
+		So(err, ShouldBeNil)
+		So(line, ShouldEqual, "dXNlcg==")
+
+		// Commands can be read after it.
+		cmd, err := p.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldHaveSameTypeAs, QuitCmd{})
+	})
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPipeProtocol(t *testing.T) {
+	Convey("Testing PipeProtocol", t, func() {
+		in := &struct {
+			*strings.Reader
+			closeRecorder
+		}{Reader: strings.NewReader("EHLO some.sender\r\nNOOP\nQUIT\r\n")}
+		out := &bytes.Buffer{}
+		p := NewPipeProtocol(in, out)
+
+		So(p.GetIP().String(), ShouldEqual, "127.0.0.1")
+
+		p.Send(Answer{Status: Ready, Message: "Service Ready"})
+		cmd, err := p.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldResemble, EhloCmd{Domain: "some.sender"})
+		p.Send(MultiAnswer{Status: Ok, Messages: []string{"home.sweet.home", "OK"}})
+		cmd, err = p.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldResemble, NoopCmd{})
+		p.Send(Answer{Status: Ok, Message: "OK"})
+		cmd, err = p.GetCmd()
+		So(err, ShouldBeNil)
+		So(*cmd, ShouldResemble, QuitCmd{})
+		_, err = p.GetCmd()
+		So(err, ShouldNotBeNil)
+
+		So(out.String(), ShouldEqual, "220 Service Ready\r\n250-home.sweet.home\r\n250 OK\r\n250 2.0.0 OK\r\n")
+
+		p.Close()
+		So(in.closed, ShouldBeTrue)
+	})
+}
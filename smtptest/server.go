@@ -0,0 +1,134 @@
+// Package smtptest provides an SMTP server for use in tests,
+// similar to net/http/httptest.
+package smtptest
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Server is an SMTP server listening on a random port on the loopback interface.
+type Server struct {
+	// Keep the counters first, they are used atomically.
+	connections int64
+	bytes       int64
+	messages    int64
+
+	mta  *mta.DefaultMta
+	ln   net.Listener
+	done chan error
+}
+
+// NewServer starts a server that calls handler for every mail it receives.
+// The server should be closed with Close when done.
+func NewServer(handler mta.Handler) *Server {
+	return newServer(mta.Config{}, handler)
+}
+
+// NewAuthServer starts a server like NewServer, that only accepts mail from
+// clients that authenticated with AUTH PLAIN as username and password.
+func NewAuthServer(handler mta.Handler, username, password string) *Server {
+	return newServer(mta.Config{
+		AuthBackend:       credentials{username: username, password: password},
+		AllowInsecureAuth: true,
+		DomainPolicies: map[string]mta.DomainPolicy{
+			"*": {RequireAuth: true},
+		},
+	}, handler)
+}
+
+func newServer(cfg mta.Config, handler mta.Handler) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("smtptest: could not listen: " + err.Error())
+	}
+
+	s := &Server{
+		done: make(chan error, 1),
+	}
+	s.ln = &countingListener{Listener: ln, server: s}
+
+	cfg.Hostname = "localhost"
+	cfg.GracePeriod = 100 * time.Millisecond
+	s.mta = mta.NewDefault(cfg, mta.HandlerFunc(func(state *smtp.State) error {
+		if err := handler.Handle(state); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.messages, 1)
+		return nil
+	}))
+
+	go func() {
+		s.done <- s.mta.Serve(s.ln)
+	}()
+
+	return s
+}
+
+// Addr returns the address the server is listening on, e.g. "127.0.0.1:1234".
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and waits untill all connections are closed.
+func (s *Server) Close() {
+	s.mta.Stop()
+	<-s.done
+}
+
+// Connections returns the number of connections that were accepted.
+func (s *Server) Connections() int64 {
+	return atomic.LoadInt64(&s.connections)
+}
+
+// BytesReceived returns the number of bytes received from all clients.
+func (s *Server) BytesReceived() int64 {
+	return atomic.LoadInt64(&s.bytes)
+}
+
+// MessagesDelivered returns the number of mails that were passed to the handler.
+func (s *Server) MessagesDelivered() int64 {
+	return atomic.LoadInt64(&s.messages)
+}
+
+// credentials is the AuthBackend of NewAuthServer.
+type credentials struct {
+	username, password string
+}
+
+func (c credentials) Authenticate(username, password string) error {
+	if username != c.username || password != c.password {
+		return errors.New("invalid username or password")
+	}
+	return nil
+}
+
+type countingListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.server.connections, 1)
+	return &countingConn{Conn: c, server: l.server}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	server *Server
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.server.bytes, int64(n))
+	return n, err
+}
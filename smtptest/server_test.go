@@ -0,0 +1,628 @@
+package smtptest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/outbound"
+	mtasmtp "github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServer(t *testing.T) {
+	c.Convey("Testing test server", t, func() {
+		var from, data string
+		s := NewServer(mta.HandlerFunc(func(state *mtasmtp.State) error {
+			from = state.From.Address
+			data = string(state.Data)
+			return nil
+		}))
+		defer s.Close()
+
+		msg := []byte("Subject: test\r\n\r\nSome test email\r\n")
+		err := smtp.SendMail(s.Addr(), nil, "someone@somewhere.test", []string{"guy1@somewhere.test"}, msg)
+		c.So(err, c.ShouldBeNil)
+
+		c.So(from, c.ShouldEqual, "someone@somewhere.test")
+		c.So(data, c.ShouldEqual, "Subject: test\n\nSome test email\n")
+
+		c.So(s.Connections(), c.ShouldEqual, 1)
+		c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+		c.So(s.BytesReceived(), c.ShouldBeGreaterThan, len(msg))
+	})
+}
+
+func TestSmarthost(t *testing.T) {
+	c.Convey("Testing relaying to a smarthost", t, func() {
+		var from, data string
+		smarthost := NewAuthServer(mta.HandlerFunc(func(state *mtasmtp.State) error {
+			from = state.From.Address
+			data = string(state.Data)
+			return nil
+		}), "user", "secret")
+		defer smarthost.Close()
+
+		msg := []byte("Subject: test\r\n\r\nSome test email\r\n")
+
+		c.Convey("Clients have to authenticate", func() {
+			err := smtp.SendMail(smarthost.Addr(), nil, "someone@somewhere.test", []string{"guy1@somewhere.test"}, msg)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err.Error(), c.ShouldStartWith, "530")
+			c.So(smarthost.MessagesDelivered(), c.ShouldEqual, 0)
+		})
+
+		c.Convey("Mails are relayed with the credentials", func() {
+			s := newServer(mta.Config{
+				Smarthost:         smarthost.Addr(),
+				SmarthostUser:     "user",
+				SmarthostPassword: "secret",
+			}, mta.HandlerFunc(func(state *mtasmtp.State) error {
+				return nil
+			}))
+			defer s.Close()
+
+			err := smtp.SendMail(s.Addr(), nil, "someone@somewhere.test", []string{"guy1@somewhere.test"}, msg)
+			c.So(err, c.ShouldBeNil)
+
+			c.So(smarthost.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(from, c.ShouldEqual, "someone@somewhere.test")
+			c.So(data, c.ShouldEqual, "Subject: test\n\nSome test email\n")
+		})
+
+		c.Convey("Mails are rejected with wrong credentials", func() {
+			handled := false
+			s := newServer(mta.Config{
+				Smarthost:         smarthost.Addr(),
+				SmarthostUser:     "user",
+				SmarthostPassword: "wrong",
+			}, mta.HandlerFunc(func(state *mtasmtp.State) error {
+				handled = true
+				return nil
+			}))
+			defer s.Close()
+
+			err := smtp.SendMail(s.Addr(), nil, "someone@somewhere.test", []string{"guy1@somewhere.test"}, msg)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err.Error(), c.ShouldStartWith, "554")
+			c.So(smarthost.MessagesDelivered(), c.ShouldEqual, 0)
+			// The client sends it again, so it isn't handled yet.
+			c.So(handled, c.ShouldBeFalse)
+		})
+
+		c.Convey("Errors of the handler don't reject relayed mails", func() {
+			s := newServer(mta.Config{
+				Smarthost:         smarthost.Addr(),
+				SmarthostUser:     "user",
+				SmarthostPassword: "secret",
+			}, mta.HandlerFunc(func(state *mtasmtp.State) error {
+				return errors.New("Something went wrong")
+			}))
+			defer s.Close()
+
+			err := smtp.SendMail(s.Addr(), nil, "someone@somewhere.test", []string{"guy1@somewhere.test"}, msg)
+			c.So(err, c.ShouldBeNil)
+			c.So(smarthost.MessagesDelivered(), c.ShouldEqual, 1)
+		})
+	})
+}
+
+func TestRequireTLSBounces(t *testing.T) {
+	c.Convey("Testing mails with REQUIRETLS are not sent without TLS", t, func() {
+		s := NewServer(mta.HandlerFunc(func(state *mtasmtp.State) error {
+			return nil
+		}))
+		defer s.Close()
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From:       &from,
+			To:         []*mtasmtp.MailAddress{&to},
+			Data:       []byte("Subject: test\n\nSome test email\n"),
+			RequireTLS: true,
+		}
+
+		client := &outbound.Client{Timeout: 5 * time.Second}
+		err := client.Deliver(s.Addr(), state)
+		c.So(err, c.ShouldHaveSameTypeAs, outbound.PermanentError{})
+		c.So(s.MessagesDelivered(), c.ShouldEqual, 0)
+
+		state.RequireTLS = false
+		c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+		c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+	})
+}
+
+type stubMTASTSFetcher struct {
+	policy *outbound.MTASTSPolicy
+}
+
+func (f stubMTASTSFetcher) Fetch(domain string) (*outbound.MTASTSPolicy, error) {
+	return f.policy, nil
+}
+
+func TestMTASTSEnforcement(t *testing.T) {
+	c.Convey("Testing MTA-STS enforcement", t, func() {
+		s := NewServer(mta.HandlerFunc(func(state *mtasmtp.State) error {
+			return nil
+		}))
+		defer s.Close()
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From: &from,
+			To:   []*mtasmtp.MailAddress{&to},
+			Data: []byte("Subject: test\n\nSome test email\n"),
+		}
+		policy := &outbound.MTASTSPolicy{
+			Mode:   outbound.MTASTSEnforce,
+			MX:     []string{"127.0.0.1"},
+			MaxAge: time.Hour,
+		}
+		client := &outbound.Client{
+			Timeout: 5 * time.Second,
+			MTASTS:  stubMTASTSFetcher{policy: policy},
+		}
+
+		c.Convey("Mails are not sent without TLS, and can be retried", func() {
+			err := client.Deliver(s.Addr(), state)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err, c.ShouldNotHaveSameTypeAs, outbound.PermanentError{})
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 0)
+		})
+
+		c.Convey("Mails are only sent to an MX of the policy", func() {
+			policy.MX = []string{"mx.somewhere.test"}
+			err := client.Deliver(s.Addr(), state)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err.Error(), c.ShouldContainSubstring, "not an MX")
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 0)
+		})
+
+		c.Convey("Policies in testing mode are not enforced", func() {
+			policy.Mode = outbound.MTASTSTesting
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+		})
+	})
+}
+
+type stubMXResolver []*net.MX
+
+func (r stubMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r, nil
+}
+
+func TestMXDelivery(t *testing.T) {
+	c.Convey("Testing delivery to the MX hosts of a domain", t, func() {
+		var handlerErr error
+		s := NewServer(mta.HandlerFunc(func(state *mtasmtp.State) error {
+			return handlerErr
+		}))
+		defer s.Close()
+		_, port, _ := net.SplitHostPort(s.Addr())
+		mxPort, _ := strconv.Atoi(port)
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From: &from,
+			To:   []*mtasmtp.MailAddress{&to},
+			Data: []byte("Subject: test\n\nSome test email\n"),
+		}
+
+		// Nothing listens on 127.0.0.2, the server only on 127.0.0.1.
+		client := &outbound.Client{
+			Timeout: 5 * time.Second,
+			MXResolver: stubMXResolver{
+				{Host: "127.0.0.1.", Pref: 20},
+				{Host: "127.0.0.2.", Pref: 10},
+			},
+			MXPort: mxPort,
+		}
+
+		c.Convey("The next MX is tried when one is down", func() {
+			err := client.MXDelivery(context.Background(), "somewhere.test", state)
+			c.So(err, c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+		})
+
+		c.Convey("At most MaxMXAttempts MX hosts are tried", func() {
+			client.MaxMXAttempts = 1
+			err := client.MXDelivery(context.Background(), "somewhere.test", state)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(s.Connections(), c.ShouldEqual, 0)
+		})
+
+		c.Convey("Permanent errors are not retried", func() {
+			handlerErr = mta.PermError{Err: errors.New("no thanks")}
+			client.MXResolver = stubMXResolver{
+				{Host: "127.0.0.1.", Pref: 10},
+				{Host: "127.0.0.1.", Pref: 20},
+			}
+			err := client.MXDelivery(context.Background(), "somewhere.test", state)
+			c.So(err, c.ShouldHaveSameTypeAs, outbound.PermanentError{})
+			c.So(s.Connections(), c.ShouldEqual, 1)
+		})
+
+		c.Convey("Temporary errors are retried on the next MX", func() {
+			handlerErr = mta.TempError{Err: errors.New("later")}
+			client.MXResolver = stubMXResolver{
+				{Host: "127.0.0.1.", Pref: 10},
+				{Host: "127.0.0.1.", Pref: 20},
+			}
+			err := client.MXDelivery(context.Background(), "somewhere.test", state)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err, c.ShouldNotHaveSameTypeAs, outbound.PermanentError{})
+			c.So(s.Connections(), c.ShouldEqual, 2)
+		})
+	})
+}
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	c.Convey("Testing self-signed certificates", t, func() {
+		certPEM, keyPEM, err := GenerateSelfSignedCert("localhost")
+		c.So(err, c.ShouldBeNil)
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		c.So(err, c.ShouldBeNil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		c.So(err, c.ShouldBeNil)
+		c.So(leaf.DNSNames, c.ShouldResemble, []string{"localhost"})
+		c.So(leaf.NotAfter.Sub(leaf.NotBefore), c.ShouldEqual, time.Hour)
+		c.So(leaf.KeyUsage, c.ShouldEqual, x509.KeyUsageDigitalSignature)
+		c.So(leaf.ExtKeyUsage, c.ShouldResemble, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
+
+		c.Convey("The certificate can be used for STARTTLS", func() {
+			dir, err := ioutil.TempDir("", "smtptest")
+			c.So(err, c.ShouldBeNil)
+			defer os.RemoveAll(dir)
+			certFile := filepath.Join(dir, "cert.pem")
+			keyFile := filepath.Join(dir, "key.pem")
+			c.So(ioutil.WriteFile(certFile, certPEM, 0600), c.ShouldBeNil)
+			c.So(ioutil.WriteFile(keyFile, keyPEM, 0600), c.ShouldBeNil)
+
+			s := newServer(mta.Config{TlsCert: certFile, TlsKey: keyFile}, mta.HandlerFunc(func(state *mtasmtp.State) error {
+				return nil
+			}))
+			defer s.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(leaf)
+			client, err := smtp.Dial(s.Addr())
+			c.So(err, c.ShouldBeNil)
+			defer client.Close()
+			c.So(client.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: roots}), c.ShouldBeNil)
+			c.So(client.Quit(), c.ShouldBeNil)
+		})
+	})
+}
+
+func TestOpportunisticTLS(t *testing.T) {
+	c.Convey("Testing opportunistic STARTTLS", t, func() {
+		certPEM, keyPEM, err := GenerateSelfSignedCert("localhost")
+		c.So(err, c.ShouldBeNil)
+		dir, err := ioutil.TempDir("", "smtptest")
+		c.So(err, c.ShouldBeNil)
+		defer os.RemoveAll(dir)
+		certFile := filepath.Join(dir, "cert.pem")
+		keyFile := filepath.Join(dir, "key.pem")
+		c.So(ioutil.WriteFile(certFile, certPEM, 0600), c.ShouldBeNil)
+		c.So(ioutil.WriteFile(keyFile, keyPEM, 0600), c.ShouldBeNil)
+
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+
+		var tlsUsed bool
+		handler := mta.HandlerFunc(func(state *mtasmtp.State) error {
+			tlsUsed = state.TLSState != nil
+			return nil
+		})
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From: &from,
+			To:   []*mtasmtp.MailAddress{&to},
+			Data: []byte("Subject: test\n\nSome test email\n"),
+		}
+		client := &outbound.Client{
+			Timeout:   5 * time.Second,
+			TLSConfig: &tls.Config{ServerName: "localhost", RootCAs: roots},
+		}
+
+		c.Convey("STARTTLS is used when the server offers it", func() {
+			s := newServer(mta.Config{TlsCert: certFile, TlsKey: keyFile}, handler)
+			defer s.Close()
+
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(tlsUsed, c.ShouldBeTrue)
+		})
+
+		c.Convey("Mails are sent in plaintext to servers without STARTTLS", func() {
+			s := NewServer(handler)
+			defer s.Close()
+
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(tlsUsed, c.ShouldBeFalse)
+		})
+
+		c.Convey("STARTTLS is not used when it's disabled", func() {
+			s := newServer(mta.Config{TlsCert: certFile, TlsKey: keyFile}, handler)
+			defer s.Close()
+
+			client.DisableOpportunisticTLS = true
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(tlsUsed, c.ShouldBeFalse)
+		})
+
+		c.Convey("Certificates are not verified", func() {
+			s := newServer(mta.Config{TlsCert: certFile, TlsKey: keyFile}, handler)
+			defer s.Close()
+			client.TLSConfig = &tls.Config{ServerName: "localhost"}
+
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(tlsUsed, c.ShouldBeTrue)
+
+			// Unless TLS is required.
+			client.RequireTLS = true
+			c.So(client.Deliver(s.Addr(), state), c.ShouldNotBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+		})
+
+		c.Convey("A failed handshake", func() {
+			s := newServer(mta.Config{TlsCert: certFile, TlsKey: keyFile}, handler)
+			defer s.Close()
+			// The server doesn't speak TLS 1.0.
+			client.TLSConfig = &tls.Config{ServerName: "localhost", RootCAs: roots, MaxVersion: tls.VersionTLS10}
+
+			c.Convey("falls back to plaintext", func() {
+				c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+				c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+				c.So(s.Connections(), c.ShouldEqual, 2)
+				c.So(tlsUsed, c.ShouldBeFalse)
+			})
+
+			c.Convey("fails the delivery with RequireTLS", func() {
+				client.RequireTLS = true
+				c.So(client.Deliver(s.Addr(), state), c.ShouldNotBeNil)
+				c.So(s.MessagesDelivered(), c.ShouldEqual, 0)
+				c.So(s.Connections(), c.ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestTLSRequired(t *testing.T) {
+	c.Convey("Testing the TLS-Required header field", t, func() {
+		certPEM, keyPEM, err := GenerateSelfSignedCert("localhost")
+		c.So(err, c.ShouldBeNil)
+		dir, err := ioutil.TempDir("", "smtptest")
+		c.So(err, c.ShouldBeNil)
+		defer os.RemoveAll(dir)
+		certFile := filepath.Join(dir, "cert.pem")
+		keyFile := filepath.Join(dir, "key.pem")
+		c.So(ioutil.WriteFile(certFile, certPEM, 0600), c.ShouldBeNil)
+		c.So(ioutil.WriteFile(keyFile, keyPEM, 0600), c.ShouldBeNil)
+
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+
+		var tlsUsed bool
+		handler := mta.HandlerFunc(func(state *mtasmtp.State) error {
+			tlsUsed = state.TLSState != nil
+			return nil
+		})
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From: &from,
+			To:   []*mtasmtp.MailAddress{&to},
+			Data: []byte("Subject: test\n\nSome test email\n"),
+		}
+		client := &outbound.Client{
+			Timeout:          5 * time.Second,
+			TLSConfig:        &tls.Config{ServerName: "localhost", RootCAs: roots},
+			HonorTLSRequired: true,
+		}
+
+		c.Convey("Mails are sent over TLS", func() {
+			s := newServer(mta.Config{TlsCert: certFile, TlsKey: keyFile}, handler)
+			defer s.Close()
+
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(tlsUsed, c.ShouldBeTrue)
+		})
+
+		c.Convey("Mails are not sent in plaintext, and can be retried", func() {
+			s := NewServer(handler)
+			defer s.Close()
+
+			err := client.Deliver(s.Addr(), state)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err, c.ShouldNotHaveSameTypeAs, outbound.PermanentError{})
+			c.So(err.Error(), c.ShouldContainSubstring, "TLS is required")
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 0)
+
+			// Not if the sender prefers delivery.
+			state.Data = []byte("Subject: test\r\nTLS-Required: No\r\n\r\nSome test email\r\n")
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(tlsUsed, c.ShouldBeFalse)
+		})
+
+		c.Convey("Only the header is checked", func() {
+			s := NewServer(handler)
+			defer s.Close()
+
+			state.Data = []byte("Subject: test\n\nTLS-Required: No\n")
+			c.So(client.Deliver(s.Addr(), state), c.ShouldNotBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 0)
+		})
+	})
+}
+
+func TestConnectionPool(t *testing.T) {
+	c.Convey("Testing the connection pool", t, func() {
+		s := NewServer(mta.HandlerFunc(func(state *mtasmtp.State) error {
+			return nil
+		}))
+		defer s.Close()
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From: &from,
+			To:   []*mtasmtp.MailAddress{&to},
+			Data: []byte("Subject: test\n\nSome test email\n"),
+		}
+		pool := &outbound.ConnectionPool{ConnectionIdleTimeout: 100 * time.Millisecond}
+		defer pool.Close()
+		client := &outbound.Client{Timeout: 5 * time.Second, Pool: pool}
+
+		c.Convey("Connections are reused", func() {
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 2)
+			c.So(s.Connections(), c.ShouldEqual, 1)
+		})
+
+		c.Convey("Idle connections are closed after the timeout", func() {
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			time.Sleep(200 * time.Millisecond)
+			_, err := pool.Get(s.Addr())
+			c.So(err, c.ShouldEqual, outbound.ErrNoIdleConnection)
+
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			c.So(s.Connections(), c.ShouldEqual, 2)
+		})
+
+		c.Convey("Connections over the limit are closed", func() {
+			for i := 0; i < 2; i++ {
+				conn, err := smtp.Dial(s.Addr())
+				c.So(err, c.ShouldBeNil)
+				pool.Put(s.Addr(), conn)
+			}
+			conn, err := pool.Get(s.Addr())
+			c.So(err, c.ShouldBeNil)
+			defer conn.Close()
+			_, err = pool.Get(s.Addr())
+			c.So(err, c.ShouldEqual, outbound.ErrNoIdleConnection)
+		})
+
+		c.Convey("Connections without TLS are not used for mails that need it", func() {
+			c.So(client.Deliver(s.Addr(), state), c.ShouldBeNil)
+			client.RequireTLS = true
+			c.So(client.Deliver(s.Addr(), state), c.ShouldNotBeNil)
+			c.So(s.MessagesDelivered(), c.ShouldEqual, 1)
+			c.So(s.Connections(), c.ShouldEqual, 2)
+		})
+	})
+}
+
+// serve421 answers 421 to the MAIL command on the first connection, and
+// accepts the mail on the others. It sends the MAIL and RCPT commands it got
+// to cmds.
+func serve421(ln net.Listener, cmds chan<- string) {
+	for first := true; ; first = false {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn, first bool) {
+			defer conn.Close()
+			text := textproto.NewConn(conn)
+			text.PrintfLine("220 localhost Service Ready")
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					return
+				}
+				verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+				switch verb {
+				case "EHLO":
+					text.PrintfLine("250 localhost")
+				case "MAIL", "RCPT":
+					cmds <- line
+					if first {
+						text.PrintfLine("421 Service not available, closing transmission channel")
+						return
+					}
+					text.PrintfLine("250 OK")
+				case "DATA":
+					text.PrintfLine("354 Start mail input")
+					text.ReadDotBytes()
+					text.PrintfLine("250 Mail delivered")
+				case "QUIT":
+					text.PrintfLine("221 Bye!")
+					return
+				default:
+					text.PrintfLine("502 Command not implemented")
+				}
+			}
+		}(conn, first)
+	}
+}
+
+func TestServiceNotAvailable(t *testing.T) {
+	c.Convey("Testing a 421 answer during the transaction", t, func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, c.ShouldBeNil)
+		defer ln.Close()
+		cmds := make(chan string, 10)
+		go serve421(ln, cmds)
+
+		from, _ := mtasmtp.ParseAddress("someone@somewhere.test")
+		to, _ := mtasmtp.ParseAddress("guy1@somewhere.test")
+		state := &mtasmtp.State{
+			From: &from,
+			To:   []*mtasmtp.MailAddress{&to},
+			Data: []byte("Subject: test\n\nSome test email\n"),
+		}
+
+		c.Convey("The mail is sent again over a new connection", func() {
+			client := &outbound.Client{Timeout: 5 * time.Second, MaxRetries: 1}
+			c.So(client.Deliver(ln.Addr().String(), state), c.ShouldBeNil)
+			close(cmds)
+			sent := []string{}
+			for cmd := range cmds {
+				sent = append(sent, cmd)
+			}
+			c.So(sent, c.ShouldResemble, []string{
+				"MAIL FROM:<someone@somewhere.test>",
+				"MAIL FROM:<someone@somewhere.test>",
+				"RCPT TO:<guy1@somewhere.test>",
+			})
+		})
+
+		c.Convey("Without retries the error is returned", func() {
+			client := &outbound.Client{Timeout: 5 * time.Second}
+			err := client.Deliver(ln.Addr().String(), state)
+			c.So(err, c.ShouldNotBeNil)
+			c.So(err.Error(), c.ShouldStartWith, "421")
+		})
+	})
+}
@@ -0,0 +1,151 @@
+// Package webhook delivers mail that is posted over HTTP to the handler of
+// an Mta, for services that can only send webhooks.
+package webhook
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gopistolet/gopistolet/log"
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+)
+
+// Maximum size of a request body.
+const maxRequestSize = 32 << 20
+
+// statusTempFailure is the status when the handler returned a temporary
+// error, 451 like the SMTP reply. Senders retry these deliveries.
+const statusTempFailure = http.StatusUnavailableForLegalReasons
+
+// WebhookHandler is an http.Handler that accepts
+//
+//	POST /deliver
+//	{"from": "a@b.com", "to": ["c@d.com"], "data": "<base64 RFC 5322 message>"}
+//
+// and passes the mail to the MailHandler of the Mta. It answers 200 when the
+// mail was delivered, 422 when the request is invalid or the handler returned
+// a PermError and 451 for other handler errors.
+type WebhookHandler struct {
+	// Token is the bearer token requests need in their Authorization header.
+	// Leave empty to allow all requests.
+	Token string
+
+	mta *mta.Mta
+}
+
+// request is the JSON body of a delivery.
+type request struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	Data string   `json:"data"`
+}
+
+// NewWebhookHandler creates a handler that delivers to the MailHandler of m.
+func NewWebhookHandler(m *mta.Mta) *WebhookHandler {
+	return &WebhookHandler{
+		mta: m,
+	}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/deliver" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	state, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		state.Ip = net.ParseIP(host)
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":   state.Ip.String(),
+		"From": state.From.GetAddress(),
+	}).Debug("Received mail over webhook")
+
+	if err := h.mta.MailHandler.Handle(state); err != nil {
+		log.Warnf("Handler did not accept mail: %v", err)
+		var permErr mta.PermError
+		if errors.As(err, &permErr) {
+			http.Error(w, "Transaction failed", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, "Temporary local failure", statusTempFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorized checks the bearer token.
+func (h *WebhookHandler) authorized(r *http.Request) bool {
+	if h.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+// parseRequest creates the state for the mail in the request body.
+func parseRequest(r *http.Request) (*smtp.State, error) {
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errors.New("Invalid JSON: " + err.Error())
+	}
+
+	state := &smtp.State{}
+	state.Reset()
+	state.Proto = "HTTP"
+
+	from, err := smtp.ParseAddress(req.From)
+	if err != nil {
+		return nil, errors.New("Invalid from address: " + err.Error())
+	}
+	state.From = &from
+
+	if len(req.To) == 0 {
+		return nil, errors.New("No recipients")
+	}
+	for _, rawTo := range req.To {
+		to, err := smtp.ParseAddress(rawTo)
+		if err != nil {
+			return nil, errors.New("Invalid to address: " + err.Error())
+		}
+		state.To = append(state.To, &to)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(req.Data)
+	if err != nil {
+		return nil, errors.New("Invalid data: " + err.Error())
+	}
+	// Handlers get the data with LF line endings, like from DATA.
+	state.Data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+
+	return state, nil
+}
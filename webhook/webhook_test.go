@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gopistolet/smtp/mta"
+	"github.com/gopistolet/smtp/smtp"
+	c "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	c.Convey("Testing webhook handler", t, func() {
+		var received *smtp.State
+		var handlerErr error
+		h := NewWebhookHandler(mta.New(mta.Config{}, mta.HandlerFunc(func(state *smtp.State) error {
+			received = state
+			return handlerErr
+		})))
+		h.Token = "secret"
+
+		post := func(path, token, body string) int {
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		data := base64.StdEncoding.EncodeToString([]byte("Subject: test\r\n\r\nSome test email\r\n"))
+		body := `{"from": "someone@somewhere.test", "to": ["guy1@somewhere.test", "guy2@somewhere.test"], "data": "` + data + `"}`
+
+		c.So(post("/deliver", "", body), c.ShouldEqual, http.StatusUnauthorized)
+		c.So(post("/deliver", "wrong", body), c.ShouldEqual, http.StatusUnauthorized)
+		c.So(post("/other", "secret", body), c.ShouldEqual, http.StatusNotFound)
+		c.So(received, c.ShouldBeNil)
+
+		c.So(post("/deliver", "secret", `{"from": "someone"}`), c.ShouldEqual, http.StatusUnprocessableEntity)
+		c.So(post("/deliver", "secret", `{"from": "someone@somewhere.test", "to": []}`), c.ShouldEqual, http.StatusUnprocessableEntity)
+		c.So(post("/deliver", "secret", `{"from": "someone@somewhere.test", "to": ["guy1@somewhere.test"], "data": "%%%"}`), c.ShouldEqual, http.StatusUnprocessableEntity)
+		c.So(post("/deliver", "secret", `not json`), c.ShouldEqual, http.StatusUnprocessableEntity)
+		c.So(received, c.ShouldBeNil)
+
+		c.So(post("/deliver", "secret", body), c.ShouldEqual, http.StatusOK)
+		c.So(received, c.ShouldNotBeNil)
+		c.So(received.From.GetAddress(), c.ShouldEqual, "someone@somewhere.test")
+		c.So(received.To, c.ShouldHaveLength, 2)
+		c.So(string(received.Data), c.ShouldEqual, "Subject: test\n\nSome test email\n")
+		c.So(received.Ip.String(), c.ShouldEqual, "192.0.2.1")
+
+		handlerErr = mta.TempError{Err: errors.New("Disk full")}
+		c.So(post("/deliver", "secret", body), c.ShouldEqual, 451)
+		handlerErr = errors.New("Backend down")
+		c.So(post("/deliver", "secret", body), c.ShouldEqual, 451)
+		handlerErr = mta.PermError{Err: errors.New("Spam")}
+		c.So(post("/deliver", "secret", body), c.ShouldEqual, http.StatusUnprocessableEntity)
+
+		r := httptest.NewRequest(http.MethodGet, "/deliver", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		c.So(w.Code, c.ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}